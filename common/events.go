@@ -19,8 +19,10 @@ package common
 import (
 	"github.com/amazechain/amc/common/block"
 	"github.com/amazechain/amc/common/transaction"
+	"github.com/amazechain/amc/common/types"
 	"github.com/amazechain/amc/modules/state"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"math/big"
 )
 
 // NewLocalTxsEvent local txs
@@ -57,3 +59,12 @@ type ChainHighestBlock struct {
 type MinedEntireEvent struct {
 	Entire state.EntireCode
 }
+
+// GasPriceChangeEvent is posted when the tip cap suggested by the gas price
+// oracle moves by more than its configured threshold.
+type GasPriceChangeEvent struct {
+	OldPrice *big.Int
+	NewPrice *big.Int
+	Head     types.Hash // Head the new price was computed for
+	Samples  int        // Number of values the new price was selected from
+}
@@ -485,7 +485,7 @@ func (tx *Transaction) EffectiveGasTip(baseFee *uint256.Int) (*uint256.Int, erro
 		return tx.GasTipCap(), nil
 	}
 	var err error
-	gasFeeCap := tx.GasFeeCap()
+	gasFeeCap := new(uint256.Int).Set(tx.GasFeeCap())
 	if gasFeeCap.Cmp(baseFee) == -1 {
 		err = ErrGasFeeCapTooLow
 	}
@@ -494,9 +494,9 @@ func (tx *Transaction) EffectiveGasTip(baseFee *uint256.Int) (*uint256.Int, erro
 
 func uint256Min(x, y *uint256.Int) *uint256.Int {
 	if x.Cmp(y) == 1 {
-		return x
+		return y
 	}
-	return y
+	return x
 }
 
 func isProtectedV(V *big.Int) bool {
@@ -86,3 +86,34 @@ func TestNewDynamicTx(t *testing.T) {
 	//addr := types.PublicToAddress(pub)
 
 }
+
+func TestEffectiveGasTip(t *testing.T) {
+	tx := NewTx(&DynamicFeeTx{
+		ChainID:   uint256.NewInt(1),
+		GasTipCap: uint256.NewInt(5),
+		GasFeeCap: uint256.NewInt(20),
+		Gas:       21000,
+	})
+	for _, tt := range []struct {
+		baseFee uint64
+		want    uint64
+		err     error
+	}{
+		{10, 5, nil},                // Capped by the tip cap
+		{18, 2, nil},                // Capped by the fee cap room above the base fee
+		{20, 0, nil},                // No room left for a tip
+		{25, 0, ErrGasFeeCapTooLow}, // Fee cap below the base fee
+	} {
+		tip, err := tx.EffectiveGasTip(uint256.NewInt(tt.baseFee))
+		if err != tt.err {
+			t.Errorf("base fee %d: error mismatch: have %v, want %v", tt.baseFee, err, tt.err)
+		}
+		if err == nil && tip.Uint64() != tt.want {
+			t.Errorf("base fee %d: tip mismatch: have %v, want %d", tt.baseFee, tip, tt.want)
+		}
+		// The transaction's own fee cap is left as it is
+		if have := tx.GasFeeCap().Uint64(); have != 20 {
+			t.Fatalf("base fee %d: fee cap modified: have %d, want 20", tt.baseFee, have)
+		}
+	}
+}
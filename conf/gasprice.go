@@ -3,11 +3,13 @@ package conf
 import (
 	"github.com/amazechain/amc/params"
 	"math/big"
+	"time"
 )
 
 var (
 	DefaultMaxPrice    = big.NewInt(500 * params.GWei)
 	DefaultIgnorePrice = big.NewInt(2 * params.Wei)
+	DefaultMaxAge      = 2 * time.Minute
 )
 
 type GpoConfig struct {
@@ -18,6 +20,132 @@ type GpoConfig struct {
 	Default          *big.Int `toml:",omitempty"`
 	MaxPrice         *big.Int `toml:",omitempty"`
 	IgnorePrice      *big.Int `toml:",omitempty"`
+
+	// IncludeCoinbaseTxs samples the transactions sent by the block's coinbase
+	// too, for single sequencer deployments where it authors most of them.
+	IncludeCoinbaseTxs bool `toml:",omitempty"`
+
+	// IncludeProposerTxs samples the transactions sent by the block's coinbase
+	// on the chains whose blocks are proposed by validators rather than mined,
+	// where the coinbase is a proposer whose own transactions are legitimate.
+	// It is ignored on proof of work chains.
+	IncludeProposerTxs bool `toml:",omitempty"`
+
+	// EpochCache keeps the tip cap suggestion for a whole consensus epoch
+	// instead of recomputing it at every new head, on chains whose engine
+	// defines an epoch length.
+	EpochCache bool `toml:",omitempty"`
+
+	// BlockConfirmations is the number of blocks behind the head the sampling
+	// starts at, leaving the blocks which might still be reorged out aside.
+	BlockConfirmations int `toml:",omitempty"`
+
+	// Blacklist holds the hex encoded hashes of the transactions never
+	// sampled, such as known spam paying manipulative tips.
+	Blacklist []string `toml:",omitempty"`
+
+	// ExcludedSenders holds the hex encoded addresses whose transactions are
+	// never sampled, like the coinbase ones, such as the fee recipients and
+	// validators of the chains whose coinbase isn't the block signer.
+	ExcludedSenders []string `toml:",omitempty"`
+
+	// SampleWindow, if set, samples all the blocks of the last SampleWindow
+	// seconds instead of a fixed number of blocks, up to MaxBlockHistory.
+	SampleWindow uint64 `toml:",omitempty"`
+
+	// SafetyMultiplier scales the suggestions up before they are capped by
+	// MaxPrice, erring on the high side to avoid stuck transactions. Defaults
+	// to 1.
+	SafetyMultiplier float64 `toml:",omitempty"`
+
+	// IdleTip, if set, is the tip cap suggested while the recent blocks hold
+	// no transaction but the coinbase ones and the mempool is empty, zero
+	// signaling that no tip is needed. Unset, the last suggestion is kept.
+	IdleTip *big.Int `toml:",omitempty"`
+
+	// UncleWeight, if set, samples the transactions of the uncles referenced
+	// by the sampled blocks too, their tips weighted by UncleWeight percent.
+	UncleWeight int `toml:",omitempty"`
+
+	// Denomination and Decimals describe the native unit of the chain's fees,
+	// used to format the suggestions for display. The suggestions themselves
+	// stay in base units. Decimals default to 18 if unset; an explicit zero
+	// formats the suggestions as whole units.
+	Denomination string `toml:",omitempty"`
+	Decimals     *int   `toml:",omitempty"`
+
+	// AutoTunePercentile nudges the percentile up whenever transactions paying
+	// the suggestion are reported not included, and down after a run of
+	// inclusions, within [MinPercentile, MaxPercentile].
+	AutoTunePercentile bool `toml:",omitempty"`
+	MinPercentile      int  `toml:",omitempty"`
+	MaxPercentile      int  `toml:",omitempty"`
+
+	// MaxChangeRatio, if set, limits how far a tip cap suggestion moves from
+	// the previous one, clamping it within [last/MaxChangeRatio,
+	// last*MaxChangeRatio]. The limit is lifted across deep reorgs.
+	MaxChangeRatio float64 `toml:",omitempty"`
+
+	// MaxAge is how long a cached suggestion is served while the head doesn't
+	// change, so that stalled block production doesn't serve a stale one
+	// forever. Defaults to DefaultMaxAge.
+	MaxAge time.Duration `toml:",omitempty"`
+
+	// SamplesPerBlock is the number of lowest tipping transactions sampled in
+	// each block. Defaults to 3.
+	SamplesPerBlock int `toml:",omitempty"`
+
+	// MaxSamplesPerSender, if set, caps the number of samples any single
+	// sender contributes over the sampled blocks, so that one flooding the
+	// blocks doesn't dominate the suggestion. Its lowest samples are kept.
+	MaxSamplesPerSender int `toml:",omitempty"`
+
+	// IgnoreSelfFallback leaves the blocks without any sampled transaction out
+	// of the sampling, rather than having them contribute the last suggestion.
+	// They still extend the sampling to older blocks, and the last suggestion
+	// is only kept if no block has a sample.
+	IgnoreSelfFallback bool `toml:",omitempty"`
+
+	// GasWeighted weighs each sampled tip by the gas used by its transaction
+	// when selecting the percentile, so that a heavy transaction counts more
+	// than a plain transfer. Unset, all the samples count the same.
+	GasWeighted bool `toml:",omitempty"`
+
+	// BaseFeeMultiplier is the factor the base fee is scaled by in the max fee
+	// per gas suggested for dynamic fee transactions, leaving room for it to
+	// rise before they are included. Defaults to 2.
+	BaseFeeMultiplier float64 `toml:",omitempty"`
+
+	// BaseFeeFloorFactor, if set, keeps the max fee per gas suggested for
+	// dynamic fee transactions at least this multiple of the average base fee
+	// of the sampled blocks, so that they survive a sustained rise.
+	BaseFeeFloorFactor float64 `toml:",omitempty"`
+
+	// MinSuggestedTip, if set, is the lowest tip cap ever suggested, whatever
+	// the sampled blocks, such as the minimum tip the mempools accept. Unlike
+	// IgnorePrice, it applies to the suggestion rather than to the samples.
+	MinSuggestedTip *big.Int `toml:",omitempty"`
+
+	// PriceChangeThreshold, if set, is the percentage by which a new tip cap
+	// suggestion must differ from the previous one for a GasPriceChangeEvent
+	// to be posted, for monitoring the fee volatility.
+	PriceChangeThreshold float64 `toml:",omitempty"`
+
+	// MaxConcurrentFetches, if set, bounds the number of blocks read at once
+	// while sampling, smoothing the database load under high RPC pressure.
+	MaxConcurrentFetches int `toml:",omitempty"`
+
+	// PercentileBlend, if set, makes SuggestBlendedTipCap suggest the weighted
+	// average of the tip caps at several percentiles, e.g. p60, p75 and p90
+	// weighted 0.5, 0.3 and 0.2, less sensitive to the exact percentile. The
+	// weights are normalized to sum to 1.
+	PercentileBlend []PercentileWeight `toml:",omitempty"`
+}
+
+// PercentileWeight is a percentile of a PercentileBlend along with its weight.
+type PercentileWeight struct {
+	Percentile int
+	Weight     float64
 }
 
 // FullNodeGPO contains default gasprice oracle settings for full node.
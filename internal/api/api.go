@@ -206,13 +206,18 @@ func NewAmcAPI(api *API) *AmcAPI {
 	return &AmcAPI{api}
 }
 
-// GasPrice returns a suggestion for a gas price for legacy transactions.
-func (s *AmcAPI) GasPrice(ctx context.Context) (*hexutil.Big, error) {
+// GasPrice returns a suggestion for a gas price for legacy transactions. If
+// noCache is set, the suggestion is sampled again instead of served from the
+// oracle's cache.
+func (s *AmcAPI) GasPrice(ctx context.Context, noCache *bool) (*hexutil.Big, error) {
 	conf.LightClientGPO.Default = big.NewInt(params.GWei)
 	//oracle := NewOracle(s.api.BlockChain(), conf.LightClientGPO)
+	if noCache != nil && *noCache {
+		s.api.gpo.Invalidate()
+	}
 	tipcap, err := s.api.gpo.SuggestTipCap(ctx, s.api.GetChainConfig())
 	if err != nil {
-		return nil, err
+		return nil, rpcGasPriceError(err)
 	}
 	if head := s.api.BlockChain().CurrentBlock().Header(); head.BaseFee64() != uint256.NewInt(0) {
 		tipcap.Add(tipcap, head.BaseFee64().ToBig())
@@ -224,14 +229,40 @@ func (s *AmcAPI) GasPrice(ctx context.Context) (*hexutil.Big, error) {
 }
 
 // MaxPriorityFeePerGas returns a suggestion for a gas tip cap for dynamic fee transactions.
-func (s *AmcAPI) MaxPriorityFeePerGas(ctx context.Context) (*hexutil.Big, error) {
+// If noCache is set, the suggestion is sampled again instead of served from the
+// oracle's cache.
+func (s *AmcAPI) MaxPriorityFeePerGas(ctx context.Context, noCache *bool) (*hexutil.Big, error) {
+	if noCache != nil && *noCache {
+		s.api.gpo.Invalidate()
+	}
 	tipcap, err := s.api.gpo.SuggestTipCap(ctx, s.api.GetChainConfig())
 	if err != nil {
-		return nil, err
+		return nil, rpcGasPriceError(err)
 	}
 	return (*hexutil.Big)(tipcap), err
 }
 
+// noChainHeadError is the JSON-RPC error of a gas price suggestion requested
+// before the chain has a head, which clients may retry.
+type noChainHeadError struct {
+	error
+}
+
+// ErrorCode returns the JSON error code of an unavailable resource.
+// See: https://eips.ethereum.org/EIPS/eip-1474
+func (e *noChainHeadError) ErrorCode() int {
+	return -32002
+}
+
+// rpcGasPriceError converts the errors of the gas price oracle meaningful to the
+// JSON-RPC clients.
+func rpcGasPriceError(err error) error {
+	if errors.Is(err, ErrNoChainHead) {
+		return &noChainHeadError{err}
+	}
+	return err
+}
+
 type feeHistoryResult struct {
 	OldestBlock  *hexutil.Big     `json:"oldestBlock"`
 	Reward       [][]*hexutil.Big `json:"reward,omitempty"`
@@ -1312,6 +1343,34 @@ func (debug *DebugAPI) GetAccount(ctx context.Context, address types.Address) {
 
 }
 
+type gasPriceStatsResult struct {
+	LastPrice      *hexutil.Big   `json:"lastPrice"`
+	LastHead       types.Hash     `json:"lastHead"`
+	LastFetch      hexutil.Uint64 `json:"lastFetch"`
+	HistoryEntries int            `json:"historyEntries"`
+	CheckBlocks    int            `json:"checkBlocks"`
+	Percentile     int            `json:"percentile"`
+	MaxPrice       *hexutil.Big   `json:"maxPrice"`
+}
+
+// GasPriceStats returns the state of the gas price oracle, the time of its last
+// computation being given in unix seconds, 0 if never.
+func (debug *DebugAPI) GasPriceStats(ctx context.Context) *gasPriceStatsResult {
+	stats := debug.api.gpo.Stats()
+	result := &gasPriceStatsResult{
+		LastPrice:      (*hexutil.Big)(stats.LastPrice),
+		LastHead:       stats.LastHead,
+		HistoryEntries: stats.HistoryEntries,
+		CheckBlocks:    stats.CheckBlocks,
+		Percentile:     stats.Percentile,
+		MaxPrice:       (*hexutil.Big)(stats.MaxPrice),
+	}
+	if !stats.LastFetch.IsZero() {
+		result.LastFetch = hexutil.Uint64(stats.LastFetch.Unix())
+	}
+	return result
+}
+
 // NetAPI offers network related RPC methods
 type NetAPI struct {
 	api            *API
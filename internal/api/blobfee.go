@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/amazechain/amc/common/block"
+	types2 "github.com/amazechain/amc/common/types"
+	"github.com/amazechain/amc/params"
+	"github.com/holiman/uint256"
+	"math/big"
+)
+
+const (
+	minBlobGasPrice            = 1       // Minimum blob base fee per blob gas (EIP-4844)
+	blobGasPriceUpdateFraction = 3338477 // Controls the blob base fee change rate (EIP-4844)
+)
+
+var errBlobsUnsupported = errors.New("blob transactions not enabled before Cancun")
+
+// BlobHeader is implemented by headers carrying the excess blob gas of
+// EIP-4844. Headers which don't, or return nil, are considered to predate the
+// blobs, as are all their ancestors.
+type BlobHeader interface {
+	ExcessBlobGas() *uint64
+}
+
+// blobFeeKey identifies the blob base fee of a header in the history cache,
+// which is purged along with the fee history on reorgs.
+type blobFeeKey struct {
+	hash types2.Hash
+}
+
+// SuggestBlobFee returns the blob base fee of the head along with a suggested
+// max fee per blob gas: the percentile of the blob base fees of the last
+// maxHeaderHistory headers, at least the current one. As the blob fee has no
+// tip, the max fee is what leaves room for the base fee to rise. Without any
+// blob history, the minimum blob base fee is suggested.
+func (oracle *Oracle) SuggestBlobFee(ctx context.Context, chainConfig *params.ChainConfig) (*big.Int, *big.Int, error) {
+	if chainConfig == nil {
+		return nil, nil, errNoChainConfig
+	}
+	current := oracle.currentBlock(chainConfig)
+	if current == nil || current.Header() == nil {
+		return nil, nil, ErrNoChainHead
+	}
+	if !chainConfig.IsCancun(current.Number64().Uint64()) {
+		return nil, nil, errBlobsUnsupported
+	}
+	var (
+		baseFee *big.Int
+		fees    []*big.Int
+		number  = current.Number64().Uint64()
+	)
+	for i := 0; i < oracle.maxHeaderHistory; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		header := oracle.backend.GetHeaderByNumber(uint256.NewInt(number))
+		if header == nil || !chainConfig.IsCancun(number) {
+			break
+		}
+		if blob, ok := header.(BlobHeader); !ok || blob.ExcessBlobGas() == nil {
+			break
+		}
+		fee := oracle.blobBaseFee(header)
+		if baseFee == nil {
+			baseFee = fee
+		}
+		fees = append(fees, fee)
+		if number == 0 {
+			break
+		}
+		number--
+	}
+	if baseFee == nil {
+		baseFee = big.NewInt(minBlobGasPrice)
+	}
+	return new(big.Int).Set(baseFee), SelectTipCap(fees, oracle.Percentile(), nil, baseFee), nil
+}
+
+// blobBaseFee returns the blob base fee of the header carrying blob gas, cached
+// by header hash.
+func (oracle *Oracle) blobBaseFee(header block.IHeader) *big.Int {
+	key := blobFeeKey{hash: header.Hash()}
+	if fee, ok := oracle.cache().Get(key); ok {
+		return fee.(*big.Int)
+	}
+	fee := calcBlobFee(*header.(BlobHeader).ExcessBlobGas())
+	oracle.cache().Add(key, fee)
+	return fee
+}
+
+// calcBlobFee computes the blob base fee from the excess blob gas (EIP-4844).
+func calcBlobFee(excessBlobGas uint64) *big.Int {
+	return fakeExponential(big.NewInt(minBlobGasPrice), new(big.Int).SetUint64(excessBlobGas), big.NewInt(blobGasPriceUpdateFraction))
+}
+
+// fakeExponential approximates factor * e ** (numerator / denominator) using
+// Taylor expansion, as specified by EIP-4844.
+func fakeExponential(factor, numerator, denominator *big.Int) *big.Int {
+	var (
+		output = new(big.Int)
+		accum  = new(big.Int).Mul(factor, denominator)
+	)
+	for i := 1; accum.Sign() > 0; i++ {
+		output.Add(output, accum)
+
+		accum.Mul(accum, numerator)
+		accum.Div(accum, denominator)
+		accum.Div(accum, big.NewInt(int64(i)))
+	}
+	return output.Div(output, denominator)
+}
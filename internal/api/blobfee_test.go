@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/conf"
+	"github.com/amazechain/amc/params"
+	"github.com/holiman/uint256"
+	"math/big"
+	"testing"
+)
+
+// blobHeader is a header carrying a fixed excess blob gas.
+type blobHeader struct {
+	block.IHeader
+	excess uint64
+}
+
+func (h *blobHeader) ExcessBlobGas() *uint64 {
+	return &h.excess
+}
+
+// blobBackend is a testBackend serving headers whose excess blob gas grows by
+// step with every block back from the head, down to the since one.
+type blobBackend struct {
+	*testBackend
+	step  uint64
+	since uint64
+	reads int
+}
+
+func (b *blobBackend) GetHeaderByNumber(number *uint256.Int) block.IHeader {
+	b.reads++
+	header := b.testBackend.GetHeaderByNumber(number)
+	if header == nil || number.Uint64() < b.since {
+		return header
+	}
+	head := b.CurrentBlock().Number64().Uint64()
+	return &blobHeader{IHeader: header, excess: (head - number.Uint64()) * b.step}
+}
+
+func TestFakeExponential(t *testing.T) {
+	for _, tt := range []struct {
+		factor, numerator, denominator, want int64
+	}{
+		{1, 0, 1, 1},
+		{1, 2, 1, 6},
+		{2, 5, 2, 23},
+		{1, 50000000, 2225652, 5709098764},
+	} {
+		have := fakeExponential(big.NewInt(tt.factor), big.NewInt(tt.numerator), big.NewInt(tt.denominator))
+		if have.Int64() != tt.want {
+			t.Errorf("fakeExponential(%d, %d, %d) mismatch: have %v, want %d", tt.factor, tt.numerator, tt.denominator, have, tt.want)
+		}
+	}
+}
+
+func TestSuggestBlobFee(t *testing.T) {
+	// The blob base fees are 1, 148, 22026 and 3269017 from the head back
+	backend := &blobBackend{testBackend: newTestBackend(5, nil), step: 5 * blobGasPriceUpdateFraction}
+	oracle := NewOracle(backend, nil, params.TestChainConfig, conf.GpoConfig{Blocks: 2, Percentile: 60, MaxHeaderHistory: 4, Default: big.NewInt(params.GWei)})
+
+	if _, _, err := oracle.SuggestBlobFee(context.Background(), params.TestChainConfig); !errors.Is(err, errBlobsUnsupported) {
+		t.Errorf("pre-Cancun error mismatch: have %v, want %v", err, errBlobsUnsupported)
+	}
+	config := *params.TestChainConfig
+	config.CancunBlock = big.NewInt(0)
+
+	baseFee, maxFee, err := oracle.SuggestBlobFee(context.Background(), &config)
+	if err != nil {
+		t.Fatalf("failed to suggest blob fee: %v", err)
+	}
+	if baseFee.Int64() != 1 {
+		t.Errorf("blob base fee mismatch: have %v, want 1", baseFee)
+	}
+	if maxFee.Int64() != 148 {
+		t.Errorf("max blob fee mismatch: have %v, want 148", maxFee)
+	}
+}
+
+func TestSuggestBlobFeeHistoryStart(t *testing.T) {
+	config := *params.TestChainConfig
+	config.CancunBlock = big.NewInt(0)
+
+	for i, tt := range []struct {
+		since           uint64
+		baseFee, maxFee int64
+		reads           int
+	}{
+		{0, 1, 22026, 5}, // Blob gas all the way back to the genesis
+		{3, 1, 1, 3},     // The headers before block 3 carry no blob gas
+		{5, 1, 1, 1},     // Nor does any header, e.g. plain block headers
+	} {
+		backend := &blobBackend{testBackend: newTestBackend(5, nil), step: 5 * blobGasPriceUpdateFraction, since: tt.since}
+		oracle := NewOracle(backend, nil, &config, conf.GpoConfig{Blocks: 2, Percentile: 60, MaxHeaderHistory: 1024, Default: big.NewInt(params.GWei)})
+		baseFee, maxFee, err := oracle.SuggestBlobFee(context.Background(), &config)
+		if err != nil {
+			t.Fatalf("test %d: failed to suggest blob fee: %v", i, err)
+		}
+		if baseFee.Int64() != tt.baseFee || maxFee.Int64() != tt.maxFee {
+			t.Errorf("test %d: fees mismatch: have %v/%v, want %d/%d", i, baseFee, maxFee, tt.baseFee, tt.maxFee)
+		}
+		// The history ends at the first header without blob gas
+		if backend.reads != tt.reads {
+			t.Errorf("test %d: header reads mismatch: have %d, want %d", i, backend.reads, tt.reads)
+		}
+	}
+	oracle := newTestOracle(newTestBackend(5, nil), conf.GpoConfig{})
+	if _, _, err := oracle.SuggestBlobFee(context.Background(), nil); !errors.Is(err, errNoChainConfig) {
+		t.Errorf("nil chain config error mismatch: have %v, want %v", err, errNoChainConfig)
+	}
+}
+
+func TestSuggestBlobFeeNilHead(t *testing.T) {
+	backend := &headlessBackend{newTestBackend(1, nil)}
+	oracle := NewOracle(backend, nil, params.TestChainConfig, conf.GpoConfig{Blocks: 2, Percentile: 60, Default: big.NewInt(params.GWei)})
+
+	config := *params.TestChainConfig
+	config.CancunBlock = big.NewInt(0)
+	if _, _, err := oracle.SuggestBlobFee(context.Background(), &config); !errors.Is(err, ErrNoChainHead) {
+		t.Errorf("error mismatch: have %v, want %v", err, ErrNoChainHead)
+	}
+}
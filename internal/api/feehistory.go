@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"github.com/amazechain/amc/common"
 	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/common/types"
 	"github.com/amazechain/amc/internal/consensus/misc"
 	"github.com/amazechain/amc/log"
 	"github.com/amazechain/amc/modules/rpc/jsonrpc"
@@ -56,8 +57,10 @@ type blockFees struct {
 	err     error
 }
 
+// cacheKey identifies the processed fees of a block by its hash, so that the
+// entries of reorged blocks are never served.
 type cacheKey struct {
-	number      uint64
+	hash        types.Hash
 	percentiles string
 }
 
@@ -89,6 +92,11 @@ func (s sortGasAndReward) Less(i, j int) bool {
 // the block field filled in, retrieves the block from the backend if not present yet and
 // fills in the rest of the fields.
 func (oracle *Oracle) processBlock(bf *blockFees, percentiles []float64) {
+	header, ok := bf.header.(*block.Header)
+	if !ok {
+		bf.err = fmt.Errorf("unsupported header type %T of block %d", bf.header, bf.blockNumber)
+		return
+	}
 	if bf.results.baseFee = bf.header.BaseFee64().ToBig(); bf.results.baseFee == nil {
 		bf.results.baseFee = new(big.Int)
 	}
@@ -97,12 +105,14 @@ func (oracle *Oracle) processBlock(bf *blockFees, percentiles []float64) {
 	bf.results.nextBaseFee = new(big.Int)
 
 	if oracle.chainConfig.IsLondon(bf.blockNumber + 1) {
-		bf.results.nextBaseFee = misc.CalcBaseFee(oracle.chainConfig, bf.header.(*block.Header))
+		bf.results.nextBaseFee = misc.CalcBaseFee(oracle.chainConfig, header)
 	} else {
 		bf.results.nextBaseFee = new(big.Int)
 	}
 
-	bf.results.gasUsedRatio = float64(bf.block.GasUsed()) / float64(bf.block.GasLimit())
+	if header.GasLimit > 0 {
+		bf.results.gasUsedRatio = float64(header.GasUsed) / float64(header.GasLimit)
+	}
 	if len(percentiles) == 0 {
 		// rewards were not requested, return null
 		return
@@ -146,7 +156,7 @@ func (oracle *Oracle) processBlock(bf *blockFees, percentiles []float64) {
 // also returned if requested and available.
 // Note: an error is only returned if retrieving the head header has failed. If there are no
 // retrievable blocks in the specified range then zero block count is returned with no error.
-func (oracle *Oracle) resolveBlockRange(ctx context.Context, reqEnd jsonrpc.BlockNumber, blocks int) (block.IBlock, []*block.Receipt, uint64, int, error) {
+func (oracle *Oracle) resolveBlockRange(ctx context.Context, reqEnd jsonrpc.BlockNumber, resolvedEnd *uint256.Int, blocks int) (block.IBlock, []*block.Receipt, uint64, int, error) {
 	var (
 		headBlock       block.IHeader
 		pendingBlock    block.IBlock
@@ -172,7 +182,10 @@ func (oracle *Oracle) resolveBlockRange(ctx context.Context, reqEnd jsonrpc.Bloc
 		)
 		switch reqEnd {
 		case jsonrpc.PendingBlockNumber:
-			if pendingBlock, pendingReceipts = oracle.miner.PendingBlockAndReceipts(); pendingBlock != nil {
+			if oracle.miner != nil {
+				pendingBlock, pendingReceipts = oracle.miner.PendingBlockAndReceipts()
+			}
+			if pendingBlock != nil {
 				resolved = pendingBlock.Header()
 			} else {
 				// Pending block not supported by backend, process only until latest block.
@@ -184,10 +197,13 @@ func (oracle *Oracle) resolveBlockRange(ctx context.Context, reqEnd jsonrpc.Bloc
 		case jsonrpc.LatestBlockNumber:
 			// Retrieved above.
 			resolved = headBlock
-		//case jsonrpc.SafeBlockNumber:
-		//case jsonrpc.FinalizedBlockNumber:
 		case jsonrpc.EarliestBlockNumber:
 			resolved = oracle.backend.GetHeaderByNumber(uint256.NewInt(0))
+		default:
+			// Other tags are resolved by the caller.
+			if resolvedEnd != nil {
+				resolved = oracle.backend.GetHeaderByNumber(resolvedEnd)
+			}
 		}
 		if resolved == nil || err != nil {
 			return nil, nil, 0, 0, err
@@ -246,7 +262,7 @@ func (oracle *Oracle) FeeHistory(ctx context.Context, blocks int, unresolvedLast
 		pendingReceipts []*block.Receipt
 		err             error
 	)
-	pendingBlock, pendingReceipts, lastBlock, blocks, err := oracle.resolveBlockRange(ctx, unresolvedLastBlock, blocks)
+	pendingBlock, pendingReceipts, lastBlock, blocks, err := oracle.resolveBlockRange(ctx, unresolvedLastBlock, resolvedLastBlock, blocks)
 	if err != nil || blocks == 0 {
 		return common.Big0, nil, nil, nil, err
 	}
@@ -276,26 +292,29 @@ func (oracle *Oracle) FeeHistory(ctx context.Context, blocks int, unresolvedLast
 					oracle.processBlock(fees, rewardPercentiles)
 					results <- fees
 				} else {
-					cacheKey := cacheKey{number: blockNumber, percentiles: string(percentileKey)}
+					number := uint256.NewInt(blockNumber)
+					if fees.header = oracle.backend.GetHeaderByNumber(number); fees.header == nil {
+						// send to results even if empty to guarantee that blocks items are sent in total
+						results <- fees
+						continue
+					}
+					cacheKey := cacheKey{hash: fees.header.Hash(), percentiles: string(percentileKey)}
 
-					if p, ok := oracle.historyCache.Get(cacheKey); ok {
+					if p, ok := oracle.cache().Get(cacheKey); ok {
 						fees.results = p.(processedFees)
 						results <- fees
 					} else {
 						if len(rewardPercentiles) != 0 {
-							fees.block, fees.err = oracle.backend.GetBlockByNumber(resolvedLastBlock)
+							fees.block, fees.err = oracle.backend.GetBlockByNumber(number)
 							if fees.block != nil && fees.err == nil {
 								fees.receipts, fees.err = oracle.backend.GetReceipts(fees.block.Hash())
 								fees.header = fees.block.Header()
 							}
-						} else {
-							fees.err = nil
-							fees.header = oracle.backend.GetHeaderByNumber(resolvedLastBlock)
 						}
 						if fees.header != nil && fees.err == nil {
 							oracle.processBlock(fees, rewardPercentiles)
 							if fees.err == nil {
-								oracle.historyCache.Add(cacheKey, fees.results)
+								oracle.cache().Add(cacheKey, fees.results)
 							}
 						}
 						// send to results even if empty to guarantee that blocks items are sent in total
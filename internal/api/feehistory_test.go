@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/conf"
+	"github.com/amazechain/amc/modules/rpc/jsonrpc"
+	"github.com/amazechain/amc/params"
+	"github.com/holiman/uint256"
+	"math/big"
+	"testing"
+)
+
+// testMiner serves a fixed pending block to the oracle.
+type testMiner struct {
+	pending block.IBlock
+}
+
+func (m *testMiner) Start() {}
+
+func (m *testMiner) PendingBlockAndReceipts() (block.IBlock, block.Receipts) {
+	return m.pending, nil
+}
+
+func TestFeeHistory(t *testing.T) {
+	backend := newTestBackendWithBaseFee(5, uint256.NewInt(8*params.GWei), nil)
+	for _, tt := range []struct {
+		count     int
+		last      jsonrpc.BlockNumber
+		oldest    int64
+		processed int
+	}{
+		{2, jsonrpc.LatestBlockNumber, 3, 2},
+		{3, 2, 0, 3},
+		{10, 2, 0, 3}, // Only the blocks since the genesis are available
+	} {
+		oracle := newTestOracle(backend, conf.GpoConfig{MaxHeaderHistory: 16})
+		oldest, reward, baseFee, gasUsedRatio, err := oracle.FeeHistory(context.Background(), tt.count, tt.last, nil, nil)
+		if err != nil {
+			t.Fatalf("count %d, last %d: failed to get fee history: %v", tt.count, tt.last, err)
+		}
+		if oldest.Int64() != tt.oldest {
+			t.Errorf("count %d, last %d: oldest block mismatch: have %v, want %d", tt.count, tt.last, oldest, tt.oldest)
+		}
+		if reward != nil {
+			t.Errorf("count %d, last %d: unrequested rewards returned", tt.count, tt.last)
+		}
+		if len(baseFee) != tt.processed+1 || len(gasUsedRatio) != tt.processed {
+			t.Fatalf("count %d, last %d: processed blocks mismatch: have %d base fees and %d ratios, want %d blocks", tt.count, tt.last, len(baseFee), len(gasUsedRatio), tt.processed)
+		}
+		for i := 0; i < tt.processed; i++ {
+			if baseFee[i].Cmp(big.NewInt(8*params.GWei)) != 0 {
+				t.Errorf("count %d, last %d: base fee %d mismatch: have %v, want %v", tt.count, tt.last, i, baseFee[i], 8*params.GWei)
+			}
+		}
+	}
+}
+
+func TestFeeHistoryPending(t *testing.T) {
+	backend := newTestBackendWithBaseFee(5, uint256.NewInt(8*params.GWei), nil)
+	pending := block.NewBlock(&block.Header{
+		ParentHash: backend.CurrentBlock().Hash(),
+		Number:     uint256.NewInt(5),
+		Difficulty: uint256.NewInt(0),
+		GasLimit:   params.GenesisGasLimit,
+		BaseFee:    uint256.NewInt(9 * params.GWei),
+	}, nil)
+	oracle := NewOracle(backend, &testMiner{pending: pending}, params.TestChainConfig, conf.GpoConfig{Blocks: 2, Percentile: 60, MaxHeaderHistory: 16, Default: big.NewInt(params.GWei)})
+
+	oldest, _, baseFee, _, err := oracle.FeeHistory(context.Background(), 2, jsonrpc.PendingBlockNumber, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to get fee history: %v", err)
+	}
+	if oldest.Int64() != 4 {
+		t.Errorf("oldest block mismatch: have %v, want 4", oldest)
+	}
+	if len(baseFee) != 3 || baseFee[1].Cmp(big.NewInt(9*params.GWei)) != 0 {
+		t.Errorf("pending base fee mismatch: have %v, want %v", baseFee, 9*params.GWei)
+	}
+}
+
+func TestFeeHistoryUnsupportedHeader(t *testing.T) {
+	backend := &blobBackend{testBackend: newTestBackendWithBaseFee(5, uint256.NewInt(8*params.GWei), nil)}
+	oracle := NewOracle(backend, nil, params.TestChainConfig, conf.GpoConfig{Blocks: 2, Percentile: 60, MaxHeaderHistory: 16, Default: big.NewInt(params.GWei)})
+
+	if _, _, _, _, err := oracle.FeeHistory(context.Background(), 2, jsonrpc.LatestBlockNumber, nil, nil); err == nil {
+		t.Error("fee history of foreign headers succeeded")
+	}
+}
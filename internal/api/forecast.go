@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/internal/consensus/misc"
+	"github.com/amazechain/amc/params"
+	"github.com/holiman/uint256"
+	"math/big"
+)
+
+// Assumptions a FeeForecast is made under.
+const (
+	AssumeSameFullness = "the pending block uses as much gas as the head block"
+	AssumeSameGasLimit = "the pending block has the gas limit of the head block"
+	AssumeTipTrend     = "the tip cap keeps changing as it did since the previous head"
+)
+
+// FeeForecast is the fee suggestion for the pending block along with the one
+// forecast for the block after it.
+type FeeForecast struct {
+	TipCap  *big.Int // Tip cap suggestion for the pending block
+	BaseFee *big.Int // Base fee of the pending block, nil before London
+
+	NextTipCap  *big.Int // Tip cap forecast for the block after the pending one
+	NextBaseFee *big.Int // Base fee forecast for the block after the pending one, nil before London
+
+	Assumptions []string // Assumptions the forecast was made under
+}
+
+// SuggestWithForecast returns the current tip cap suggestion and the base fee
+// of the pending block, along with a forecast one block further. The pending
+// base fee follows from the head, the next one applies the EIP-1559 formula to
+// a pending block assumed as full as the head. The next tip cap extrapolates
+// the change of the sampled suggestion between the previous head and the
+// current one, within the floor and the price cap.
+func (oracle *Oracle) SuggestWithForecast(ctx context.Context, chainConfig *params.ChainConfig) (*FeeForecast, error) {
+	if chainConfig == nil {
+		return nil, errNoChainConfig
+	}
+	tipCap, err := oracle.SuggestTipCap(ctx, chainConfig)
+	if err != nil {
+		return nil, err
+	}
+	current := oracle.currentBlock(chainConfig)
+	if current == nil || current.Header() == nil {
+		return nil, ErrNoChainHead
+	}
+	head, ok := current.Header().(*block.Header)
+	if !ok {
+		return nil, fmt.Errorf("unsupported header type %T", current.Header())
+	}
+	var (
+		number   = head.Number.Uint64()
+		forecast = &FeeForecast{
+			TipCap:      tipCap,
+			NextTipCap:  new(big.Int).Set(tipCap),
+			Assumptions: []string{AssumeTipTrend},
+		}
+	)
+	if number > 0 {
+		series, err := oracle.SuggestSeries(ctx, chainConfig, number-1, number)
+		if err != nil {
+			return nil, err
+		}
+		forecast.NextTipCap.Add(forecast.NextTipCap, new(big.Int).Sub(series[1], series[0]))
+		if forecast.NextTipCap.Cmp(oracle.minTip) < 0 {
+			forecast.NextTipCap.Set(oracle.minTip)
+		}
+		if oracle.maxPrice != nil && forecast.NextTipCap.Cmp(oracle.maxPrice) > 0 {
+			forecast.NextTipCap.Set(oracle.maxPrice)
+		}
+	}
+	if chainConfig.IsLondon(number + 1) {
+		forecast.BaseFee = misc.CalcBaseFee(chainConfig, head)
+	}
+	if chainConfig.IsLondon(number + 2) {
+		pending := &block.Header{
+			Number:   uint256.NewInt(number + 1),
+			GasLimit: head.GasLimit,
+			GasUsed:  head.GasUsed,
+		}
+		if forecast.BaseFee != nil {
+			pending.BaseFee, _ = uint256.FromBig(forecast.BaseFee)
+		}
+		forecast.NextBaseFee = misc.CalcBaseFee(chainConfig, pending)
+		forecast.Assumptions = append(forecast.Assumptions, AssumeSameFullness, AssumeSameGasLimit)
+	}
+	return forecast, nil
+}
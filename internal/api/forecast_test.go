@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/common/transaction"
+	"github.com/amazechain/amc/conf"
+	"github.com/amazechain/amc/internal/consensus/misc"
+	"github.com/amazechain/amc/params"
+	"github.com/holiman/uint256"
+	"math/big"
+	"testing"
+)
+
+func TestSuggestWithForecast(t *testing.T) {
+	london := *params.TestChainConfig
+	london.LondonBlock = big.NewInt(0)
+
+	tests := []struct {
+		full          bool
+		baseFee, next *big.Int
+	}{
+		// An empty head lowers the base fee by an eighth twice
+		{false, big.NewInt(8750000000), big.NewInt(7656250000)},
+		// A full head raises it by an eighth twice
+		{true, big.NewInt(11250000000), big.NewInt(12656250000)},
+	}
+	for i, tt := range tests {
+		backend := newTestBackendWithBaseFee(8, uint256.NewInt(10*params.GWei), func(number uint64) []*transaction.Transaction {
+			return []*transaction.Transaction{newTestTx(testSender, number, 5)}
+		})
+		if tt.full {
+			last := backend.blocks[len(backend.blocks)-1]
+			header := *last.Header().(*block.Header)
+			header.GasUsed = header.GasLimit
+			backend.blocks[len(backend.blocks)-1] = block.NewBlock(&header, last.Transactions())
+		}
+		oracle := NewOracle(backend, nil, &london, conf.GpoConfig{Blocks: 2, Percentile: 60, Default: big.NewInt(params.GWei)})
+		forecast, err := oracle.SuggestWithForecast(context.Background(), &london)
+		if err != nil {
+			t.Fatalf("test %d: failed to forecast: %v", i, err)
+		}
+		if forecast.BaseFee.Cmp(tt.baseFee) != 0 {
+			t.Errorf("test %d: pending base fee mismatch: have %v, want %v", i, forecast.BaseFee, tt.baseFee)
+		}
+		if forecast.NextBaseFee.Cmp(tt.next) != 0 {
+			t.Errorf("test %d: next base fee mismatch: have %v, want %v", i, forecast.NextBaseFee, tt.next)
+		}
+		// The forecast is the base fee formula applied to the assumed pending block
+		head := backend.CurrentBlock().Header().(*block.Header)
+		pending := &block.Header{Number: uint256.NewInt(head.Number.Uint64() + 1), GasLimit: head.GasLimit, GasUsed: head.GasUsed}
+		pending.BaseFee, _ = uint256.FromBig(misc.CalcBaseFee(&london, head))
+		if want := misc.CalcBaseFee(&london, pending); forecast.NextBaseFee.Cmp(want) != 0 {
+			t.Errorf("test %d: next base fee differs from the formula: have %v, want %v", i, forecast.NextBaseFee, want)
+		}
+		// Steady tips are forecast to stay where they are
+		if forecast.NextTipCap.Cmp(forecast.TipCap) != 0 {
+			t.Errorf("test %d: next tip cap mismatch: have %v, want %v", i, forecast.NextTipCap, forecast.TipCap)
+		}
+		if len(forecast.Assumptions) == 0 {
+			t.Errorf("test %d: forecast states no assumptions", i)
+		}
+	}
+	// Without a chain config, there is no fork to tell
+	oracle := newTestOracle(newTestBackend(3, nil), conf.GpoConfig{})
+	if _, err := oracle.SuggestWithForecast(context.Background(), nil); !errors.Is(err, errNoChainConfig) {
+		t.Errorf("nil chain config error mismatch: have %v, want %v", err, errNoChainConfig)
+	}
+}
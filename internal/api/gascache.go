@@ -0,0 +1,128 @@
+package api
+
+import (
+	types2 "github.com/amazechain/amc/common/types"
+	lru "github.com/hashicorp/golang-lru"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// SuggestionCache holds the values the oracle caches between queries: the
+// history entries, such as the values sampled in the blocks or their blob
+// fees, and the last suggestions. The default one lives in the process, a
+// shared one, e.g. backed by Redis, lets several instances serve each other's
+// computations.
+type SuggestionCache interface {
+	// Get returns the history entry of the key, which is comparable and opaque.
+	Get(key interface{}) (value interface{}, ok bool)
+	// Add stores the history entry of the key, reporting whether an older one
+	// was evicted.
+	Add(key, value interface{}) (evicted bool)
+	// Len returns the number of history entries.
+	Len() int
+
+	// LastSuggestion returns the last full gas price suggestion if gasPrice is
+	// set, the last tip cap one otherwise.
+	LastSuggestion(gasPrice bool) (CachedSuggestion, bool)
+	// StoreSuggestion replaces the last full gas price or tip cap suggestion.
+	StoreSuggestion(gasPrice bool, suggestion CachedSuggestion)
+}
+
+// CachedSuggestion is a suggestion along with the head it was computed for.
+type CachedSuggestion struct {
+	Head   types2.Hash
+	Number uint64
+	Price  *big.Int
+	Time   time.Time // When the suggestion was computed
+}
+
+// localCache is the in-process SuggestionCache.
+type localCache struct {
+	*lru.Cache
+
+	lock     sync.RWMutex
+	tipCap   *CachedSuggestion
+	gasPrice *CachedSuggestion
+}
+
+// newLocalCache creates an in-process SuggestionCache keeping at most size
+// history entries.
+func newLocalCache(size int) *localCache {
+	cache, _ := lru.New(size)
+	return &localCache{Cache: cache}
+}
+
+func (c *localCache) LastSuggestion(gasPrice bool) (CachedSuggestion, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	last := c.tipCap
+	if gasPrice {
+		last = c.gasPrice
+	}
+	if last == nil {
+		return CachedSuggestion{}, false
+	}
+	return *last, true
+}
+
+func (c *localCache) StoreSuggestion(gasPrice bool, suggestion CachedSuggestion) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if gasPrice {
+		c.gasPrice = &suggestion
+	} else {
+		c.tipCap = &suggestion
+	}
+}
+
+// SetCache replaces the cache of the oracle, nil restoring an in-process one.
+// The suggestions already computed by the oracle are only kept locally. The
+// history of the caches having a Purge method is purged on reorgs.
+func (oracle *Oracle) SetCache(cache SuggestionCache) {
+	if cache == nil {
+		cache = newLocalCache(historyCacheSize)
+	}
+	oracle.cacheLock.Lock()
+	oracle.historyCache = cache
+	oracle.cacheLock.Unlock()
+}
+
+// cache returns the cache of the oracle.
+func (oracle *Oracle) cache() SuggestionCache {
+	oracle.cacheLock.RLock()
+	defer oracle.cacheLock.RUnlock()
+
+	return oracle.historyCache
+}
+
+// storeSuggestion stores the suggestion just computed in the cache, for the
+// other instances sharing it. The cache lock must be held.
+func (oracle *Oracle) storeSuggestion(gasPrice bool, suggestion CachedSuggestion) {
+	suggestion.Price = new(big.Int).Set(suggestion.Price)
+	oracle.historyCache.StoreSuggestion(gasPrice, suggestion)
+}
+
+// adoptSuggestion replaces the last suggestion of the oracle by the one of the
+// cache, if another instance sharing it computed a more recent one.
+func (oracle *Oracle) adoptSuggestion(gasPrice bool) {
+	shared, ok := oracle.cache().LastSuggestion(gasPrice)
+	if !ok || shared.Price == nil {
+		return
+	}
+	oracle.cacheLock.Lock()
+	defer oracle.cacheLock.Unlock()
+
+	if gasPrice {
+		if shared.Time.After(oracle.lastGasTime) {
+			oracle.lastGasHead, oracle.lastGasPrice, oracle.lastGasTime = shared.Head, new(big.Int).Set(shared.Price), shared.Time
+		}
+		return
+	}
+	if shared.Time.After(oracle.lastTime) {
+		oracle.lastHead, oracle.lastPrice, oracle.lastTime = shared.Head, new(big.Int).Set(shared.Price), shared.Time
+		oracle.lastNumber = shared.Number
+	}
+}
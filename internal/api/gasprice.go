@@ -1,9 +1,15 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	common2 "github.com/amazechain/amc/common"
+	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/common/crypto"
 	"github.com/amazechain/amc/common/transaction"
+	"github.com/amazechain/amc/common/txs_pool"
 	types2 "github.com/amazechain/amc/common/types"
 	"github.com/amazechain/amc/conf"
 	"github.com/amazechain/amc/internal/avm/types"
@@ -13,12 +19,38 @@ import (
 	"github.com/amazechain/amc/params"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/holiman/uint256"
+	"math"
 	"math/big"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
-const sampleNumber = 3 // Number of transactions sampled in a block
+const (
+	sampleNumber     = 3 // Default number of transactions sampled in a block
+	minTargetSamples = 3 // Fewest samples a target specific suggestion is made from
+
+	baseFeeMultiplier = 2 // Default factor of the base fee in the suggested max fee per gas
+
+	tuneStep      = 5  // Percentile points the auto-tuner moves the percentile by
+	tuneSuccesses = 10 // Consecutive inclusions after which the percentile is lowered
+
+	historyCacheSize = 2048 // History entries kept by the in-process cache
+	tagCacheSize     = 16   // Tip caps kept for the blocks the tags resolved to
+)
+
+// ErrNoChainHead is returned by the suggestions made before the chain has a
+// head, such as during the early startup, the request being worth retrying.
+var ErrNoChainHead = errors.New("chain head not available yet")
+
+var (
+	errNoPriceSource   = errors.New("no gas price source available")
+	errBudgetUnderBase = errors.New("max fee per gas below the current base fee")
+	errUnsupportedTag  = errors.New("unsupported block tag")
+	errNotLondon       = errors.New("dynamic fee transactions not enabled before London")
+	errNoChainConfig   = errors.New("no chain config")
+)
 
 // Oracle recommends gas prices based on the content of recent
 // blocks. Suitable for both light and full clients.
@@ -27,21 +59,181 @@ type Oracle struct {
 	miner       common2.IMiner
 	lastHead    types2.Hash
 	lastPrice   *big.Int
+	lastTime    time.Time // When the last tip cap was computed
 	maxPrice    *big.Int
 	ignorePrice *big.Int
+	minTip      *big.Int // Floor of the tip cap suggestions, zero if none
 	cacheLock   sync.RWMutex
 	fetchLock   sync.Mutex
 
+	// Last full gas price suggestion (tip plus base fee)
+	lastGasHead  types2.Hash
+	lastGasPrice *big.Int
+	lastGasTime  time.Time
+	// Number of the head the last tip cap was computed for
+	lastNumber uint64
+
+	tracing   bool             // Whether the tip cap computations are traced
+	lastTrace *SuggestionTrace // Trace of the last tip cap computed, nil if none
+
+	includeCoinbase bool   // Whether transactions sent by the coinbase are sampled
+	epochCache      bool   // Whether the tip cap is cached per epoch rather than per head
+	confirmations   int    // Number of blocks behind the head the sampling starts at
+	sampleWindow    uint64 // Seconds before the head whose blocks are sampled, 0 to sample checkBlocks
+
+	safetyMultiplier float64 // Factor applied to the suggestions before the price cap
+	maxChangeRatio   float64 // Bound of the ratio between successive tip caps, 0 if unbounded
+	feeMultiplier    float64 // Factor of the base fee in the suggested max fee per gas
+	changeThreshold  float64 // Percentage of change of the tip cap posting an event, 0 if never
+	baseFeeFloor     float64 // Factor of the average sampled base fee the max fee is kept above, 0 if none
+
+	blend []conf.PercentileWeight // Percentiles blended by SuggestBlendedTipCap, weights summing to 1
+
+	idleTip *big.Int          // Tip cap suggested while the chain is idle, nil to keep the last one
+	pool    txs_pool.ITxsPool // Mempool checked for idleness, nil if unknown
+
+	// Head whose recent blocks were last checked for idleness, and whether they were quiet
+	quietHead   types2.Hash
+	quietBlocks bool
+
+	uncleWeight int // Percentage the uncle tips are weighted by, 0 if uncles aren't sampled
+
+	denomination string // Symbol of the native fee unit, if any
+	decimals     int    // Number of decimals of the native fee unit
+
+	tuneLock                     sync.Mutex
+	autoTune                     bool // Whether the percentile follows the inclusion feedback
+	minPercentile, maxPercentile int  // Bounds of the auto-tuned percentile
+	successes                    int  // Consecutive inclusions reported since the last nudge
+
+	maxAge          time.Duration // Age past which a cached suggestion is recomputed at the same head
+	samplesPerBlock int           // Number of transactions sampled in a block
+	maxPerSender    int           // Number of samples kept per sender in the window, 0 if unlimited
+	ignoreFallback  bool          // Whether blocks without samples contribute nothing rather than the last price
+	gasWeighted     bool          // Whether the samples are weighted by the gas used of their transactions
+	fetchSlots      chan struct{} // Slots of the blocks read at once, nil if unbounded
+
 	checkBlocks, percentile           int
 	maxHeaderHistory, maxBlockHistory int
-	historyCache                      *lru.Cache
+	historyCache                      SuggestionCache
+	tagPrices                         *lru.Cache // Tip caps sampled at the tagged blocks, by tagPriceKey
 	//
 	chainConfig *params.ChainConfig
+
+	sourceLock sync.RWMutex
+	sources    []PriceSource
+	l1Fees     L1FeeProvider // Estimates the L1 data fees of the transactions, nil on L1
+
+	blacklistLock    sync.RWMutex
+	blacklist        map[types2.Hash]struct{}    // Transactions excluded from sampling
+	excluded         map[types2.Address]struct{} // Senders excluded from sampling, besides the coinbase
+	exclusionsDigest types2.Hash                 // Digest of the blacklist and excluded senders contents
+}
+
+// PriceSource is a provider of tip cap suggestions. The oracle consults its
+// configured sources in order and uses the first one that succeeds.
+type PriceSource interface {
+	Price(ctx context.Context) (*big.Int, error)
+}
+
+// StaticPriceSource is a PriceSource always returning a fixed price, suitable
+// as the last resort of a fallback chain.
+type StaticPriceSource struct {
+	price *big.Int
+}
+
+// NewStaticPriceSource creates a price source returning the given price.
+func NewStaticPriceSource(price *big.Int) *StaticPriceSource {
+	return &StaticPriceSource{price: new(big.Int).Set(price)}
+}
+
+// Price implements PriceSource, returning the configured price.
+func (s *StaticPriceSource) Price(ctx context.Context) (*big.Int, error) {
+	return new(big.Int).Set(s.price), nil
+}
+
+// samplingSource is the PriceSource backed by the oracle's own sampling of
+// recent blocks.
+type samplingSource struct {
+	oracle *Oracle
+}
+
+// Price implements PriceSource, sampling the recent blocks of the local chain.
+func (s *samplingSource) Price(ctx context.Context) (*big.Int, error) {
+	return s.oracle.sampleTipCap(ctx, s.oracle.chainConfig)
+}
+
+// UncleBackend is implemented by block stores keeping the uncle blocks. When
+// the oracle's backend implements it and uncle sampling is enabled, the
+// transactions of the uncles referenced by the sampled blocks are sampled too.
+type UncleBackend interface {
+	GetUncleBlocks(hash types2.Hash) []block.IBlock
+}
+
+// ExternalEstimator is an external fee estimation service, such as an HTTP fee
+// oracle shared with other chains.
+type ExternalEstimator interface {
+	EstimateTipCap(ctx context.Context) (*big.Int, error)
+}
+
+// externalSource is the PriceSource deferring to an external estimator.
+type externalSource struct {
+	estimator ExternalEstimator
+	timeout   time.Duration
+	maxPrice  *big.Int
+}
+
+// Price implements PriceSource, querying the external estimator for at most
+// the configured timeout and clamping its estimate by the price cap.
+func (s *externalSource) Price(ctx context.Context) (*big.Int, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	type estimate struct {
+		price *big.Int
+		err   error
+	}
+	done := make(chan estimate, 1)
+	go func() {
+		price, err := s.estimator.EstimateTipCap(ctx)
+		done <- estimate{price, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil || res.price == nil {
+			return nil, res.err
+		}
+		if res.price.Cmp(s.maxPrice) > 0 {
+			return new(big.Int).Set(s.maxPrice), nil
+		}
+		return new(big.Int).Set(res.price), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TagBackend is implemented by block stores tracking the safe and finalized
+// blocks, allowing suggestions anchored at these blocks rather than the head.
+type TagBackend interface {
+	GetBlockByTag(tag jsonrpc.BlockNumber) (block.IBlock, error)
+}
+
+// MultiChainBackend is implemented by block stores shared by several chains,
+// distinguished by their chain ID. When the oracle's backend implements it,
+// the blocks are sampled from the chain identified by the chain config the
+// suggestion is requested for.
+type MultiChainBackend interface {
+	CurrentChainBlock(chainID *big.Int) block.IBlock
+	GetChainBlockByNumber(chainID *big.Int, number *uint256.Int) (block.IBlock, error)
 }
 
 // NewOracle returns a new gasprice oracle which can recommend suitable
 // gasprice for newly created transaction.
 func NewOracle(backend common2.IBlockChain, miner common2.IMiner, chainConfig *params.ChainConfig, params conf.GpoConfig) *Oracle {
+	checkChainConfig(chainConfig)
+
 	blocks := params.Blocks
 	if blocks < 1 {
 		blocks = 1
@@ -67,180 +259,1787 @@ func NewOracle(backend common2.IBlockChain, miner common2.IMiner, chainConfig *p
 	} else if ignorePrice.Int64() > 0 {
 		log.Info("Gasprice oracle is ignoring threshold set", "threshold", ignorePrice)
 	}
+	minTip := params.MinSuggestedTip
+	if minTip == nil {
+		minTip = new(big.Int)
+	} else if minTip.Sign() < 0 {
+		minTip = new(big.Int)
+		log.Warn("Sanitizing invalid gasprice oracle min suggested tip", "provided", params.MinSuggestedTip, "updated", minTip)
+	} else if minTip.Cmp(maxPrice) > 0 {
+		minTip = maxPrice
+		log.Warn("Sanitizing invalid gasprice oracle min suggested tip", "provided", params.MinSuggestedTip, "updated", minTip)
+	}
 	maxHeaderHistory := params.MaxHeaderHistory
 	if maxHeaderHistory < 1 {
 		maxHeaderHistory = 1
 		log.Warn("Sanitizing invalid gasprice oracle max header history", "provided", params.MaxHeaderHistory, "updated", maxHeaderHistory)
 	}
-	maxBlockHistory := params.MaxBlockHistory
-	if maxBlockHistory < 1 {
-		maxBlockHistory = 1
-		log.Warn("Sanitizing invalid gasprice oracle max block history", "provided", params.MaxBlockHistory, "updated", maxBlockHistory)
+	maxBlockHistory := params.MaxBlockHistory
+	if maxBlockHistory < 1 {
+		maxBlockHistory = 1
+		log.Warn("Sanitizing invalid gasprice oracle max block history", "provided", params.MaxBlockHistory, "updated", maxBlockHistory)
+	}
+
+	confirmations := params.BlockConfirmations
+	if confirmations < 0 {
+		confirmations = 0
+		log.Warn("Sanitizing invalid gasprice oracle block confirmations", "provided", params.BlockConfirmations, "updated", confirmations)
+	}
+
+	idleTip := params.IdleTip
+	if idleTip != nil && idleTip.Sign() < 0 {
+		idleTip = new(big.Int)
+		log.Warn("Sanitizing invalid gasprice oracle idle tip", "provided", params.IdleTip, "updated", idleTip)
+	}
+
+	uncleWeight := params.UncleWeight
+	if uncleWeight < 0 {
+		uncleWeight = 0
+		log.Warn("Sanitizing invalid gasprice oracle uncle weight", "provided", params.UncleWeight, "updated", uncleWeight)
+	} else if uncleWeight > 100 {
+		uncleWeight = 100
+		log.Warn("Sanitizing invalid gasprice oracle uncle weight", "provided", params.UncleWeight, "updated", uncleWeight)
+	}
+
+	decimals := 18
+	if params.Decimals != nil {
+		decimals = *params.Decimals
+		if decimals < 0 {
+			decimals = 18
+			log.Warn("Sanitizing invalid gasprice oracle decimals", "provided", *params.Decimals, "updated", decimals)
+		}
+	}
+
+	minPercentile, maxPercentile := params.MinPercentile, params.MaxPercentile
+	if params.AutoTunePercentile {
+		if maxPercentile == 0 || maxPercentile > 100 {
+			maxPercentile = 100
+		}
+		if minPercentile < 0 || minPercentile > maxPercentile {
+			minPercentile = 0
+			log.Warn("Sanitizing invalid gasprice oracle min percentile", "provided", params.MinPercentile, "updated", minPercentile)
+		}
+		if percent < minPercentile {
+			percent = minPercentile
+		} else if percent > maxPercentile {
+			percent = maxPercentile
+		}
+	}
+
+	safetyMultiplier := params.SafetyMultiplier
+	if safetyMultiplier == 0 {
+		safetyMultiplier = 1
+	} else if safetyMultiplier < 1 {
+		safetyMultiplier = 1
+		log.Warn("Sanitizing invalid gasprice oracle safety multiplier", "provided", params.SafetyMultiplier, "updated", safetyMultiplier)
+	}
+
+	feeMultiplier := params.BaseFeeMultiplier
+	if feeMultiplier == 0 {
+		feeMultiplier = baseFeeMultiplier
+	} else if feeMultiplier < 1 {
+		feeMultiplier = baseFeeMultiplier
+		log.Warn("Sanitizing invalid gasprice oracle base fee multiplier", "provided", params.BaseFeeMultiplier, "updated", feeMultiplier)
+	}
+
+	baseFeeFloor := params.BaseFeeFloorFactor
+	if baseFeeFloor < 0 {
+		baseFeeFloor = 0
+		log.Warn("Sanitizing invalid gasprice oracle base fee floor factor", "provided", params.BaseFeeFloorFactor, "updated", baseFeeFloor)
+	}
+
+	changeThreshold := params.PriceChangeThreshold
+	if changeThreshold < 0 {
+		changeThreshold = 0
+		log.Warn("Sanitizing invalid gasprice oracle price change threshold", "provided", params.PriceChangeThreshold, "updated", changeThreshold)
+	}
+
+	var (
+		blend       []conf.PercentileWeight
+		totalWeight float64
+	)
+	for _, pw := range params.PercentileBlend {
+		if pw.Percentile < 0 || pw.Percentile > 100 || pw.Weight <= 0 {
+			log.Warn("Sanitizing invalid gasprice oracle percentile blend", "percentile", pw.Percentile, "weight", pw.Weight, "updated", "dropped")
+			continue
+		}
+		blend = append(blend, pw)
+		totalWeight += pw.Weight
+	}
+	for i := range blend {
+		blend[i].Weight /= totalWeight
+	}
+
+	maxChangeRatio := params.MaxChangeRatio
+	if maxChangeRatio != 0 && maxChangeRatio < 1 {
+		maxChangeRatio = 0
+		log.Warn("Sanitizing invalid gasprice oracle max change ratio", "provided", params.MaxChangeRatio, "updated", maxChangeRatio)
+	}
+
+	maxAge := params.MaxAge
+	if maxAge <= 0 {
+		maxAge = conf.DefaultMaxAge
+		if params.MaxAge < 0 {
+			log.Warn("Sanitizing invalid gasprice oracle max age", "provided", params.MaxAge, "updated", maxAge)
+		}
+	}
+
+	samplesPerBlock := params.SamplesPerBlock
+	if samplesPerBlock == 0 {
+		samplesPerBlock = sampleNumber
+	} else if samplesPerBlock < 0 {
+		samplesPerBlock = sampleNumber
+		log.Warn("Sanitizing invalid gasprice oracle samples per block", "provided", params.SamplesPerBlock, "updated", samplesPerBlock)
+	}
+
+	includeCoinbase := params.IncludeCoinbaseTxs
+	if params.IncludeProposerTxs {
+		if chainConfig != nil && !chainConfig.IsProofOfWork() {
+			includeCoinbase = true
+		} else {
+			log.Warn("Ignoring gasprice oracle proposer transactions on a proof of work chain")
+		}
+	}
+
+	maxPerSender := params.MaxSamplesPerSender
+	if maxPerSender < 0 {
+		maxPerSender = 0
+		log.Warn("Sanitizing invalid gasprice oracle samples per sender", "provided", params.MaxSamplesPerSender, "updated", maxPerSender)
+	}
+
+	var fetchSlots chan struct{}
+	if params.MaxConcurrentFetches < 0 {
+		log.Warn("Sanitizing invalid gasprice oracle concurrent fetches", "provided", params.MaxConcurrentFetches, "updated", 0)
+	} else if params.MaxConcurrentFetches > 0 {
+		fetchSlots = make(chan struct{}, params.MaxConcurrentFetches)
+	}
+
+	tagPrices, _ := lru.New(tagCacheSize)
+
+	oracle := &Oracle{
+		backend:          backend,
+		miner:            miner,
+		lastPrice:        params.Default,
+		lastGasPrice:     params.Default,
+		maxPrice:         maxPrice,
+		ignorePrice:      ignorePrice,
+		minTip:           minTip,
+		checkBlocks:      blocks,
+		percentile:       percent,
+		maxHeaderHistory: maxHeaderHistory,
+		maxBlockHistory:  maxBlockHistory,
+		historyCache:     newLocalCache(historyCacheSize),
+		tagPrices:        tagPrices,
+		chainConfig:      chainConfig,
+		includeCoinbase:  includeCoinbase,
+		epochCache:       params.EpochCache,
+		confirmations:    confirmations,
+		sampleWindow:     params.SampleWindow,
+		safetyMultiplier: safetyMultiplier,
+		maxChangeRatio:   maxChangeRatio,
+		feeMultiplier:    feeMultiplier,
+		changeThreshold:  changeThreshold,
+		baseFeeFloor:     baseFeeFloor,
+		blend:            blend,
+		maxAge:           maxAge,
+		samplesPerBlock:  samplesPerBlock,
+		maxPerSender:     maxPerSender,
+		ignoreFallback:   params.IgnoreSelfFallback,
+		gasWeighted:      params.GasWeighted,
+		fetchSlots:       fetchSlots,
+		idleTip:          idleTip,
+		uncleWeight:      uncleWeight,
+		denomination:     params.Denomination,
+		decimals:         decimals,
+		autoTune:         params.AutoTunePercentile,
+		minPercentile:    minPercentile,
+		maxPercentile:    maxPercentile,
+	}
+	blacklist := make([]types2.Hash, 0, len(params.Blacklist))
+	for _, hash := range params.Blacklist {
+		if len(types2.FromHex2Bytes(hash)) != types2.HashLength {
+			log.Warn("Ignoring invalid gasprice oracle blacklisted hash", "provided", hash)
+			continue
+		}
+		blacklist = append(blacklist, types2.HexToHash(hash))
+	}
+	excluded := make([]types2.Address, 0, len(params.ExcludedSenders))
+	for _, addr := range params.ExcludedSenders {
+		if !types2.IsHexAddress(addr) {
+			log.Warn("Ignoring invalid gasprice oracle excluded sender", "provided", addr)
+			continue
+		}
+		excluded = append(excluded, types2.HexToAddress(addr))
+	}
+	oracle.sources = []PriceSource{oracle.SamplingSource()}
+	oracle.SetBlacklist(blacklist)
+	oracle.SetExcludedSenders(excluded)
+
+	// Purge the history on reorgs, from the cache the oracle uses by then
+	highestBlockCh := make(chan common2.ChainHighestBlock, 1)
+	event.GlobalEvent.Subscribe(highestBlockCh)
+
+	go func() {
+		var lastHead types2.Hash
+		for ev := range highestBlockCh {
+			if ev.Block.ParentHash() != lastHead {
+				if purger, ok := oracle.cache().(interface{ Purge() }); ok {
+					purger.Purge()
+				}
+			}
+			lastHead = ev.Block.Hash()
+		}
+	}()
+	return oracle
+}
+
+// checkChainConfig warns about the chain config data the oracle misses to pick
+// the signer of each sampled block.
+func checkChainConfig(chainConfig *params.ChainConfig) {
+	if chainConfig == nil {
+		log.Warn("Gasprice oracle has no chain config")
+		return
+	}
+	if chainConfig.ChainID == nil {
+		log.Warn("Gasprice oracle chain config lacks the chain ID, skipping the replay protected blocks")
+	}
+	if err := chainConfig.CheckConfigForkOrder(); err != nil {
+		log.Warn("Gasprice oracle chain config has incomplete fork data", "err", err)
+	}
+}
+
+// signerAt returns the signer of the block at the given number, or an error if
+// the chain config doesn't allow picking one, such as a missing config or a
+// replay protected fork without a chain ID.
+func signerAt(chainConfig *params.ChainConfig, number uint64) (types.Signer, error) {
+	if chainConfig == nil {
+		return nil, fmt.Errorf("no chain config for the signer of block %d", number)
+	}
+	signer := types.MakeSigner(chainConfig, new(big.Int).SetUint64(number))
+	if chainConfig.ChainID == nil && signer.ChainID() != nil {
+		return nil, fmt.Errorf("no chain ID for the signer of block %d", number)
+	}
+	return signer, nil
+}
+
+// chainIDOf returns the chain ID of the chain config, nil if there is none.
+func chainIDOf(chainConfig *params.ChainConfig) *big.Int {
+	if chainConfig == nil {
+		return nil
+	}
+	return chainConfig.ChainID
+}
+
+// FormatPrice formats a price given in base units in the native unit of the
+// chain's fees, such as "1.5 USDC" for 1500000 base units of a 6 decimals
+// denomination.
+func (oracle *Oracle) FormatPrice(price *big.Int) string {
+	sign := ""
+	if price.Sign() < 0 {
+		sign, price = "-", new(big.Int).Neg(price)
+	}
+	unit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(oracle.decimals)), nil)
+	whole, frac := new(big.Int).QuoRem(price, unit, new(big.Int))
+
+	formatted := sign + whole.String()
+	if frac.Sign() > 0 {
+		digits := frac.String()
+		digits = strings.Repeat("0", oracle.decimals-len(digits)) + digits
+		formatted += "." + strings.TrimRight(digits, "0")
+	}
+	if oracle.denomination != "" {
+		formatted += " " + oracle.denomination
+	}
+	return formatted
+}
+
+// InclusionReporter is fed back whether the transactions paying the suggested
+// tip cap got included, such as by the txpool or the miner.
+type InclusionReporter interface {
+	ReportInclusion(included bool)
+}
+
+// ReportInclusion implements InclusionReporter. With auto-tuning enabled, the
+// percentile is raised on every failed inclusion and lowered after a run of
+// successful ones, dropping the cached suggestions when it moves.
+func (oracle *Oracle) ReportInclusion(included bool) {
+	if !oracle.autoTune {
+		return
+	}
+	oracle.tuneLock.Lock()
+	percentile := oracle.percentile
+	if included {
+		if oracle.successes++; oracle.successes >= tuneSuccesses {
+			oracle.successes = 0
+			percentile -= tuneStep
+		}
+	} else {
+		oracle.successes = 0
+		percentile += tuneStep
+	}
+	if percentile < oracle.minPercentile {
+		percentile = oracle.minPercentile
+	} else if percentile > oracle.maxPercentile {
+		percentile = oracle.maxPercentile
+	}
+	changed := percentile != oracle.percentile
+	oracle.percentile = percentile
+	oracle.tuneLock.Unlock()
+
+	if changed {
+		oracle.Invalidate()
+	}
+}
+
+// Percentile returns the percentile the suggestions are currently made at,
+// which moves with the inclusion feedback if auto-tuning is enabled.
+func (oracle *Oracle) Percentile() int {
+	oracle.tuneLock.Lock()
+	defer oracle.tuneLock.Unlock()
+
+	return oracle.percentile
+}
+
+// OracleStats is a snapshot of the oracle's last suggestion and configuration,
+// for debugging.
+type OracleStats struct {
+	LastPrice      *big.Int    // Last tip cap computed, as cached without the safety multiplier
+	LastHead       types2.Hash // Head the last tip cap was computed for, zero if invalidated
+	LastFetch      time.Time   // When the last tip cap was computed, zero if never
+	HistoryEntries int         // Number of block entries held by the history cache
+	CheckBlocks    int
+	Percentile     int
+	MaxPrice       *big.Int
+}
+
+// Stats returns a snapshot of the oracle's state.
+func (oracle *Oracle) Stats() OracleStats {
+	oracle.cacheLock.RLock()
+	stats := OracleStats{
+		LastPrice: new(big.Int).Set(oracle.lastPrice),
+		LastHead:  oracle.lastHead,
+		LastFetch: oracle.lastTime,
+	}
+	oracle.cacheLock.RUnlock()
+
+	stats.HistoryEntries = oracle.cache().Len()
+	stats.CheckBlocks = oracle.checkBlocks
+	stats.Percentile = oracle.Percentile()
+	stats.MaxPrice = new(big.Int).Set(oracle.maxPrice)
+	return stats
+}
+
+// SetTxPool sets the mempool checked along with the recent blocks to tell
+// whether the chain is idle. Without it, the chain is never considered idle.
+func (oracle *Oracle) SetTxPool(pool txs_pool.ITxsPool) {
+	oracle.pool = pool
+}
+
+// SuggestionTrace explains, step by step, how a tip cap suggestion sampled from
+// the recent blocks was computed.
+type SuggestionTrace struct {
+	Head        types2.Hash
+	Number      uint64
+	Blocks      []BlockTrace      // Sampled blocks, in the order their values were collected
+	Values      []*big.Int        // Values the percentile is selected from, in ascending order
+	Percentile  int               // Percentile selected
+	Index       int               // Index of the selected value within Values
+	Adjustments []TraceAdjustment // Changes made to the selected value, in order
+	Price       *big.Int          // Suggestion returned
+}
+
+// BlockTrace records the values a block contributed to a suggestion.
+type BlockTrace struct {
+	Number   uint64
+	Hash     types2.Hash
+	Values   []*big.Int // Values sampled, or the last price for a fallback block
+	Fallback bool       // Whether the block had no sample and the last price stood in
+	Extended bool       // Whether the block extended the sampling to an older block
+}
+
+// TraceAdjustment records a change made to the value selected at the
+// percentile. The reasons are "max price", "change limit", "floor" and "safety
+// multiplier".
+type TraceAdjustment struct {
+	Reason   string
+	From, To *big.Int
+}
+
+// adjust records the adjustment of the suggestion, if it did change it.
+func (t *SuggestionTrace) adjust(reason string, from, to *big.Int) {
+	if t != nil && from.Cmp(to) != 0 {
+		t.Adjustments = append(t.Adjustments, TraceAdjustment{Reason: reason, From: new(big.Int).Set(from), To: new(big.Int).Set(to)})
+	}
+}
+
+// SetTracing enables or disables tracing the tip cap suggestions sampled from
+// the recent blocks, the trace of the last one being returned by LastTrace.
+func (oracle *Oracle) SetTracing(enabled bool) {
+	oracle.cacheLock.Lock()
+	defer oracle.cacheLock.Unlock()
+
+	oracle.tracing = enabled
+	if !enabled {
+		oracle.lastTrace = nil
+	}
+}
+
+// LastTrace returns the trace of the last tip cap suggestion sampled from the
+// recent blocks while tracing, nil if none. Suggestions served from the cache
+// don't replace it.
+func (oracle *Oracle) LastTrace() *SuggestionTrace {
+	oracle.cacheLock.RLock()
+	defer oracle.cacheLock.RUnlock()
+
+	return oracle.lastTrace
+}
+
+// SetBlacklist replaces the set of transactions excluded from sampling. The
+// cached suggestions are dropped, as they might have sampled them.
+func (oracle *Oracle) SetBlacklist(hashes []types2.Hash) {
+	blacklist := make(map[types2.Hash]struct{}, len(hashes))
+	for _, hash := range hashes {
+		blacklist[hash] = struct{}{}
+	}
+	oracle.blacklistLock.Lock()
+	oracle.blacklist = blacklist
+	oracle.exclusionsDigest = exclusionsDigest(oracle.blacklist, oracle.excluded)
+	oracle.blacklistLock.Unlock()
+
+	oracle.Invalidate()
+}
+
+// SetExcludedSenders replaces the set of senders whose transactions are never
+// sampled, like the ones of the coinbase, such as the fee recipients and
+// validators of the chains whose coinbase isn't the block signer. The cached
+// suggestions are dropped, as they might have sampled them.
+func (oracle *Oracle) SetExcludedSenders(addrs []types2.Address) {
+	excluded := make(map[types2.Address]struct{}, len(addrs))
+	for _, addr := range addrs {
+		excluded[addr] = struct{}{}
+	}
+	oracle.blacklistLock.Lock()
+	oracle.excluded = excluded
+	oracle.exclusionsDigest = exclusionsDigest(oracle.blacklist, oracle.excluded)
+	oracle.blacklistLock.Unlock()
+
+	oracle.Invalidate()
+}
+
+// exclusionsDigest hashes the blacklist and excluded senders in sorted order,
+// so that oracles sampling under the same ones, even sharing a cache across
+// processes, key their sampled values alike.
+func exclusionsDigest(blacklist map[types2.Hash]struct{}, excluded map[types2.Address]struct{}) types2.Hash {
+	hashes := make([][]byte, 0, len(blacklist))
+	for hash := range blacklist {
+		hashes = append(hashes, hash.Bytes())
+	}
+	addrs := make([][]byte, 0, len(excluded))
+	for addr := range excluded {
+		addrs = append(addrs, addr.Bytes())
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i], hashes[j]) < 0 })
+	sort.Slice(addrs, func(i, j int) bool { return bytes.Compare(addrs[i], addrs[j]) < 0 })
+	return crypto.Keccak256Hash(crypto.Keccak256(hashes...), crypto.Keccak256(addrs...))
+}
+
+// selfSent reports whether the transaction of the block is sent by its coinbase
+// or an excluded sender, and as such not meaningful for sampling.
+func (oracle *Oracle) selfSent(block block.IBlock, tx *transaction.Transaction, excluded map[types2.Address]struct{}) bool {
+	if _, ok := excluded[*tx.From()]; ok {
+		return true
+	}
+	return !oracle.includeCoinbase && *tx.From() == block.Coinbase()
+}
+
+// SamplingSource returns the PriceSource sampling the oracle's local chain, so
+// it can be placed anywhere within a custom fallback chain.
+func (oracle *Oracle) SamplingSource() PriceSource {
+	return &samplingSource{oracle: oracle}
+}
+
+// ExternalSource returns a PriceSource deferring to the external estimator for
+// at most timeout, zero meaning no timeout, and clamping its estimates by the
+// price cap of the oracle.
+func (oracle *Oracle) ExternalSource(estimator ExternalEstimator, timeout time.Duration) PriceSource {
+	return &externalSource{estimator: estimator, timeout: timeout, maxPrice: oracle.maxPrice}
+}
+
+// SetExternalEstimator makes SuggestTipCap defer to the external estimator,
+// falling back to the local sampling if it fails or doesn't answer within the
+// timeout.
+func (oracle *Oracle) SetExternalEstimator(estimator ExternalEstimator, timeout time.Duration) {
+	oracle.SetPriceSources(oracle.ExternalSource(estimator, timeout), oracle.SamplingSource())
+}
+
+// SetPriceSources replaces the ordered list of price sources consulted by
+// SuggestTipCap. An empty list restores the default local sampling.
+func (oracle *Oracle) SetPriceSources(sources ...PriceSource) {
+	if len(sources) == 0 {
+		sources = []PriceSource{oracle.SamplingSource()}
+	}
+	oracle.sourceLock.Lock()
+	oracle.sources = append([]PriceSource(nil), sources...)
+	oracle.sourceLock.Unlock()
+}
+
+// SuggestTipCap returns a tip cap so that newly created transaction can have a
+// very high chance to be included in the following blocks.
+//
+// Note, for legacy transactions and the legacy eth_gasPrice RPC call, it will be
+// necessary to add the basefee to the returned number to fall back to the legacy
+// behavior.
+//
+// The configured price sources are tried in order and the first suggestion
+// obtained without error is returned. When every source fails, the error of
+// the last one is returned.
+func (oracle *Oracle) SuggestTipCap(ctx context.Context, chainConfig *params.ChainConfig) (*big.Int, error) {
+	prices, err := oracle.SuggestTipCapsAt(ctx, chainConfig, []int{oracle.Percentile()})
+	if err != nil {
+		return nil, err
+	}
+	return prices[0], nil
+}
+
+// SuggestTipCapAtTag returns a tip cap suggestion sampled from the blocks up to
+// the one the tag resolves to, latest, safe or finalized. The latest tag is the
+// same as SuggestTipCap, the other ones are only supported by backends
+// implementing TagBackend and bypass any price source but the local sampling.
+// The tag suggestions are cached apart from the latest head one, keyed by the
+// hash of the block the tag resolved to.
+func (oracle *Oracle) SuggestTipCapAtTag(ctx context.Context, chainConfig *params.ChainConfig, tag jsonrpc.BlockNumber) (*big.Int, error) {
+	switch tag {
+	case jsonrpc.LatestBlockNumber:
+		return oracle.SuggestTipCap(ctx, chainConfig)
+	case jsonrpc.SafeBlockNumber, jsonrpc.FinalizedBlockNumber:
+		backend, ok := oracle.backend.(TagBackend)
+		if !ok {
+			return nil, fmt.Errorf("%w %d", errUnsupportedTag, tag)
+		}
+		anchor, err := backend.GetBlockByTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if anchor == nil {
+			return nil, fmt.Errorf("block not found for tag %d", tag)
+		}
+		return oracle.sampleTipCapAt(ctx, chainConfig, anchor)
+	}
+	return nil, fmt.Errorf("%w %d", errUnsupportedTag, tag)
+}
+
+// tagPriceKey identifies a tip cap sampled at a tagged block.
+type tagPriceKey struct {
+	hash       types2.Hash
+	percentile int
+}
+
+// sampleTipCapAt computes the tip cap suggestion from the blocks up to anchor,
+// such as the safe or finalized one. The suggestions are cached by the hash of
+// the anchor, apart from the latest head one: they neither serve nor replace
+// it, nor count as the previous suggestion the change limit and events go by.
+func (oracle *Oracle) sampleTipCapAt(ctx context.Context, chainConfig *params.ChainConfig, anchor block.IBlock) (*big.Int, error) {
+	head := anchor.Header()
+	if head == nil {
+		return nil, ErrNoChainHead
+	}
+	key := tagPriceKey{hash: head.Hash(), percentile: oracle.Percentile()}
+	if price, ok := oracle.tagPrices.Get(key); ok {
+		return oracle.withSafety(price.(*big.Int), oracle.maxPrice), nil
+	}
+	_, lastPrice := oracle.cachedPrice(false)
+	results, gas, err := oracle.collectSamples(ctx, chainConfig, anchor, lastPrice, false, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		results, gas = []*big.Int{lastPrice}, []uint64{params.TxGas}
+	}
+	price := oracle.selectPercentiles(results, gas, []int{key.percentile}, oracle.maxPrice)[0]
+	if price.Cmp(oracle.minTip) < 0 {
+		price = new(big.Int).Set(oracle.minTip)
+	}
+	oracle.tagPrices.Add(key, price)
+	return oracle.withSafety(price, oracle.maxPrice), nil
+}
+
+// Invalidate drops the cached suggestions, forcing the next query to sample
+// the recent blocks again even if the head didn't change.
+func (oracle *Oracle) Invalidate() {
+	oracle.cacheLock.Lock()
+	oracle.lastHead = types2.Hash{}
+	oracle.lastGasHead = types2.Hash{}
+	oracle.quietHead = types2.Hash{}
+	oracle.cacheLock.Unlock()
+
+	oracle.tagPrices.Purge()
+}
+
+// SuggestTipCapWithAge returns the last computed tip cap along with the head it
+// was computed for and its age, i.e. the number of blocks the chain advanced
+// since. The suggestion is only recomputed if none is available yet, allowing
+// callers to decide whether a stale value warrants a refresh through
+// SuggestTipCap.
+func (oracle *Oracle) SuggestTipCapWithAge(ctx context.Context, chainConfig *params.ChainConfig) (*big.Int, types2.Hash, int, error) {
+	oracle.cacheLock.RLock()
+	lastHead, lastPrice, lastNumber := oracle.lastHead, oracle.lastPrice, oracle.lastNumber
+	oracle.cacheLock.RUnlock()
+
+	if lastHead == (types2.Hash{}) {
+		price, err := oracle.sampleTipCap(ctx, chainConfig)
+		if err != nil {
+			return nil, types2.Hash{}, 0, err
+		}
+		oracle.cacheLock.RLock()
+		lastHead = oracle.lastHead
+		oracle.cacheLock.RUnlock()
+		return price, lastHead, 0, nil
+	}
+	var age int
+	if head := oracle.currentBlock(chainConfig).Header(); head != nil && head.Number64().Uint64() > lastNumber {
+		age = int(head.Number64().Uint64() - lastNumber)
+	}
+	return new(big.Int).Set(lastPrice), lastHead, age, nil
+}
+
+// SuggestTipWithinBudget returns the best tip cap affordable by a transaction
+// willing to pay at most maxFeePerGas per gas at the current base fee: the
+// budget left after the base fee, capped by the regular tip cap suggestion. An
+// error is returned if the budget doesn't cover the base fee.
+func (oracle *Oracle) SuggestTipWithinBudget(ctx context.Context, chainConfig *params.ChainConfig, maxFeePerGas *big.Int) (*big.Int, error) {
+	headroom := new(big.Int).Set(maxFeePerGas)
+	if head := oracle.currentBlock(chainConfig).Header(); head != nil && head.BaseFee64() != nil {
+		headroom.Sub(headroom, head.BaseFee64().ToBig())
+	}
+	if headroom.Sign() < 0 {
+		return nil, errBudgetUnderBase
+	}
+	tip, err := oracle.SuggestTipCap(ctx, chainConfig)
+	if err != nil {
+		return nil, err
+	}
+	if tip.Cmp(headroom) > 0 {
+		return headroom, nil
+	}
+	return tip, nil
+}
+
+// FeeSuggestion holds the fee parameters of a dynamic fee transaction.
+type FeeSuggestion struct {
+	MaxPriorityFeePerGas *big.Int
+	MaxFeePerGas         *big.Int
+}
+
+// Suggest1559 returns ready to use fee parameters for a dynamic fee transaction:
+// the tip cap suggestion as the max priority fee, and the max fee per gas
+// leaving room for the base fee of the head to grow by the configured base fee
+// multiplier. If a base fee floor factor is configured, the max fee is at least
+// that multiple of the average base fee of the sampled blocks. An error is
+// returned if the next block isn't London enabled.
+func (oracle *Oracle) Suggest1559(ctx context.Context, chainConfig *params.ChainConfig) (*FeeSuggestion, error) {
+	if chainConfig == nil {
+		return nil, errNoChainConfig
+	}
+	var (
+		number  uint64
+		baseFee = new(big.Int)
+	)
+	if current := oracle.currentBlock(chainConfig); current != nil && current.Header() != nil {
+		head := current.Header()
+		number = head.Number64().Uint64()
+		if head.BaseFee64() != nil {
+			baseFee = head.BaseFee64().ToBig()
+		}
+	}
+	if !chainConfig.IsLondon(number + 1) {
+		return nil, errNotLondon
+	}
+	tip, err := oracle.SuggestTipCap(ctx, chainConfig)
+	if err != nil {
+		return nil, err
+	}
+	maxFee := scaleUp(baseFee, oracle.feeMultiplier)
+	maxFee.Add(maxFee, tip)
+	if oracle.baseFeeFloor > 0 {
+		if average := oracle.averageBaseFee(chainConfig, number); average != nil {
+			if floor := scaleUp(average, oracle.baseFeeFloor); maxFee.Cmp(floor) < 0 {
+				maxFee = floor
+			}
+		}
+	}
+	return &FeeSuggestion{
+		MaxPriorityFeePerGas: tip,
+		MaxFeePerGas:         maxFee,
+	}, nil
+}
+
+// scaleUp returns the value multiplied by the factor, rounded up.
+func scaleUp(value *big.Int, factor float64) *big.Int {
+	scaled, accuracy := new(big.Float).Mul(new(big.Float).SetInt(value), big.NewFloat(factor)).Int(nil)
+	if accuracy == big.Below {
+		scaled.Add(scaled, big.NewInt(1))
+	}
+	return scaled
+}
+
+// averageBaseFee returns the average base fee of the blocks sampled for the head
+// at the given number, or nil if none of these carries a base fee.
+func (oracle *Oracle) averageBaseFee(chainConfig *params.ChainConfig, number uint64) *big.Int {
+	if uint64(oracle.confirmations) < number {
+		number -= uint64(oracle.confirmations)
+	} else {
+		number = 0
+	}
+	var (
+		sum    = new(big.Int)
+		blocks int64
+	)
+	for checked := 0; checked < oracle.checkBlocks && number > 0; checked, number = checked+1, number-1 {
+		block, _ := oracle.blockByNumber(chainIDOf(chainConfig), number)
+		if block == nil || block.BaseFee64() == nil {
+			continue
+		}
+		sum.Add(sum, block.BaseFee64().ToBig())
+		blocks++
+	}
+	if blocks == 0 {
+		return nil
+	}
+	return sum.Div(sum, big.NewInt(blocks))
+}
+
+// SuggestTipCaps is SuggestTipCapsAt for the chain config of the oracle.
+func (oracle *Oracle) SuggestTipCaps(ctx context.Context, percentiles []int) ([]*big.Int, error) {
+	return oracle.SuggestTipCapsAt(ctx, oracle.chainConfig, percentiles)
+}
+
+// SuggestTipCapsAt returns a tip cap suggestion for each of the percentiles,
+// all computed from a single sampling and sort of the recent blocks, such as
+// slow, average and fast ones. The price sources are tried like by
+// SuggestTipCap, a source other than the local sampling answering all the
+// percentiles with its single suggestion. Only the suggestion at the configured
+// percentile alone, the SuggestTipCap one, is cached and served from the cache.
+func (oracle *Oracle) SuggestTipCapsAt(ctx context.Context, chainConfig *params.ChainConfig, percentiles []int) ([]*big.Int, error) {
+	for i, percentile := range percentiles {
+		if percentile < 0 || percentile > 100 {
+			return nil, fmt.Errorf("invalid percentile #%d: %d, must be within [0, 100]", i, percentile)
+		}
+	}
+	oracle.sourceLock.RLock()
+	sources := oracle.sources
+	oracle.sourceLock.RUnlock()
+
+	var err error
+	for _, source := range sources {
+		var prices []*big.Int
+		// Local sampling honours the chain config of the caller
+		if sampler, ok := source.(*samplingSource); ok && sampler.oracle == oracle {
+			prices, err = oracle.sampleTipCaps(ctx, chainConfig, percentiles)
+		} else {
+			var price *big.Int
+			if price, err = source.Price(ctx); err == nil && price != nil {
+				prices = make([]*big.Int, len(percentiles))
+				for i := range prices {
+					prices[i] = new(big.Int).Set(price)
+				}
+			}
+		}
+		if err == nil && prices != nil {
+			return prices, nil
+		}
+		log.Debug("Gasprice oracle source failed", "source", fmt.Sprintf("%T", source), "err", err)
+	}
+	if err == nil {
+		err = errNoPriceSource
+	}
+	return nil, err
+}
+
+// sampleTipCaps computes the tip cap suggestions at the percentiles from the
+// transactions included in the recent blocks of the local chain. The one at
+// the configured percentile alone is the sampleTipCap one.
+func (oracle *Oracle) sampleTipCaps(ctx context.Context, chainConfig *params.ChainConfig, percentiles []int) ([]*big.Int, error) {
+	if len(percentiles) == 1 && percentiles[0] == oracle.Percentile() {
+		price, err := oracle.sampleTipCap(ctx, chainConfig)
+		if err != nil {
+			return nil, err
+		}
+		return []*big.Int{price}, nil
+	}
+	_, lastPrice := oracle.cachedPrice(false)
+	results, gas, err := oracle.collectSamples(ctx, chainConfig, oracle.currentBlock(chainConfig), lastPrice, false, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		results, gas = []*big.Int{lastPrice}, []uint64{params.TxGas}
+	}
+	prices := oracle.selectPercentiles(results, gas, percentiles, oracle.maxPrice)
+	for i, price := range prices {
+		if price.Cmp(oracle.minTip) < 0 {
+			price = oracle.minTip
+		}
+		prices[i] = oracle.withSafety(price, oracle.maxPrice)
+	}
+	return prices, nil
+}
+
+// SuggestBlendedTipCap returns the weighted average of the tip caps suggested
+// at the percentiles of the configured blend, all computed from a single
+// sampling like SuggestTipCapsAt. Without a blend, it's the SuggestTipCap one.
+func (oracle *Oracle) SuggestBlendedTipCap(ctx context.Context, chainConfig *params.ChainConfig) (*big.Int, error) {
+	if len(oracle.blend) == 0 {
+		return oracle.SuggestTipCap(ctx, chainConfig)
+	}
+	percentiles := make([]int, len(oracle.blend))
+	for i, pw := range oracle.blend {
+		percentiles[i] = pw.Percentile
+	}
+	prices, err := oracle.SuggestTipCapsAt(ctx, chainConfig, percentiles)
+	if err != nil {
+		return nil, err
+	}
+	return blendPrices(prices, oracle.blend), nil
+}
+
+// blendPrices returns the average of the prices weighted by the blend, rounded
+// to the nearest integer.
+func blendPrices(prices []*big.Int, blend []conf.PercentileWeight) *big.Int {
+	sum := new(big.Float).SetPrec(256)
+	for i, price := range prices {
+		weighted := new(big.Float).SetPrec(256).SetInt(price)
+		sum.Add(sum, weighted.Mul(weighted, big.NewFloat(blend[i].Weight)))
+	}
+	blended, _ := sum.Add(sum, big.NewFloat(0.5)).Int(nil)
+	return blended
+}
+
+// SuggestTipCapForTarget returns a tip cap suggestion sampled only from the
+// recent transactions sent to the target, such as a busy contract. The global
+// suggestion is returned instead if too few of them were found. This method is
+// experimental, its suggestions are neither cached nor served from the cache.
+func (oracle *Oracle) SuggestTipCapForTarget(ctx context.Context, chainConfig *params.ChainConfig, target types2.Address) (*big.Int, error) {
+	_, lastPrice := oracle.cachedPrice(false)
+	values, err := oracle.collectValues(ctx, chainConfig, oracle.currentBlock(chainConfig), lastPrice, false, &target)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < minTargetSamples {
+		return oracle.SuggestTipCap(ctx, chainConfig)
+	}
+	return oracle.withSafety(SelectTipCap(values, oracle.Percentile(), oracle.maxPrice, oracle.tipFloor()), oracle.maxPrice), nil
+}
+
+// SuggestTipForBlockPosition estimates the tip cap needed to be included within
+// the given top fraction of a block, 0.2 meaning the 20% best paying included
+// transactions. It is experimental and isn't cached.
+//
+// The estimation assumes blocks are filled by decreasing tips, as done by the
+// miner. In each of the recent sampled blocks, the position threshold is the
+// lowest tip among its top fraction of sampled transactions, rounded to include
+// at least one of them. The median of these thresholds is suggested, or the
+// last price if the blocks hold no sampled transaction.
+func (oracle *Oracle) SuggestTipForBlockPosition(ctx context.Context, chainConfig *params.ChainConfig, fraction float64) (*big.Int, error) {
+	if fraction <= 0 || fraction > 1 {
+		return nil, fmt.Errorf("invalid block position %v, must be within (0, 1]", fraction)
+	}
+	oracle.blacklistLock.RLock()
+	blacklist, excluded := oracle.blacklist, oracle.excluded
+	oracle.blacklistLock.RUnlock()
+
+	current := oracle.currentBlock(chainConfig)
+	if current == nil || current.Header() == nil {
+		return nil, ErrNoChainHead
+	}
+	number := current.Number64().Uint64()
+	if uint64(oracle.confirmations) < number {
+		number -= uint64(oracle.confirmations)
+	} else {
+		number = 0
+	}
+	var thresholds []*big.Int
+	for checked := 0; checked < oracle.checkBlocks && number > 0; checked, number = checked+1, number-1 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		block, err := oracle.blockByNumber(chainIDOf(chainConfig), number)
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			break
+		}
+		// All the transactions are sampled, by ascending tips
+		tips, _, _ := oracle.sampleBlock(block, len(block.Transactions()), oracle.ignorePrice, false, nil, blacklist, excluded, 100, nil)
+		if len(tips) == 0 {
+			continue
+		}
+		top := int(math.Ceil(fraction * float64(len(tips))))
+		thresholds = append(thresholds, tips[len(tips)-top])
+	}
+	if len(thresholds) == 0 {
+		_, lastPrice := oracle.cachedPrice(false)
+		thresholds = []*big.Int{lastPrice}
 	}
+	return oracle.withSafety(SelectTipCap(thresholds, 50, oracle.maxPrice, oracle.tipFloor()), oracle.maxPrice), nil
+}
 
-	cache, _ := lru.New(2048)
+// SuggestSeries returns the tip cap suggestion the oracle would have made at
+// each head from fromBlock to toBlock inclusive, for backtesting. The sampling
+// window slides along the heads, each block being fetched and sampled once for
+// the whole series. Blocks are counted as by checkBlocks, the sample window is
+// not honoured here. These suggestions are neither cached nor served from the
+// cache.
+func (oracle *Oracle) SuggestSeries(ctx context.Context, chainConfig *params.ChainConfig, fromBlock, toBlock uint64) ([]*big.Int, error) {
+	if fromBlock > toBlock {
+		return nil, fmt.Errorf("invalid block range %d-%d", fromBlock, toBlock)
+	}
+	var (
+		_, lastPrice = oracle.cachedPrice(false)
+		cache        = make(map[uint64][]*big.Int)
+		quit         = make(chan struct{})
+		result       = make(chan results, 1)
+		series       = make([]*big.Int, 0, toBlock-fromBlock+1)
+	)
+	defer close(quit)
 
-	highestBlockCh := make(chan common2.ChainHighestBlock)
-	defer close(highestBlockCh)
-	highestSub := event.GlobalEvent.Subscribe(highestBlockCh)
-	defer highestSub.Unsubscribe()
+	// blockValues returns the sampled values of a block, reusing them for
+	// all the heads whose window overlaps it.
+	blockValues := func(number uint64) ([]*big.Int, error) {
+		if values, ok := cache[number]; ok {
+			return values, nil
+		}
+		signer, err := signerAt(chainConfig, number)
+		if err != nil {
+			log.Debug("Skipping gasprice oracle block", "number", number, "err", err)
+			cache[number] = nil
+			return nil, nil
+		}
+		oracle.getBlockValues(ctx, signer, chainIDOf(chainConfig), number, oracle.samplesPerBlock, oracle.ignorePrice, false, nil, result, quit)
+		res := <-result
+		if res.err != nil {
+			return nil, res.err
+		}
+		cache[number] = res.values
+		return res.values, nil
+	}
+	for head := fromBlock; head <= toBlock; head++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		number := head
+		if uint64(oracle.confirmations) < number {
+			number -= uint64(oracle.confirmations)
+		} else {
+			number = 0
+		}
+		// Sample the blocks the way collectValues does, in order, extending
+		// the window past the blocks without any meaningful transaction.
+		var pending []uint64
+		for len(pending) < oracle.checkBlocks && number > 0 {
+			pending = append(pending, number)
+			number--
+		}
+		var values []*big.Int
+		for i := 0; i < len(pending); i++ {
+			sampled, err := blockValues(pending[i])
+			if err != nil {
+				return nil, err
+			}
+			if len(sampled) == 0 && !oracle.ignoreFallback {
+				sampled = []*big.Int{lastPrice}
+			}
+			if len(sampled) <= 1 && len(values)+len(pending)-i < oracle.checkBlocks*2 && number > 0 {
+				pending = append(pending, number)
+				number--
+			}
+			values = append(values, sampled...)
+		}
+		if len(values) == 0 {
+			values = []*big.Int{lastPrice}
+		}
+		lastPrice = SelectTipCap(values, oracle.Percentile(), oracle.maxPrice, oracle.tipFloor())
+		series = append(series, oracle.withSafety(lastPrice, oracle.maxPrice))
 
-	go func() {
-		var lastHead types2.Hash
-		for ev := range highestBlockCh {
-			if ev.Block.ParentHash() != lastHead {
-				cache.Purge()
+		// Drop the blocks no later head will sample anymore, as none reaches
+		// back more than twice checkBlocks.
+		for number := range cache {
+			if number+uint64(oracle.confirmations)+uint64(oracle.checkBlocks)*2 <= head+1 {
+				delete(cache, number)
 			}
-			lastHead = ev.Block.Hash()
 		}
-	}()
+	}
+	return series, nil
+}
 
-	return &Oracle{
-		backend:          backend,
-		miner:            miner,
-		lastPrice:        params.Default,
-		maxPrice:         maxPrice,
-		ignorePrice:      ignorePrice,
-		checkBlocks:      blocks,
-		percentile:       percent,
-		maxHeaderHistory: maxHeaderHistory,
-		maxBlockHistory:  maxBlockHistory,
-		historyCache:     cache,
-		chainConfig:      chainConfig,
+// SuggestGasPrice returns a full gas price (effective tip plus base fee) so that
+// newly created legacy transaction can have a very high chance to be included
+// in the following blocks. Contrary to SuggestTipCap, the percentile is applied
+// over the effective gas prices paid by the sampled transactions, while the
+// price cap applies to the tip portion only.
+func (oracle *Oracle) SuggestGasPrice(ctx context.Context, chainConfig *params.ChainConfig) (*big.Int, error) {
+	return oracle.samplePrice(ctx, chainConfig, true)
+}
+
+// sampleTipCap computes the tip cap suggestion from the transactions included
+// in the recent blocks of the local chain.
+func (oracle *Oracle) sampleTipCap(ctx context.Context, chainConfig *params.ChainConfig) (*big.Int, error) {
+	return oracle.samplePrice(ctx, chainConfig, false)
+}
+
+// cachedPrice returns the last suggestion along with the head it was computed
+// for, either the tip cap or the full gas price one.
+func (oracle *Oracle) cachedPrice(gasPrice bool) (types2.Hash, *big.Int) {
+	oracle.adoptSuggestion(gasPrice)
+
+	oracle.cacheLock.RLock()
+	defer oracle.cacheLock.RUnlock()
+
+	if gasPrice {
+		return oracle.lastGasHead, oracle.lastGasPrice
 	}
+	return oracle.lastHead, oracle.lastPrice
 }
 
-// SuggestTipCap returns a tip cap so that newly created transaction can have a
-// very high chance to be included in the following blocks.
-//
-// Note, for legacy transactions and the legacy eth_gasPrice RPC call, it will be
-// necessary to add the basefee to the returned number to fall back to the legacy
-// behavior.
-func (oracle *Oracle) SuggestTipCap(ctx context.Context, chainConfig *params.ChainConfig) (*big.Int, error) {
-	//var latestNumber jsonrpc.BlockNumber
-	//latestNumber = jsonrpc.LatestBlockNumber
+// fresh reports whether the last suggestion, either the tip cap or the full gas
+// price one, was computed less than the max age ago.
+func (oracle *Oracle) fresh(gasPrice bool) bool {
+	oracle.cacheLock.RLock()
+	defer oracle.cacheLock.RUnlock()
+
+	if gasPrice {
+		return time.Since(oracle.lastGasTime) < oracle.maxAge
+	}
+	return time.Since(oracle.lastTime) < oracle.maxAge
+}
+
+// samplePrice samples the recent blocks, collecting either the effective tips
+// or the effective gas prices of their transactions.
+func (oracle *Oracle) samplePrice(ctx context.Context, chainConfig *params.ChainConfig, gasPrice bool) (*big.Int, error) {
+	return oracle.samplePriceAt(ctx, chainConfig, oracle.currentBlock(chainConfig), gasPrice)
+}
 
-	head := oracle.backend.CurrentBlock().Header()
-	var headHash types2.Hash
+// samplePriceAt is samplePrice sampling the blocks up to current rather than
+// up to the head of the chain.
+func (oracle *Oracle) samplePriceAt(ctx context.Context, chainConfig *params.ChainConfig, current block.IBlock, gasPrice bool) (*big.Int, error) {
+	// Without a head yet, such as during the early startup, there is nothing
+	// to sample nor any base fee to build upon.
+	var head block.IHeader
+	if current != nil {
+		head = current.Header()
+	}
 	if head == nil {
-		headHash = types2.Hash{}
-	} else {
-		headHash = types2.Hash(head.Hash())
+		return nil, ErrNoChainHead
+	}
+	// An idle chain is reported right away, its mempool might fill up at any
+	// time without the head changing.
+	if !gasPrice && oracle.idleTip != nil && oracle.idle(chainConfig, current) {
+		if oracle.idleTip.Cmp(oracle.minTip) < 0 {
+			return new(big.Int).Set(oracle.minTip), nil
+		}
+		return new(big.Int).Set(oracle.idleTip), nil
 	}
+	headHash := head.Hash()
 
+	maxPrice := oracle.maxPrice
+	if gasPrice && head.BaseFee64() != nil {
+		maxPrice = new(big.Int).Add(maxPrice, head.BaseFee64().ToBig())
+	}
 	// If the latest gasprice is still available, return it.
-	oracle.cacheLock.RLock()
-	lastHead, lastPrice := oracle.lastHead, oracle.lastPrice
-	oracle.cacheLock.RUnlock()
-	if headHash == lastHead {
-		return new(big.Int).Set(lastPrice), nil
+	lastHead, lastPrice := oracle.cachedPrice(gasPrice)
+	if oracle.fresh(gasPrice) && (headHash == lastHead || (!gasPrice && oracle.sameEpoch(chainConfig, head.Number64().Uint64()))) {
+		return oracle.withSafety(lastPrice, maxPrice), nil
 	}
 	oracle.fetchLock.Lock()
 	defer oracle.fetchLock.Unlock()
 
 	// Try checking the cache again, maybe the last fetch fetched what we need
+	lastHead, lastPrice = oracle.cachedPrice(gasPrice)
+	if oracle.fresh(gasPrice) && (headHash == lastHead || (!gasPrice && oracle.sameEpoch(chainConfig, head.Number64().Uint64()))) {
+		return oracle.withSafety(lastPrice, maxPrice), nil
+	}
+	oracle.cacheLock.RLock()
+	var trace *SuggestionTrace
+	if !gasPrice && oracle.tracing {
+		trace = &SuggestionTrace{Head: headHash, Number: head.Number64().Uint64()}
+	}
+	oracle.cacheLock.RUnlock()
+
+	results, gas, err := oracle.collectSamples(ctx, chainConfig, current, lastPrice, gasPrice, nil, trace)
+	if err != nil {
+		return oracle.withSafety(lastPrice, maxPrice), err
+	}
+	samples := len(results)
+	if samples == 0 {
+		results, gas = []*big.Int{lastPrice}, []uint64{params.TxGas}
+	}
+	// The bare price is cached, so that the blocks sampling it as the last
+	// price don't compound the safety multiplier.
+	percentile := oracle.Percentile()
+	price := oracle.selectPercentiles(results, gas, []int{percentile}, maxPrice)[0]
+	if trace != nil {
+		trace.Values, trace.Percentile, trace.Index = results, percentile, (len(results)-1)*percentile/100
+		if oracle.gasWeighted {
+			trace.Index = weightedIndex(gas, percentile)
+		}
+		trace.adjust("max price", results[trace.Index], price)
+	}
+	if !gasPrice && oracle.maxChangeRatio > 0 {
+		limited := oracle.limitChange(chainConfig, head.Number64().Uint64(), price, lastPrice)
+		trace.adjust("change limit", price, limited)
+		price = limited
+	}
+	// The floor is applied last, so that the suggestion never falls below it
+	if oracle.minTip.Sign() > 0 {
+		floor := new(big.Int).Set(oracle.minTip)
+		if gasPrice && head.BaseFee64() != nil {
+			floor.Add(floor, head.BaseFee64().ToBig())
+		}
+		if price.Cmp(floor) < 0 {
+			trace.adjust("floor", price, floor)
+			price = floor
+		}
+	}
+	suggestion := oracle.withSafety(price, maxPrice)
+	if trace != nil {
+		trace.adjust("safety multiplier", price, suggestion)
+		trace.Price = new(big.Int).Set(suggestion)
+	}
+	now := time.Now()
+	oracle.cacheLock.Lock()
+	if gasPrice {
+		oracle.lastGasHead = headHash
+		oracle.lastGasPrice = price
+		oracle.lastGasTime = now
+		oracle.storeSuggestion(true, CachedSuggestion{Head: headHash, Price: price, Time: now})
+	} else {
+		oracle.lastHead = headHash
+		oracle.lastPrice = price
+		oracle.lastNumber = head.Number64().Uint64()
+		oracle.lastTime = now
+		oracle.storeSuggestion(false, CachedSuggestion{Head: headHash, Number: oracle.lastNumber, Price: price, Time: now})
+		if trace != nil && oracle.tracing {
+			oracle.lastTrace = trace
+		}
+		if oracle.changeThreshold > 0 && changedBy(lastPrice, price, oracle.changeThreshold) {
+			event.GlobalEvent.Send(&common2.GasPriceChangeEvent{
+				OldPrice: new(big.Int).Set(lastPrice),
+				NewPrice: new(big.Int).Set(price),
+				Head:     headHash,
+				Samples:  samples,
+			})
+		}
+	}
+	oracle.cacheLock.Unlock()
+
+	return suggestion, nil
+}
+
+// changedBy reports whether price differs from lastPrice by more than the given
+// percentage of it. Any change from zero is.
+func changedBy(lastPrice, price *big.Int, percent float64) bool {
+	if lastPrice.Sign() == 0 {
+		return price.Sign() != 0
+	}
+	delta := new(big.Float).SetInt(new(big.Int).Sub(price, lastPrice))
+	ratio, _ := new(big.Float).Quo(delta.Abs(delta), new(big.Float).SetInt(lastPrice)).Float64()
+	return ratio*100 > percent
+}
+
+// limitChange clamps a new tip cap suggestion for the head at the given number
+// within the max change ratio of the last one. Nothing is clamped before a
+// first suggestion was sampled, nor after a deep reorg, i.e. if the head the
+// last suggestion was sampled for isn't canonical anymore.
+func (oracle *Oracle) limitChange(chainConfig *params.ChainConfig, number uint64, price, lastPrice *big.Int) *big.Int {
 	oracle.cacheLock.RLock()
-	lastHead, lastPrice = oracle.lastHead, oracle.lastPrice
+	lastHead, lastNumber := oracle.lastHead, oracle.lastNumber
 	oracle.cacheLock.RUnlock()
-	if headHash == lastHead {
-		return new(big.Int).Set(lastPrice), nil
+
+	if lastNumber == 0 || lastPrice.Sign() <= 0 || number < lastNumber {
+		return price
+	}
+	if lastHead != (types2.Hash{}) {
+		if ancestor, err := oracle.blockByNumber(chainIDOf(chainConfig), lastNumber); err != nil || ancestor == nil || ancestor.Hash() != lastHead {
+			log.Debug("Skipping gasprice oracle change limit across reorg", "number", lastNumber, "hash", lastHead)
+			return price
+		}
+	}
+	ratio := big.NewFloat(oracle.maxChangeRatio)
+	last := new(big.Float).SetInt(lastPrice)
+	if upper, _ := new(big.Float).Mul(last, ratio).Int(nil); price.Cmp(upper) > 0 {
+		return upper
+	}
+	if lower, _ := new(big.Float).Quo(last, ratio).Int(nil); price.Cmp(lower) < 0 {
+		return lower
+	}
+	return price
+}
+
+// SelectTipCap returns the value at the given percentile of the sampled values,
+// raised to floor and then capped by maxPrice, either bound being ignored if
+// nil. Without any value, floor is returned, nil if unset. This is the
+// selection the oracle applies to its samples, exported for reuse without a
+// backend. The values are left untouched.
+func SelectTipCap(results []*big.Int, percentile int, maxPrice, floor *big.Int) *big.Int {
+	return selectTipCaps(results, []int{percentile}, maxPrice, floor)[0]
+}
+
+// selectTipCaps is SelectTipCap selecting the values at several percentiles out
+// of a single sort of the values.
+func selectTipCaps(results []*big.Int, percentiles []int, maxPrice, floor *big.Int) []*big.Int {
+	prices := make([]*big.Int, len(percentiles))
+	if len(results) == 0 {
+		if floor != nil {
+			for i := range prices {
+				prices[i] = new(big.Int).Set(floor)
+			}
+		}
+		return prices
+	}
+	values := make([]*big.Int, len(results))
+	copy(values, results)
+	sort.Sort(bigIntArray(values))
+
+	for i, percentile := range percentiles {
+		if percentile < 0 {
+			percentile = 0
+		} else if percentile > 100 {
+			percentile = 100
+		}
+		price := values[(len(values)-1)*percentile/100]
+		if floor != nil && price.Cmp(floor) < 0 {
+			price = floor
+		}
+		if maxPrice != nil && price.Cmp(maxPrice) > 0 {
+			price = maxPrice
+		}
+		prices[i] = new(big.Int).Set(price)
+	}
+	return prices
+}
+
+// selectPercentiles returns the sampled values at each of the percentiles,
+// weighted by the gas used by their transactions if the oracle is configured
+// so, then capped by maxPrice.
+func (oracle *Oracle) selectPercentiles(values []*big.Int, gas []uint64, percentiles []int, maxPrice *big.Int) []*big.Int {
+	if !oracle.gasWeighted {
+		return selectTipCaps(values, percentiles, maxPrice, nil)
+	}
+	prices := make([]*big.Int, len(percentiles))
+	for i, percentile := range percentiles {
+		prices[i] = selectWeightedTipCap(values, gas, percentile, maxPrice)
+	}
+	return prices
+}
+
+// selectWeightedTipCap returns the value at the given percentile of the values,
+// sorted in ascending order, each weighted by the gas used by its transaction,
+// then capped by maxPrice. The values are weighted equally if none used gas.
+func selectWeightedTipCap(values []*big.Int, gas []uint64, percentile int, maxPrice *big.Int) *big.Int {
+	price := values[weightedIndex(gas, percentile)]
+	if maxPrice != nil && price.Cmp(maxPrice) > 0 {
+		price = maxPrice
+	}
+	return new(big.Int).Set(price)
+}
+
+// weightedIndex returns the index of the value at the given percentile of the
+// sorted values whose transactions used the given gas, as selected by
+// selectWeightedTipCap.
+func weightedIndex(gas []uint64, percentile int) int {
+	if percentile < 0 {
+		percentile = 0
+	} else if percentile > 100 {
+		percentile = 100
+	}
+	var total uint64
+	for _, used := range gas {
+		total += used
+	}
+	if total == 0 {
+		return (len(gas) - 1) * percentile / 100
+	}
+	var (
+		threshold = total * uint64(percentile) / 100
+		index     = 0
+		sum       = gas[0]
+	)
+	for sum < threshold && index < len(gas)-1 {
+		index++
+		sum += gas[index]
+	}
+	return index
+}
+
+// tipFloor returns the floor of the tip cap suggestions, nil if none is
+// configured.
+func (oracle *Oracle) tipFloor() *big.Int {
+	if oracle.minTip.Sign() > 0 {
+		return oracle.minTip
+	}
+	return nil
+}
+
+// withSafety returns a copy of the price scaled up by the safety multiplier,
+// rounded up, then capped by maxPrice.
+func (oracle *Oracle) withSafety(price, maxPrice *big.Int) *big.Int {
+	if oracle.safetyMultiplier > 1 {
+		scaled := new(big.Float).Mul(new(big.Float).SetInt(price), big.NewFloat(oracle.safetyMultiplier))
+		rounded, accuracy := scaled.Int(nil)
+		if accuracy == big.Below {
+			rounded.Add(rounded, big.NewInt(1))
+		}
+		price = rounded
+	}
+	if price.Cmp(maxPrice) > 0 {
+		price = maxPrice
+	}
+	return new(big.Int).Set(price)
+}
+
+// collectValues samples the recent blocks of the chain ending at current, as of
+// the configuration of the oracle, and returns the collected values in
+// ascending order. Blocks without any meaningful transaction contribute
+// lastPrice instead, unless only the transactions sent to a non-nil target are
+// sampled.
+func (oracle *Oracle) collectValues(ctx context.Context, chainConfig *params.ChainConfig, current block.IBlock, lastPrice *big.Int, gasPrice bool, target *types2.Address) ([]*big.Int, error) {
+	values, _, err := oracle.collectSamples(ctx, chainConfig, current, lastPrice, gasPrice, target, nil)
+	return values, err
+}
+
+// collectSamples is collectValues also returning the gas used by the
+// transaction of each value, a plain transfer's for the lastPrice ones. The
+// sampled blocks are recorded into trace if non-nil.
+func (oracle *Oracle) collectSamples(ctx context.Context, chainConfig *params.ChainConfig, current block.IBlock, lastPrice *big.Int, gasPrice bool, target *types2.Address, trace *SuggestionTrace) ([]*big.Int, []uint64, error) {
+	if current == nil || current.Header() == nil {
+		return nil, nil, ErrNoChainHead
 	}
 	var (
-		sent, exp int
-		number    = head.Number64().Uint64()
-		result    = make(chan results, oracle.checkBlocks)
-		quit      = make(chan struct{})
-		results   []*big.Int
+		sent, exp   int
+		number      = current.Number64().Uint64()
+		checkBlocks = oracle.checkBlocks
+		extend      = true
+		quit        = make(chan struct{})
+		values      []*big.Int
+		senders     []types2.Address
+		gas         []uint64
+		seen        = make(map[types2.Hash]struct{})
 	)
-	for sent < oracle.checkBlocks && number > 0 {
-		go oracle.getBlockValues(ctx, types.MakeSigner(chainConfig, big.NewInt(int64(number))), number, sampleNumber, oracle.ignorePrice, result, quit)
+	// Skip the blocks not confirmed enough yet, down to the genesis at most
+	if uint64(oracle.confirmations) < number {
+		number -= uint64(oracle.confirmations)
+	} else {
+		number = 0
+	}
+	// Within a time window, sample all of its blocks but no more
+	if oracle.sampleWindow > 0 {
+		checkBlocks, extend = oracle.windowBlocks(chainIDOf(chainConfig), number, current.Time()), false
+	}
+	result := make(chan results, checkBlocks)
+
+	// fetch samples the next block down, unless no signer can be picked for
+	// it, in which case it is skipped rather than sampled with a wrong one.
+	fetch := func() {
+		if signer, err := signerAt(chainConfig, number); err != nil {
+			log.Debug("Skipping gasprice oracle block", "number", number, "err", err)
+		} else {
+			go oracle.getBlockValues(ctx, signer, chainIDOf(chainConfig), number, oracle.samplesPerBlock, oracle.ignorePrice, gasPrice, target, result, quit)
+			exp++
+		}
 		sent++
-		exp++
 		number--
 	}
+	for sent < checkBlocks && number > 0 {
+		fetch()
+	}
 	for exp > 0 {
-		res := <-result
+		var res results
+		select {
+		case res = <-result:
+		case <-ctx.Done():
+			close(quit)
+			return nil, nil, ctx.Err()
+		}
 		if res.err != nil {
 			close(quit)
-			return new(big.Int).Set(lastPrice), res.err
+			return nil, nil, res.err
 		}
 		exp--
+		// Each distinct block contributes at most once, even if the backend
+		// served it more than once due to a racing head change.
+		if res.hash != (types2.Hash{}) {
+			if _, ok := seen[res.hash]; ok {
+				continue
+			}
+			seen[res.hash] = struct{}{}
+		}
 		// Nothing returned. There are two special cases here:
 		// - The block is empty
-		// - All the transactions included are sent by the miner itself.
-		// In these cases, use the latest calculated price for sampling.
-		if len(res.values) == 0 {
-			res.values = []*big.Int{lastPrice}
+		// - All the transactions included are sent by the miner itself,
+		//   unless configured to sample these too.
+		// In these cases, use the latest calculated price for sampling, unless
+		// configured to only sample observed values.
+		fallback := len(res.values) == 0 && target == nil && !oracle.ignoreFallback
+		if fallback {
+			res.values, res.senders, res.gas = []*big.Int{lastPrice}, []types2.Address{{}}, []uint64{params.TxGas}
 		}
 		// Besides, in order to collect enough data for sampling, if nothing
 		// meaningful returned, try to query more blocks. But the maximum
-		// is 2*checkBlocks.
-		if len(res.values) == 1 && len(results)+1+exp < oracle.checkBlocks*2 && number > 0 {
-			go oracle.getBlockValues(ctx, types.MakeSigner(chainConfig, big.NewInt(int64(number))), number, sampleNumber, oracle.ignorePrice, result, quit)
-			sent++
-			exp++
-			number--
+		// is 2*checkBlocks, and the time window is never exceeded.
+		extended := extend && len(res.values) <= 1 && len(values)+1+exp < checkBlocks*2 && sent < checkBlocks*2 && number > 0
+		if extended {
+			fetch()
+		}
+		if trace != nil {
+			trace.Blocks = append(trace.Blocks, BlockTrace{Number: res.number, Hash: res.hash, Values: res.values, Fallback: fallback, Extended: extended})
+		}
+		values, senders, gas = append(values, res.values...), append(senders, res.senders...), append(gas, res.gas...)
+	}
+	if oracle.maxPerSender > 0 {
+		values, gas = capSenders(values, senders, gas, oracle.maxPerSender)
+		return values, gas, nil
+	}
+	sort.Sort(sampleArray{values, gas})
+	return values, gas, nil
+}
+
+// capSenders returns the values in ascending order along with their gas used,
+// keeping at most the limit lowest ones of each sender. Values without sender,
+// the zero address, are always kept.
+func capSenders(values []*big.Int, senders []types2.Address, gas []uint64, limit int) ([]*big.Int, []uint64) {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return values[order[i]].Cmp(values[order[j]]) < 0
+	})
+	var (
+		capped    = make([]*big.Int, 0, len(values))
+		cappedGas = make([]uint64, 0, len(values))
+		counts    = make(map[types2.Address]int)
+	)
+	for _, i := range order {
+		if sender := senders[i]; sender != (types2.Address{}) {
+			if counts[sender] >= limit {
+				continue
+			}
+			counts[sender]++
 		}
-		results = append(results, res.values...)
+		capped, cappedGas = append(capped, values[i]), append(cappedGas, gas[i])
 	}
-	price := lastPrice
-	if len(results) > 0 {
-		sort.Sort(bigIntArray(results))
-		price = results[(len(results)-1)*oracle.percentile/100]
+	return capped, cappedGas
+}
+
+// idle reports whether the mempool is empty and the recent blocks of the chain
+// ending at current hold no transaction but the ones of the excluded senders
+// and of their coinbase, unless these are sampled too. The mempool is checked
+// on every call, the blocks once per head.
+func (oracle *Oracle) idle(chainConfig *params.ChainConfig, current block.IBlock) bool {
+	if oracle.pool == nil {
+		return false
+	}
+	if pending, _, queued, _ := oracle.pool.Stats(); pending > 0 || queued > 0 {
+		return false
+	}
+	head := current.Hash()
+	oracle.cacheLock.RLock()
+	quietHead, quiet := oracle.quietHead, oracle.quietBlocks
+	oracle.cacheLock.RUnlock()
+	if quietHead == head {
+		return quiet
 	}
-	if price.Cmp(oracle.maxPrice) > 0 {
-		price = new(big.Int).Set(oracle.maxPrice)
+	quiet, err := oracle.quiet(chainConfig, current)
+	if err != nil {
+		return false
 	}
 	oracle.cacheLock.Lock()
-	oracle.lastHead = headHash
-	oracle.lastPrice = price
+	oracle.quietHead, oracle.quietBlocks = head, quiet
 	oracle.cacheLock.Unlock()
+	return quiet
+}
+
+// quiet reports whether the recent blocks of the chain ending at current hold
+// no transaction but the ones of the excluded senders and of their coinbase,
+// unless these are sampled too.
+func (oracle *Oracle) quiet(chainConfig *params.ChainConfig, current block.IBlock) (bool, error) {
+	oracle.blacklistLock.RLock()
+	excluded := oracle.excluded
+	oracle.blacklistLock.RUnlock()
+
+	number := current.Number64().Uint64()
+	if uint64(oracle.confirmations) < number {
+		number -= uint64(oracle.confirmations)
+	} else {
+		number = 0
+	}
+	for checked := 0; checked < oracle.checkBlocks && number > 0; checked, number = checked+1, number-1 {
+		block, err := oracle.blockByNumber(chainIDOf(chainConfig), number)
+		if err != nil {
+			return false, err
+		}
+		if block == nil {
+			return false, fmt.Errorf("block %d not found", number)
+		}
+		for _, tx := range block.Transactions() {
+			if !oracle.selfSent(block, tx, excluded) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// currentBlock returns the head block of the chain identified by chainConfig.
+func (oracle *Oracle) currentBlock(chainConfig *params.ChainConfig) block.IBlock {
+	if backend, ok := oracle.backend.(MultiChainBackend); ok && chainConfig != nil && chainConfig.ChainID != nil {
+		return backend.CurrentChainBlock(chainConfig.ChainID)
+	}
+	return oracle.backend.CurrentBlock()
+}
+
+// blockByNumber returns the block with the given number of the chain with the
+// given ID, or of the backend's only chain if it doesn't serve several.
+func (oracle *Oracle) blockByNumber(chainID *big.Int, number uint64) (block.IBlock, error) {
+	if backend, ok := oracle.backend.(MultiChainBackend); ok && chainID != nil {
+		return backend.GetChainBlockByNumber(chainID, uint256.NewInt(number))
+	}
+	return oracle.backend.GetBlockByNumber(uint256.NewInt(number))
+}
+
+// windowBlocks returns the number of blocks, counting down from number, whose
+// timestamp lies within the sample window ending at the head time. It is
+// bounded by the max block history, and at least one block is sampled.
+func (oracle *Oracle) windowBlocks(chainID *big.Int, number uint64, headTime uint64) int {
+	var cutoff uint64
+	if headTime > oracle.sampleWindow {
+		cutoff = headTime - oracle.sampleWindow
+	}
+	var blocks int
+	for ; blocks < oracle.maxBlockHistory && number > 0; number-- {
+		block, err := oracle.blockByNumber(chainID, number)
+		if err != nil || block == nil || block.Time() < cutoff {
+			break
+		}
+		blocks++
+	}
+	if blocks == 0 {
+		blocks = 1
+	}
+	return blocks
+}
+
+// sameEpoch reports whether epoch caching is enabled and the last tip cap was
+// computed for a head within the same epoch as the given block number.
+func (oracle *Oracle) sameEpoch(chainConfig *params.ChainConfig, number uint64) bool {
+	epoch := epochLength(chainConfig)
+	if !oracle.epochCache || epoch == 0 {
+		return false
+	}
+	oracle.cacheLock.RLock()
+	defer oracle.cacheLock.RUnlock()
+
+	return oracle.lastHead != (types2.Hash{}) && number/epoch == oracle.lastNumber/epoch
+}
 
-	return new(big.Int).Set(price), nil
+// epochLength returns the epoch length of the chain's consensus engine, or 0 if
+// it doesn't define one.
+func epochLength(chainConfig *params.ChainConfig) uint64 {
+	switch {
+	case chainConfig == nil:
+		return 0
+	case chainConfig.Clique != nil:
+		return chainConfig.Clique.Epoch
+	case chainConfig.Parlia != nil:
+		return chainConfig.Parlia.Epoch
+	}
+	return 0
 }
 
 type results struct {
-	values []*big.Int
-	err    error
+	values  []*big.Int
+	senders []types2.Address // Sender of each value
+	gas     []uint64         // Gas used by the transaction of each value
+	hash    types2.Hash      // Hash of the sampled block
+	number  uint64           // Number of the sampled block
+	err     error
+}
+
+// blockValuesKey identifies the values sampled from a block in the history
+// cache. As blocks are keyed by hash, the values never go stale, but they
+// depend on the sampling settings. These are all part of the key, so that
+// oracles configured differently can share a cache.
+type blockValuesKey struct {
+	hash            types2.Hash
+	limit           int
+	gasPrice        bool
+	target          types2.Address // Recipient the samples are restricted to, if targeted
+	targeted        bool
+	ignoreUnder     string      // Tip under which transactions are skipped, empty if none
+	includeCoinbase bool        // Whether the coinbase transactions are sampled
+	gasWeighted     bool        // Whether the gas used by the transactions was looked up
+	uncleWeight     int         // Weight of the uncle samples, zero if not sampled
+	exclusions      types2.Hash // Digest of the blacklist and excluded senders applied
 }
 
 // getBlockPrices calculates the lowest transaction gas price in a given block
 // and sends it to the result channel. If the block is empty or all transactions
 // are sent by the miner itself(it doesn't make any sense to include this kind of
-// transaction prices for sampling), nil gasprice is returned.
-func (oracle *Oracle) getBlockValues(ctx context.Context, signer types.Signer, blockNum uint64, limit int, ignoreUnder *big.Int, result chan results, quit chan struct{}) {
-	block, err := oracle.backend.GetBlockByNumber(uint256.NewInt(uint64(jsonrpc.BlockNumber(blockNum))))
+// transaction prices for sampling), nil gasprice is returned. The latter can be
+// disabled to sample the transactions of the miner too.
+//
+// The effective tips are collected, unless gasPrice is set in which case the
+// block's base fee is added to each of them. Blacklisted transactions are
+// skipped, as are the ones of the excluded senders like the miner's and the
+// ones not sent to target if it is non-nil. The uncles of the block are
+// sampled along with it if enabled. The values are cached per block hash, for
+// the blocks sampled again by the later heads.
+func (oracle *Oracle) getBlockValues(ctx context.Context, signer types.Signer, chainID *big.Int, blockNum uint64, limit int, ignoreUnder *big.Int, gasPrice bool, target *types2.Address, result chan results, quit chan struct{}) {
+	// Wait for a fetch slot if these are bounded, the sampling is abandoned
+	// meanwhile if the caller gave up. A cancelled context is still reported,
+	// as the caller may be waiting for the result without watching it.
+	if oracle.fetchSlots != nil {
+		select {
+		case oracle.fetchSlots <- struct{}{}:
+			defer func() { <-oracle.fetchSlots }()
+		case <-quit:
+			return
+		case <-ctx.Done():
+			select {
+			case result <- results{number: blockNum, err: ctx.Err()}:
+			case <-quit:
+			}
+			return
+		}
+	}
+	block, err := oracle.blockByNumber(chainID, uint64(jsonrpc.BlockNumber(blockNum)))
 	if block == nil {
 		select {
-		case result <- results{nil, err}:
+		case result <- results{nil, nil, nil, types2.Hash{}, blockNum, err}:
+		case <-quit:
+		}
+		return
+	}
+	oracle.blacklistLock.RLock()
+	blacklist, excluded, exclusions := oracle.blacklist, oracle.excluded, oracle.exclusionsDigest
+	oracle.blacklistLock.RUnlock()
+
+	key := blockValuesKey{
+		hash:            block.Hash(),
+		limit:           limit,
+		gasPrice:        gasPrice,
+		includeCoinbase: oracle.includeCoinbase,
+		gasWeighted:     oracle.gasWeighted,
+		exclusions:      exclusions,
+	}
+	if target != nil {
+		key.target, key.targeted = *target, true
+	}
+	if ignoreUnder != nil {
+		key.ignoreUnder = ignoreUnder.String()
+	}
+	if _, ok := oracle.backend.(UncleBackend); ok {
+		key.uncleWeight = oracle.uncleWeight
+	}
+	if cached, ok := oracle.cache().Get(key); ok {
+		select {
+		case result <- cached.(results):
 		case <-quit:
 		}
 		return
 	}
+	// The gas used is only looked up if it matters, the receipts of the uncles
+	// are never available.
+	var gasUsed map[types2.Hash]uint64
+	if oracle.gasWeighted {
+		gasUsed = oracle.receiptsGasUsed(block)
+	}
+	prices, senders, gas := oracle.sampleBlock(block, limit, ignoreUnder, gasPrice, target, blacklist, excluded, 100, gasUsed)
+	if backend, ok := oracle.backend.(UncleBackend); ok && oracle.uncleWeight > 0 {
+		for _, uncle := range backend.GetUncleBlocks(block.Hash()) {
+			unclePrices, uncleSenders, uncleGas := oracle.sampleBlock(uncle, limit, ignoreUnder, gasPrice, target, blacklist, excluded, oracle.uncleWeight, nil)
+			prices, senders, gas = append(prices, unclePrices...), append(senders, uncleSenders...), append(gas, uncleGas...)
+		}
+	}
+	res := results{prices, senders, gas, block.Hash(), blockNum, nil}
+	oracle.cache().Add(key, res)
+
+	select {
+	case result <- res:
+	case <-quit:
+	}
+}
+
+// receiptsGasUsed returns the gas used by each transaction of the block, as of
+// its receipts, or nil if these aren't available.
+func (oracle *Oracle) receiptsGasUsed(block block.IBlock) map[types2.Hash]uint64 {
+	receipts, err := oracle.backend.GetReceipts(block.Hash())
+	if err != nil || len(receipts) == 0 {
+		return nil
+	}
+	gasUsed := make(map[types2.Hash]uint64, len(receipts))
+	for _, receipt := range receipts {
+		if receipt != nil {
+			gasUsed[receipt.TxHash] = receipt.GasUsed
+		}
+	}
+	return gasUsed
+}
+
+// sampleBlock returns the lowest effective tips, or gas prices, of up to limit
+// transactions of the block along with their senders and gas used, as sampled
+// by getBlockValues. The tips are scaled by the weight percentage. The gas used
+// is taken from gasUsed, falling back to the gas limit of the transactions
+// missing from it.
+func (oracle *Oracle) sampleBlock(block block.IBlock, limit int, ignoreUnder *big.Int, gasPrice bool, target *types2.Address, blacklist map[types2.Hash]struct{}, excluded map[types2.Address]struct{}, weight int, gasUsed map[types2.Hash]uint64) ([]*big.Int, []types2.Address, []uint64) {
 	// Sort the transaction by effective tip in ascending sort.
 	txs := make([]*transaction.Transaction, len(block.Transactions()))
 	copy(txs, block.Transactions())
 	sorter := newSorter(txs, block.BaseFee64())
 	sort.Sort(sorter)
 
-	var prices []*big.Int
+	var (
+		prices  []*big.Int
+		senders []types2.Address
+		gas     []uint64
+	)
 	for _, tx := range sorter.txs {
-		tip, _ := tx.EffectiveGasTip(block.BaseFee64())
+		if _, ok := blacklist[tx.Hash()]; ok {
+			continue
+		}
+		if to := tx.To(); target != nil && (to == nil || *to != *target) {
+			continue
+		}
+		tip, err := tx.EffectiveGasTip(block.BaseFee64())
+		if err != nil {
+			// Such a transaction couldn't have been mined, don't let its
+			// underflowed tip into the sampling.
+			log.Debug("Skipping transaction with negative effective tip", "block", block.Number64(), "hash", tx.Hash(), "err", err)
+			continue
+		}
 		ignoreUnderx, _ := uint256.FromBig(ignoreUnder)
 		if ignoreUnder != nil && tip.Cmp(ignoreUnderx) == -1 {
 			continue
 		}
-		if *tx.From() != block.Coinbase() {
-			prices = append(prices, tip.ToBig())
+		if !oracle.selfSent(block, tx, excluded) {
+			price := tip.ToBig()
+			if weight < 100 {
+				price.Div(price.Mul(price, big.NewInt(int64(weight))), big.NewInt(100))
+			}
+			if gasPrice && block.BaseFee64() != nil {
+				price.Add(price, block.BaseFee64().ToBig())
+			}
+			used, ok := gasUsed[tx.Hash()]
+			if !ok {
+				used = tx.Gas()
+			}
+			prices, senders, gas = append(prices, price), append(senders, *tx.From()), append(gas, used)
 			if len(prices) >= limit {
 				break
 			}
 		}
 	}
-	select {
-	case result <- results{prices, nil}:
-	case <-quit:
-	}
+	return prices, senders, gas
 }
 
 type txSorter struct {
@@ -273,3 +2072,17 @@ type bigIntArray []*big.Int
 func (s bigIntArray) Len() int           { return len(s) }
 func (s bigIntArray) Less(i, j int) bool { return s[i].Cmp(s[j]) < 0 }
 func (s bigIntArray) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// sampleArray sorts the sampled values along with the gas used by their
+// transactions.
+type sampleArray struct {
+	values []*big.Int
+	gas    []uint64
+}
+
+func (s sampleArray) Len() int           { return len(s.values) }
+func (s sampleArray) Less(i, j int) bool { return s.values[i].Cmp(s.values[j]) < 0 }
+func (s sampleArray) Swap(i, j int) {
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+	s.gas[i], s.gas[j] = s.gas[j], s.gas[i]
+}
@@ -0,0 +1,2092 @@
+package api
+
+import (
+	"context"
+	"errors"
+	common2 "github.com/amazechain/amc/common"
+	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/common/hexutil"
+	"github.com/amazechain/amc/common/transaction"
+	"github.com/amazechain/amc/common/txs_pool"
+	types2 "github.com/amazechain/amc/common/types"
+	"github.com/amazechain/amc/conf"
+	event "github.com/amazechain/amc/modules/event/v2"
+	"github.com/amazechain/amc/modules/rpc/jsonrpc"
+	"github.com/amazechain/amc/params"
+	"github.com/holiman/uint256"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testCoinbase  = types2.HexToAddress("0x1000000000000000000000000000000000000001")
+	testSender    = types2.HexToAddress("0x2000000000000000000000000000000000000002")
+	testRecipient = types2.HexToAddress("0x3000000000000000000000000000000000000003")
+)
+
+// testBackend serves a fixed canonical chain to the oracle. Only the methods
+// used by the oracle are implemented.
+type testBackend struct {
+	common2.IBlockChain
+	blocks   []block.IBlock
+	receipts map[types2.Hash]block.Receipts
+}
+
+func (b *testBackend) GetReceipts(hash types2.Hash) (block.Receipts, error) {
+	return b.receipts[hash], nil
+}
+
+func (b *testBackend) CurrentBlock() block.IBlock {
+	return b.blocks[len(b.blocks)-1]
+}
+
+func (b *testBackend) GetBlockByNumber(number *uint256.Int) (block.IBlock, error) {
+	if n := number.Uint64(); n < uint64(len(b.blocks)) {
+		return b.blocks[n], nil
+	}
+	return nil, nil
+}
+
+func (b *testBackend) GetHeaderByNumber(number *uint256.Int) block.IHeader {
+	if n := number.Uint64(); n < uint64(len(b.blocks)) {
+		return b.blocks[n].Header()
+	}
+	return nil
+}
+
+// newTestTx creates a dynamic fee transaction paying the given tip in gwei, with
+// a fee cap leaving enough room for a base fee of up to 100 gwei.
+func newTestTx(from types2.Address, nonce uint64, tip uint64) *transaction.Transaction {
+	return newTestTxTo(from, testRecipient, nonce, tip)
+}
+
+// newTestTxTo is newTestTx sending the transaction to a given recipient.
+func newTestTxTo(from types2.Address, to types2.Address, nonce uint64, tip uint64) *transaction.Transaction {
+	return transaction.NewTx(&transaction.DynamicFeeTx{
+		ChainID:   uint256.NewInt(1),
+		Nonce:     nonce,
+		GasTipCap: uint256.NewInt(tip * params.GWei),
+		GasFeeCap: uint256.NewInt((tip + 100) * params.GWei),
+		Gas:       params.TxGas,
+		To:        &to,
+		From:      &from,
+		Value:     uint256.NewInt(0),
+	})
+}
+
+// newTestBackend creates a chain of the given length, filling each block but
+// the genesis with the transactions returned by txs.
+func newTestBackend(length int, txs func(number uint64) []*transaction.Transaction) *testBackend {
+	return newTestBackendWithBaseFee(length, nil, txs)
+}
+
+// newTestBackendWithBaseFee creates a chain like newTestBackend whose blocks
+// all carry the given base fee.
+func newTestBackendWithBaseFee(length int, baseFee *uint256.Int, txs func(number uint64) []*transaction.Transaction) *testBackend {
+	return newTestBackendWithBaseFees(length, func(uint64) *uint256.Int { return baseFee }, txs)
+}
+
+// newTestBackendWithBaseFees creates a chain like newTestBackend whose blocks
+// carry the base fees returned by baseFee.
+func newTestBackendWithBaseFees(length int, baseFee func(number uint64) *uint256.Int, txs func(number uint64) []*transaction.Transaction) *testBackend {
+	backend := new(testBackend)
+	var parent types2.Hash
+	for i := 0; i < length; i++ {
+		header := &block.Header{
+			ParentHash: parent,
+			Coinbase:   testCoinbase,
+			Number:     uint256.NewInt(uint64(i)),
+			Difficulty: uint256.NewInt(0),
+			GasLimit:   params.GenesisGasLimit,
+			Time:       uint64(i) * 8,
+			BaseFee:    baseFee(uint64(i)),
+		}
+		var body []*transaction.Transaction
+		if i > 0 && txs != nil {
+			body = txs(uint64(i))
+		}
+		b := block.NewBlock(header, body)
+		backend.blocks = append(backend.blocks, b)
+		parent = b.Hash()
+	}
+	return backend
+}
+
+func newTestOracle(backend *testBackend, config conf.GpoConfig) *Oracle {
+	if config.Blocks == 0 {
+		config.Blocks = 2
+	}
+	if config.Percentile == 0 {
+		config.Percentile = 60
+	}
+	if config.Default == nil {
+		config.Default = big.NewInt(params.GWei)
+	}
+	return NewOracle(backend, nil, params.TestChainConfig, config)
+}
+
+type failingPriceSource struct{}
+
+func (failingPriceSource) Price(ctx context.Context) (*big.Int, error) {
+	return nil, errors.New("price source unavailable")
+}
+
+func TestSuggestTipCapSourceFallback(t *testing.T) {
+	oracle := newTestOracle(newTestBackend(3, nil), conf.GpoConfig{})
+	oracle.SetPriceSources(failingPriceSource{}, NewStaticPriceSource(big.NewInt(7*params.GWei)), oracle.SamplingSource())
+
+	price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if price.Cmp(big.NewInt(7*params.GWei)) != 0 {
+		t.Errorf("suggestion mismatch: have %v, want %v", price, 7*params.GWei)
+	}
+
+	oracle.SetPriceSources(failingPriceSource{})
+	if _, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig); err == nil {
+		t.Error("expected an error when every source fails")
+	}
+}
+
+func TestSuggestTipCapDefaultSampling(t *testing.T) {
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, number)}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 4, Percentile: 100})
+
+	price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if want := big.NewInt(4 * params.GWei); price.Cmp(want) != 0 {
+		t.Errorf("suggestion mismatch: have %v, want %v", price, want)
+	}
+}
+
+func TestSuggestGasPrice(t *testing.T) {
+	backend := newTestBackendWithBaseFee(5, uint256.NewInt(10*params.GWei), func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, number)}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 4, Percentile: 100})
+
+	tip, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if want := big.NewInt(4 * params.GWei); tip.Cmp(want) != 0 {
+		t.Errorf("tip cap mismatch: have %v, want %v", tip, want)
+	}
+	price, err := oracle.SuggestGasPrice(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest gas price: %v", err)
+	}
+	if want := big.NewInt(14 * params.GWei); price.Cmp(want) != 0 {
+		t.Errorf("gas price mismatch: have %v, want %v", price, want)
+	}
+}
+
+func TestSuggestTipCapWithAge(t *testing.T) {
+	chain := newTestBackend(8, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, number)}
+	})
+	backend := &testBackend{blocks: chain.blocks[:5]}
+	oracle := newTestOracle(backend, conf.GpoConfig{})
+
+	price, head, age, err := oracle.SuggestTipCapWithAge(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if head != chain.blocks[4].Hash() || age != 0 {
+		t.Errorf("fresh suggestion mismatch: head %x, age %d", head, age)
+	}
+	for i := 6; i <= 8; i++ {
+		backend.blocks = chain.blocks[:i]
+		cached, from, age, err := oracle.SuggestTipCapWithAge(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("failed to suggest tip cap: %v", err)
+		}
+		if cached.Cmp(price) != 0 || from != head {
+			t.Errorf("suggestion recomputed: have %v from %x, want %v from %x", cached, from, price, head)
+		}
+		if want := i - 5; age != want {
+			t.Errorf("age mismatch: have %d, want %d", age, want)
+		}
+	}
+}
+
+func TestSuggestTipCapCoinbaseTxs(t *testing.T) {
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testCoinbase, number, 10)}
+	})
+	for _, tt := range []struct {
+		include bool
+		want    *big.Int
+	}{
+		{false, big.NewInt(params.GWei)},
+		{true, big.NewInt(10 * params.GWei)},
+	} {
+		oracle := newTestOracle(backend, conf.GpoConfig{IncludeCoinbaseTxs: tt.include})
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("include %v: failed to suggest tip cap: %v", tt.include, err)
+		}
+		if price.Cmp(tt.want) != 0 {
+			t.Errorf("include %v: suggestion mismatch: have %v, want %v", tt.include, price, tt.want)
+		}
+	}
+}
+
+func TestSuggestTipCapDuplicateBlocks(t *testing.T) {
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		tip := uint64(1)
+		if number >= 3 {
+			tip = 9
+		}
+		return []*transaction.Transaction{newTestTx(testSender, 2*number, tip), newTestTx(testSender, 2*number+1, tip)}
+	})
+	// Serve the head block in place of its parent as well
+	backend.blocks[3] = backend.blocks[4]
+
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 3, Percentile: 50})
+	price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	// Sampled once, the head yields [1 1 9 9] whose median is 1. Counted twice
+	// it would yield [1 1 9 9 9 9] whose median is 9.
+	if want := big.NewInt(params.GWei); price.Cmp(want) != 0 {
+		t.Errorf("suggestion mismatch: have %v, want %v", price, want)
+	}
+}
+
+func TestSuggestTipCapEpochCache(t *testing.T) {
+	chain := newTestBackend(12, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, number)}
+	})
+	config := *params.TestChainConfig
+	config.Clique = &params.CliqueConfig{Period: 8, Epoch: 4}
+
+	for _, tt := range []struct {
+		epochCache bool
+		want       []uint64 // Suggestion in gwei for heads 4 to 9
+	}{
+		{false, []uint64{4, 5, 6, 7, 8, 9}},
+		{true, []uint64{4, 4, 4, 4, 8, 8}},
+	} {
+		backend := &testBackend{blocks: chain.blocks[:5]}
+		oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 1, Percentile: 100, EpochCache: tt.epochCache})
+		for i, want := range tt.want {
+			backend.blocks = chain.blocks[:5+i]
+			price, err := oracle.SuggestTipCap(context.Background(), &config)
+			if err != nil {
+				t.Fatalf("epoch cache %v, head %d: failed to suggest tip cap: %v", tt.epochCache, 4+i, err)
+			}
+			if want := big.NewInt(int64(want * params.GWei)); price.Cmp(want) != 0 {
+				t.Errorf("epoch cache %v, head %d: suggestion mismatch: have %v, want %v", tt.epochCache, 4+i, price, want)
+			}
+		}
+	}
+}
+
+func TestMaxPriorityFeePerGasNoCache(t *testing.T) {
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, number)}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 2, Percentile: 100})
+	api := NewAmcAPI(&API{bc: backend, chainConfig: params.TestChainConfig, gpo: oracle})
+
+	price, err := api.MaxPriorityFeePerGas(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if want := big.NewInt(4 * params.GWei); price.ToInt().Cmp(want) != 0 {
+		t.Errorf("suggestion mismatch: have %v, want %v", price, want)
+	}
+	// Raise the tips below the head, which only a fresh sampling can observe
+	backend.blocks[3] = newTestBackend(4, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 20)}
+	}).blocks[3]
+
+	noCache := false
+	if price, _ := api.MaxPriorityFeePerGas(context.Background(), &noCache); price.ToInt().Cmp(big.NewInt(4*params.GWei)) != 0 {
+		t.Errorf("cached suggestion mismatch: have %v, want %v", price, 4*params.GWei)
+	}
+	noCache = true
+	if price, _ := api.MaxPriorityFeePerGas(context.Background(), &noCache); price.ToInt().Cmp(big.NewInt(20*params.GWei)) != 0 {
+		t.Errorf("fresh suggestion mismatch: have %v, want %v", price, 20*params.GWei)
+	}
+}
+
+// multiChainBackend serves the chains of several test backends by chain ID.
+type multiChainBackend struct {
+	*testBackend // Chain served to chain unaware callers
+	chains       map[uint64]*testBackend
+}
+
+func (b *multiChainBackend) CurrentChainBlock(chainID *big.Int) block.IBlock {
+	return b.chains[chainID.Uint64()].CurrentBlock()
+}
+
+func (b *multiChainBackend) GetChainBlockByNumber(chainID *big.Int, number *uint256.Int) (block.IBlock, error) {
+	return b.chains[chainID.Uint64()].GetBlockByNumber(number)
+}
+
+func TestSuggestTipCapMultiChain(t *testing.T) {
+	newChain := func(length int, tip uint64) *testBackend {
+		return newTestBackend(length, func(number uint64) []*transaction.Transaction {
+			return []*transaction.Transaction{newTestTx(testSender, number, tip)}
+		})
+	}
+	backend := &multiChainBackend{testBackend: newChain(3, 1), chains: map[uint64]*testBackend{
+		100: newChain(5, 3),
+		200: newChain(7, 8),
+	}}
+	oracle := NewOracle(backend, nil, params.TestChainConfig, conf.GpoConfig{Blocks: 2, Percentile: 60, Default: big.NewInt(params.GWei)})
+
+	for _, tt := range []struct {
+		chainID uint64
+		want    int64
+	}{
+		{100, 3 * params.GWei},
+		{200, 8 * params.GWei},
+		{100, 3 * params.GWei},
+	} {
+		config := *params.TestChainConfig
+		config.ChainID = new(big.Int).SetUint64(tt.chainID)
+		price, err := oracle.SuggestTipCap(context.Background(), &config)
+		if err != nil {
+			t.Fatalf("chain %d: failed to suggest tip cap: %v", tt.chainID, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("chain %d: suggestion mismatch: have %v, want %v", tt.chainID, price, tt.want)
+		}
+	}
+}
+
+func TestSuggestTipCapBlockConfirmations(t *testing.T) {
+	backend := newTestBackend(7, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, number)}
+	})
+	for _, tt := range []struct {
+		confirmations int
+		want          int64
+	}{
+		{0, 6 * params.GWei},
+		{2, 4 * params.GWei},
+		{10, params.GWei}, // Nothing to sample, the default is used
+	} {
+		oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 1, Percentile: 100, BlockConfirmations: tt.confirmations})
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("confirmations %d: failed to suggest tip cap: %v", tt.confirmations, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("confirmations %d: suggestion mismatch: have %v, want %v", tt.confirmations, price, tt.want)
+		}
+	}
+}
+
+func TestSuggestTipCapNegativeEffectiveTip(t *testing.T) {
+	backend := newTestBackendWithBaseFee(3, uint256.NewInt(10*params.GWei), func(number uint64) []*transaction.Transaction {
+		// A fee cap below the base fee, whose tip would underflow
+		invalid := transaction.NewTx(&transaction.DynamicFeeTx{
+			ChainID:   uint256.NewInt(1),
+			Nonce:     2 * number,
+			GasTipCap: uint256.NewInt(50 * params.GWei),
+			GasFeeCap: uint256.NewInt(5 * params.GWei),
+			Gas:       params.TxGas,
+			To:        &testRecipient,
+			From:      &testSender,
+			Value:     uint256.NewInt(0),
+		})
+		return []*transaction.Transaction{invalid, newTestTx(testSender, 2*number+1, 2)}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 2, Percentile: 100})
+
+	price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if want := big.NewInt(2 * params.GWei); price.Cmp(want) != 0 {
+		t.Errorf("suggestion mismatch: have %v, want %v", price, want)
+	}
+}
+
+func TestSuggestTipWithinBudget(t *testing.T) {
+	backend := newTestBackendWithBaseFee(5, uint256.NewInt(10*params.GWei), func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 4)}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{})
+
+	for _, tt := range []struct {
+		budget int64
+		want   int64 // Zero when the budget is rejected
+	}{
+		{9 * params.GWei, 0},
+		{10*params.GWei + 1, 1},
+		{100 * params.GWei, 4 * params.GWei},
+	} {
+		tip, err := oracle.SuggestTipWithinBudget(context.Background(), params.TestChainConfig, big.NewInt(tt.budget))
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("budget %d: expected an error, have tip %v", tt.budget, tip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("budget %d: failed to suggest tip: %v", tt.budget, err)
+		}
+		if tip.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("budget %d: tip mismatch: have %v, want %v", tt.budget, tip, tt.want)
+		}
+	}
+}
+
+func TestSuggestTipCapBlacklist(t *testing.T) {
+	spam := newTestTx(testSender, 100, 50)
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		txs := []*transaction.Transaction{newTestTx(testSender, number, 2)}
+		if number == 4 {
+			txs = append(txs, spam)
+		}
+		return txs
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 2, Percentile: 100})
+
+	price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if want := big.NewInt(50 * params.GWei); price.Cmp(want) != 0 {
+		t.Errorf("suggestion mismatch: have %v, want %v", price, want)
+	}
+	oracle.SetBlacklist([]types2.Hash{spam.Hash()})
+	if price, err = oracle.SuggestTipCap(context.Background(), params.TestChainConfig); err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if want := big.NewInt(2 * params.GWei); price.Cmp(want) != 0 {
+		t.Errorf("blacklisted suggestion mismatch: have %v, want %v", price, want)
+	}
+	// The configured blacklist is decoded from hex, skipping the invalid hashes
+	oracle = newTestOracle(backend, conf.GpoConfig{Blocks: 2, Percentile: 100, Blacklist: []string{"0x1234", spam.Hash().Hex()}})
+	if price, err = oracle.SuggestTipCap(context.Background(), params.TestChainConfig); err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if want := big.NewInt(2 * params.GWei); price.Cmp(want) != 0 {
+		t.Errorf("configured blacklist suggestion mismatch: have %v, want %v", price, want)
+	}
+}
+
+func TestSuggestTipCapSampleWindow(t *testing.T) {
+	// Blocks produced in bursts, the last five within five seconds
+	times := []uint64{0, 100, 200, 300, 301, 302, 303, 304}
+	backend := new(testBackend)
+	var parent types2.Hash
+	for i, time := range times {
+		var txs []*transaction.Transaction
+		if i > 0 {
+			txs = []*transaction.Transaction{newTestTx(testSender, uint64(i), uint64(i))}
+		}
+		b := block.NewBlock(&block.Header{
+			ParentHash: parent,
+			Coinbase:   testCoinbase,
+			Number:     uint256.NewInt(uint64(i)),
+			Difficulty: uint256.NewInt(0),
+			GasLimit:   params.GenesisGasLimit,
+			Time:       time,
+		}, txs)
+		backend.blocks = append(backend.blocks, b)
+		parent = b.Hash()
+	}
+	for _, tt := range []struct {
+		window     uint64
+		maxHistory int
+		want       int64
+	}{
+		{0, 1024, 6 * params.GWei}, // Two blocks sampled
+		{5, 1024, 3 * params.GWei}, // Blocks 3 to 7 sampled
+		{1000, 3, 5 * params.GWei}, // Blocks 5 to 7 sampled
+	} {
+		oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 2, Percentile: 0, SampleWindow: tt.window, MaxBlockHistory: tt.maxHistory})
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("window %d: failed to suggest tip cap: %v", tt.window, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("window %d: suggestion mismatch: have %v, want %v", tt.window, price, tt.want)
+		}
+	}
+}
+
+func TestSuggestTipCapsAt(t *testing.T) {
+	backend := newTestBackend(9, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{
+			newTestTx(testSender, 3*number, number),
+			newTestTx(testSender, 3*number+1, 2*number),
+			newTestTx(testSender, 3*number+2, 5*number),
+		}
+	})
+	percentiles := []int{10, 25, 50, 75, 90}
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 4})
+	prices, err := oracle.SuggestTipCapsAt(context.Background(), params.TestChainConfig, percentiles)
+	if err != nil {
+		t.Fatalf("failed to suggest tip caps: %v", err)
+	}
+	if len(prices) != len(percentiles) {
+		t.Fatalf("suggestion count mismatch: have %d, want %d", len(prices), len(percentiles))
+	}
+	for i, percentile := range percentiles {
+		want, err := newTestOracle(backend, conf.GpoConfig{Blocks: 4, Percentile: percentile}).SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("percentile %d: failed to suggest tip cap: %v", percentile, err)
+		}
+		if prices[i].Cmp(want) != 0 {
+			t.Errorf("percentile %d: suggestion mismatch: have %v, want %v", percentile, prices[i], want)
+		}
+	}
+	if _, err := oracle.SuggestTipCapsAt(context.Background(), params.TestChainConfig, []int{50, 101}); err == nil {
+		t.Error("expected an error for an out of range percentile")
+	} else if !strings.Contains(err.Error(), "#1") {
+		t.Errorf("error not naming the offending percentile: %v", err)
+	}
+}
+
+// countingBackend is a testBackend counting the blocks read.
+type countingBackend struct {
+	*testBackend
+	lock  sync.Mutex
+	reads int
+}
+
+func (b *countingBackend) GetBlockByNumber(number *uint256.Int) (block.IBlock, error) {
+	b.lock.Lock()
+	b.reads++
+	b.lock.Unlock()
+	return b.testBackend.GetBlockByNumber(number)
+}
+
+func TestSuggestTipCaps(t *testing.T) {
+	backend := &countingBackend{testBackend: newTestBackend(9, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{
+			newTestTx(testSender, 3*number, number),
+			newTestTx(testSender, 3*number+1, 2*number),
+			newTestTx(testSender, 3*number+2, 5*number),
+		}
+	})}
+	oracle := NewOracle(backend, nil, params.TestChainConfig, conf.GpoConfig{Blocks: 4, Percentile: 60, Default: big.NewInt(params.GWei)})
+	prices, err := oracle.SuggestTipCaps(context.Background(), []int{0, 50, 100})
+	if err != nil {
+		t.Fatalf("failed to suggest tip caps: %v", err)
+	}
+	// The blocks are read once for all the percentiles
+	if backend.reads != 4 {
+		t.Errorf("block reads mismatch: have %d, want 4", backend.reads)
+	}
+	// The 12 tips of blocks 5 to 8 sorted, picked at indexes 0, 5 and 11
+	for i, want := range []int64{5 * params.GWei, 12 * params.GWei, 40 * params.GWei} {
+		if prices[i].Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("suggestion %d mismatch: have %v, want %v", i, prices[i], want)
+		}
+	}
+}
+
+func TestSuggestBlendedTipCap(t *testing.T) {
+	backend := newTestBackend(9, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{
+			newTestTx(testSender, 3*number, number),
+			newTestTx(testSender, 3*number+1, 2*number),
+			newTestTx(testSender, 3*number+2, 5*number),
+		}
+	})
+	// The weights are normalized, 5, 3 and 2 blending as 0.5, 0.3 and 0.2
+	blend := []conf.PercentileWeight{{Percentile: 60, Weight: 5}, {Percentile: 75, Weight: 3}, {Percentile: 90, Weight: 2}}
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 4, PercentileBlend: blend})
+
+	prices, err := oracle.SuggestTipCapsAt(context.Background(), params.TestChainConfig, []int{60, 75, 90})
+	if err != nil {
+		t.Fatalf("failed to suggest tip caps: %v", err)
+	}
+	if prices[0].Cmp(prices[2]) == 0 {
+		t.Fatalf("blended percentiles suggest the same tip cap %v", prices[0])
+	}
+	want := new(big.Int).Mul(prices[0], big.NewInt(5))
+	want.Add(want, new(big.Int).Mul(prices[1], big.NewInt(3)))
+	want.Add(want, new(big.Int).Mul(prices[2], big.NewInt(2)))
+	want.Div(want, big.NewInt(10))
+
+	price, err := oracle.SuggestBlendedTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest blended tip cap: %v", err)
+	}
+	if price.Cmp(want) != 0 {
+		t.Errorf("blended suggestion mismatch: have %v, want %v", price, want)
+	}
+	// Without a blend, the suggestion is the plain one
+	plain := newTestOracle(backend, conf.GpoConfig{Blocks: 4})
+	have, err := plain.SuggestBlendedTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest blended tip cap: %v", err)
+	}
+	if want, _ := plain.SuggestTipCap(context.Background(), params.TestChainConfig); have.Cmp(want) != 0 {
+		t.Errorf("unblended suggestion mismatch: have %v, want %v", have, want)
+	}
+}
+
+func TestSuggestSeries(t *testing.T) {
+	backend := newTestBackend(16, func(number uint64) []*transaction.Transaction {
+		if number%4 == 0 {
+			return nil
+		}
+		return []*transaction.Transaction{newTestTx(testSender, number, number*params.GWei)}
+	})
+	series, err := newTestOracle(backend, conf.GpoConfig{}).SuggestSeries(context.Background(), params.TestChainConfig, 4, 15)
+	if err != nil {
+		t.Fatalf("failed to compute series: %v", err)
+	}
+	if len(series) != 12 {
+		t.Fatalf("series length mismatch: have %d, want %d", len(series), 12)
+	}
+	// Each suggestion matches the live one made when the chain was at that head
+	var (
+		blocks = backend.blocks
+		oracle = newTestOracle(backend, conf.GpoConfig{})
+	)
+	for i, have := range series {
+		backend.blocks = blocks[:5+i]
+		want, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("failed to suggest tip cap at %d: %v", 4+i, err)
+		}
+		if have.Cmp(want) != 0 {
+			t.Errorf("suggestion %d mismatch: have %v, want %v", 4+i, have, want)
+		}
+	}
+}
+
+func benchmarkSeriesBackend() *testBackend {
+	return newTestBackend(1024, func(number uint64) []*transaction.Transaction {
+		txs := make([]*transaction.Transaction, sampleNumber)
+		for i := range txs {
+			txs[i] = newTestTx(testSender, number*sampleNumber+uint64(i), (number%10+uint64(i)+1)*params.GWei)
+		}
+		return txs
+	})
+}
+
+func BenchmarkSuggestSeries(b *testing.B) {
+	backend := benchmarkSeriesBackend()
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 20})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := oracle.SuggestSeries(context.Background(), params.TestChainConfig, 1, 1023); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSuggestSeriesPerBlock(b *testing.B) {
+	backend := benchmarkSeriesBackend()
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 20})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for head := uint64(1); head <= 1023; head++ {
+			if _, err := oracle.SuggestSeries(context.Background(), params.TestChainConfig, head, head); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSuggestTipCapSafetyMultiplier(t *testing.T) {
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 10)}
+	})
+	tests := []struct {
+		maxPrice *big.Int
+		want     *big.Int
+	}{
+		{big.NewInt(20 * params.GWei), big.NewInt(12.5 * params.GWei)},
+		{big.NewInt(12 * params.GWei), big.NewInt(12 * params.GWei)},
+	}
+	for i, tt := range tests {
+		oracle := newTestOracle(backend, conf.GpoConfig{MaxPrice: tt.maxPrice, SafetyMultiplier: 1.25})
+		// Served from the cache the second time, without compounding
+		for j := 0; j < 2; j++ {
+			have, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+			if err != nil {
+				t.Fatalf("test %d: failed to suggest tip cap: %v", i, err)
+			}
+			if have.Cmp(tt.want) != 0 {
+				t.Errorf("test %d, call %d: tip cap mismatch: have %v, want %v", i, j, have, tt.want)
+			}
+		}
+	}
+}
+
+func TestSuggestTipCapForTarget(t *testing.T) {
+	busy := types2.HexToAddress("0x5000000000000000000000000000000000000005")
+	backend := newTestBackend(9, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{
+			newTestTxTo(testSender, busy, 2*number, 30),
+			newTestTx(testSender, 2*number+1, 5),
+		}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{})
+
+	global, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if want := big.NewInt(5 * params.GWei); global.Cmp(want) != 0 {
+		t.Fatalf("global tip cap mismatch: have %v, want %v", global, want)
+	}
+	have, err := oracle.SuggestTipCapForTarget(context.Background(), params.TestChainConfig, busy)
+	if err != nil {
+		t.Fatalf("failed to suggest target tip cap: %v", err)
+	}
+	if want := big.NewInt(30 * params.GWei); have.Cmp(want) != 0 {
+		t.Errorf("target tip cap mismatch: have %v, want %v", have, want)
+	}
+	// Without enough samples, the global suggestion is returned
+	idle := types2.HexToAddress("0x4000000000000000000000000000000000000004")
+	have, err = oracle.SuggestTipCapForTarget(context.Background(), params.TestChainConfig, idle)
+	if err != nil {
+		t.Fatalf("failed to suggest idle target tip cap: %v", err)
+	}
+	if have.Cmp(global) != 0 {
+		t.Errorf("idle target tip cap mismatch: have %v, want %v", have, global)
+	}
+}
+
+// testEstimator is an ExternalEstimator answering with a fixed price after a
+// delay, unless the context is done first.
+type testEstimator struct {
+	price *big.Int
+	delay time.Duration
+}
+
+func (e *testEstimator) EstimateTipCap(ctx context.Context) (*big.Int, error) {
+	select {
+	case <-time.After(e.delay):
+		return e.price, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestSuggestTipCapExternalEstimator(t *testing.T) {
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 10)}
+	})
+	tests := []struct {
+		estimator *testEstimator
+		want      *big.Int
+	}{
+		// Answering in time, the estimate is used
+		{&testEstimator{price: big.NewInt(20 * params.GWei)}, big.NewInt(20 * params.GWei)},
+		// Answering above the price cap, the estimate is clamped
+		{&testEstimator{price: big.NewInt(80 * params.GWei)}, big.NewInt(50 * params.GWei)},
+		// Timing out, the local sampling is used
+		{&testEstimator{price: big.NewInt(20 * params.GWei), delay: time.Second}, big.NewInt(10 * params.GWei)},
+	}
+	for i, tt := range tests {
+		oracle := newTestOracle(backend, conf.GpoConfig{MaxPrice: big.NewInt(50 * params.GWei)})
+		oracle.SetExternalEstimator(tt.estimator, 50*time.Millisecond)
+
+		have, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("test %d: failed to suggest tip cap: %v", i, err)
+		}
+		if have.Cmp(tt.want) != 0 {
+			t.Errorf("test %d: tip cap mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+}
+
+// testTxPool is a mempool only reporting its number of pending transactions.
+type testTxPool struct {
+	txs_pool.ITxsPool
+	pending int
+}
+
+func (p *testTxPool) Stats() (int, int, int, int) {
+	return p.pending, p.pending, 0, 0
+}
+
+func TestSuggestTipCapIdle(t *testing.T) {
+	// Only the coinbase transacts, which isn't sampled
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testCoinbase, number, 10)}
+	})
+	pool := new(testTxPool)
+	oracle := newTestOracle(backend, conf.GpoConfig{IdleTip: new(big.Int)})
+	oracle.SetTxPool(pool)
+
+	have, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if have.Sign() != 0 {
+		t.Errorf("idle tip cap mismatch: have %v, want 0", have)
+	}
+	// A pending transaction ends the idleness, the last price is suggested
+	pool.pending = 1
+	have, err = oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if want := big.NewInt(params.GWei); have.Cmp(want) != 0 {
+		t.Errorf("busy tip cap mismatch: have %v, want %v", have, want)
+	}
+	// Without the idle mode, the last price is suggested too
+	pool.pending = 0
+	oracle = newTestOracle(backend, conf.GpoConfig{})
+	oracle.SetTxPool(pool)
+	have, err = oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if want := big.NewInt(params.GWei); have.Cmp(want) != 0 {
+		t.Errorf("default tip cap mismatch: have %v, want %v", have, want)
+	}
+}
+
+func TestSuggestTipCapIdleOncePerHead(t *testing.T) {
+	backend := &countingBackend{testBackend: newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testCoinbase, number, 10)}
+	})}
+	pool := new(testTxPool)
+	oracle := newTestOracle(backend, conf.GpoConfig{IdleTip: new(big.Int)})
+	oracle.SetTxPool(pool)
+
+	// The blocks of a head are checked for idleness once, the mempool always
+	var reads int
+	for i := 0; i < 3; i++ {
+		have, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("query %d: failed to suggest tip cap: %v", i, err)
+		}
+		if have.Sign() != 0 {
+			t.Errorf("query %d: idle tip cap mismatch: have %v, want 0", i, have)
+		}
+		if i == 0 {
+			reads = backend.reads
+		} else if backend.reads != reads {
+			t.Errorf("query %d: block reads mismatch: have %d, want %d", i, backend.reads, reads)
+		}
+	}
+	pool.pending = 1
+	if have, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig); err != nil || have.Sign() == 0 {
+		t.Errorf("busy tip cap mismatch: have %v, %v, want non-zero", have, err)
+	}
+}
+
+func TestSelectTipCap(t *testing.T) {
+	values := func(prices ...int64) []*big.Int {
+		results := make([]*big.Int, len(prices))
+		for i, price := range prices {
+			results[i] = big.NewInt(price)
+		}
+		return results
+	}
+	tests := []struct {
+		results    []*big.Int
+		percentile int
+		maxPrice   *big.Int
+		floor      *big.Int
+		want       *big.Int
+	}{
+		// Empty: the floor if any
+		{nil, 60, big.NewInt(100), nil, nil},
+		{nil, 60, big.NewInt(100), big.NewInt(5), big.NewInt(5)},
+		// Single: whatever the percentile
+		{values(7), 0, big.NewInt(100), nil, big.NewInt(7)},
+		{values(7), 100, big.NewInt(100), nil, big.NewInt(7)},
+		// Unsorted values
+		{values(5, 1, 4, 2, 3), 60, big.NewInt(100), nil, big.NewInt(3)},
+		// Cap hit
+		{values(50, 150, 200), 60, big.NewInt(100), nil, big.NewInt(100)},
+		// Floor hit
+		{values(1, 2, 3), 60, big.NewInt(100), big.NewInt(10), big.NewInt(10)},
+		// The cap binds over the floor
+		{values(1, 2, 3), 60, big.NewInt(100), big.NewInt(200), big.NewInt(100)},
+	}
+	for i, tt := range tests {
+		have := SelectTipCap(tt.results, tt.percentile, tt.maxPrice, tt.floor)
+		if (have == nil) != (tt.want == nil) || (have != nil && have.Cmp(tt.want) != 0) {
+			t.Errorf("test %d: tip cap mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+}
+
+// uncleBackend serves the given uncles of the blocks of its chain.
+type uncleBackend struct {
+	*testBackend
+	uncles map[types2.Hash][]block.IBlock
+}
+
+func (b *uncleBackend) GetUncleBlocks(hash types2.Hash) []block.IBlock {
+	return b.uncles[hash]
+}
+
+func TestSuggestTipCapUncles(t *testing.T) {
+	chain := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 10)}
+	})
+	// Each block references an uncle holding a transaction paying more
+	uncles := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, 100+number, 100)}
+	})
+	backend := &uncleBackend{testBackend: chain, uncles: make(map[types2.Hash][]block.IBlock)}
+	for i, b := range chain.blocks {
+		backend.uncles[b.Hash()] = []block.IBlock{uncles.blocks[i]}
+	}
+	for _, tt := range []struct {
+		weight int
+		want   int64
+	}{
+		{0, 10 * params.GWei},  // Uncles not sampled
+		{50, 50 * params.GWei}, // Uncle tips halved
+	} {
+		oracle := NewOracle(backend, nil, params.TestChainConfig, conf.GpoConfig{Blocks: 2, Percentile: 100, Default: big.NewInt(params.GWei), UncleWeight: tt.weight})
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("weight %d: failed to suggest tip cap: %v", tt.weight, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("weight %d: suggestion mismatch: have %v, want %v", tt.weight, price, tt.want)
+		}
+	}
+}
+
+func TestFormatPrice(t *testing.T) {
+	decimals := 6
+	oracle := newTestOracle(newTestBackend(3, nil), conf.GpoConfig{Denomination: "USDC", Decimals: &decimals})
+	for _, tt := range []struct {
+		price int64
+		want  string
+	}{
+		{0, "0 USDC"},
+		{42, "0.000042 USDC"},
+		{1500000, "1.5 USDC"},
+		{2000000, "2 USDC"},
+		{1234567891, "1234.567891 USDC"},
+	} {
+		if have := oracle.FormatPrice(big.NewInt(tt.price)); have != tt.want {
+			t.Errorf("price %d: formatting mismatch: have %q, want %q", tt.price, have, tt.want)
+		}
+	}
+	// Without any denomination, the default 18 decimals apply
+	oracle = newTestOracle(newTestBackend(3, nil), conf.GpoConfig{})
+	if have, want := oracle.FormatPrice(big.NewInt(params.GWei)), "0.000000001"; have != want {
+		t.Errorf("default formatting mismatch: have %q, want %q", have, want)
+	}
+	// An explicit zero decimals formats whole units instead of the default
+	decimals = 0
+	oracle = newTestOracle(newTestBackend(3, nil), conf.GpoConfig{Denomination: "PTS", Decimals: &decimals})
+	if have, want := oracle.FormatPrice(big.NewInt(1500000)), "1500000 PTS"; have != want {
+		t.Errorf("zero decimals formatting mismatch: have %q, want %q", have, want)
+	}
+}
+
+func TestSuggestTipCapAutoTune(t *testing.T) {
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{
+			newTestTx(testSender, 3*number, 1),
+			newTestTx(testSender, 3*number+1, 5),
+			newTestTx(testSender, 3*number+2, 9),
+		}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 4, Percentile: 70, AutoTunePercentile: true, MinPercentile: 60, MaxPercentile: 75})
+	check := func(stage string, percentile int, tip int64) {
+		t.Helper()
+		if have := oracle.Percentile(); have != percentile {
+			t.Errorf("%s: percentile mismatch: have %d, want %d", stage, have, percentile)
+		}
+		have, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("%s: failed to suggest tip cap: %v", stage, err)
+		}
+		if want := big.NewInt(tip * params.GWei); have.Cmp(want) != 0 {
+			t.Errorf("%s: tip cap mismatch: have %v, want %v", stage, have, want)
+		}
+	}
+	check("initial", 70, 5)
+
+	oracle.ReportInclusion(false)
+	check("after a failure", 75, 9)
+	oracle.ReportInclusion(false)
+	check("bounded by the max percentile", 75, 9)
+
+	for i := 0; i < tuneSuccesses-1; i++ {
+		oracle.ReportInclusion(true)
+	}
+	check("before a full run of successes", 75, 9)
+	oracle.ReportInclusion(true)
+	check("after a run of successes", 70, 5)
+}
+
+func TestSuggestTipForBlockPosition(t *testing.T) {
+	// Every block holds ten transactions tipping 1 to 10 gwei
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		txs := make([]*transaction.Transaction, 10)
+		for i := range txs {
+			txs[i] = newTestTx(testSender, 10*number+uint64(i), uint64(10-i))
+		}
+		return txs
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 3})
+	for _, tt := range []struct {
+		fraction float64
+		want     int64
+	}{
+		{0.2, 9 * params.GWei},
+		{0.8, 3 * params.GWei},
+	} {
+		have, err := oracle.SuggestTipForBlockPosition(context.Background(), params.TestChainConfig, tt.fraction)
+		if err != nil {
+			t.Fatalf("fraction %v: failed to suggest tip: %v", tt.fraction, err)
+		}
+		if have.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("fraction %v: tip mismatch: have %v, want %v", tt.fraction, have, tt.want)
+		}
+	}
+	if _, err := oracle.SuggestTipForBlockPosition(context.Background(), params.TestChainConfig, 1.5); err == nil {
+		t.Error("expected an error for an out of range position")
+	}
+}
+
+func TestSuggestTipCapMaxChangeRatio(t *testing.T) {
+	// Three blocks tipping 1 gwei, then a spike to 10 gwei
+	full := newTestBackend(6, func(number uint64) []*transaction.Transaction {
+		tip := uint64(1)
+		if number >= 3 {
+			tip = 10
+		}
+		return []*transaction.Transaction{newTestTx(testSender, number, tip)}
+	})
+	backend := &testBackend{blocks: full.blocks[:3]}
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 1, MaxChangeRatio: 2})
+
+	suggest := func(want int64) {
+		t.Helper()
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("failed to suggest tip cap: %v", err)
+		}
+		if price.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("suggestion mismatch: have %v, want %v", price, want)
+		}
+	}
+	suggest(params.GWei)
+
+	// The spike is rate limited, one head at a time
+	backend.blocks = full.blocks[:4]
+	suggest(2 * params.GWei)
+	backend.blocks = full.blocks[:5]
+	suggest(4 * params.GWei)
+
+	// A reorg dropping the last head lifts the limit
+	backend.blocks = newTestBackend(6, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testRecipient, number, 10)}
+	}).blocks
+	suggest(10 * params.GWei)
+}
+
+// tagBackend is a testBackend resolving the safe and finalized tags to fixed
+// block numbers.
+type tagBackend struct {
+	*testBackend
+	tags map[jsonrpc.BlockNumber]uint64
+}
+
+func (b *tagBackend) GetBlockByTag(tag jsonrpc.BlockNumber) (block.IBlock, error) {
+	number, ok := b.tags[tag]
+	if !ok {
+		return nil, nil
+	}
+	return b.GetBlockByNumber(uint256.NewInt(number))
+}
+
+func TestSuggestTipCapAtTag(t *testing.T) {
+	backend := &tagBackend{
+		testBackend: newTestBackend(10, func(number uint64) []*transaction.Transaction {
+			return []*transaction.Transaction{newTestTx(testSender, number, number)}
+		}),
+		tags: map[jsonrpc.BlockNumber]uint64{
+			jsonrpc.SafeBlockNumber:      7,
+			jsonrpc.FinalizedBlockNumber: 4,
+		},
+	}
+	oracle := NewOracle(backend, nil, params.TestChainConfig, conf.GpoConfig{Blocks: 1, Percentile: 100, Default: big.NewInt(params.GWei)})
+
+	// Each tag is sampled from its own head, even if alternated
+	for _, tt := range []struct {
+		tag  jsonrpc.BlockNumber
+		want int64
+	}{
+		{jsonrpc.LatestBlockNumber, 9 * params.GWei},
+		{jsonrpc.SafeBlockNumber, 7 * params.GWei},
+		{jsonrpc.FinalizedBlockNumber, 4 * params.GWei},
+		{jsonrpc.LatestBlockNumber, 9 * params.GWei},
+	} {
+		price, err := oracle.SuggestTipCapAtTag(context.Background(), params.TestChainConfig, tt.tag)
+		if err != nil {
+			t.Fatalf("tag %d: failed to suggest tip cap: %v", tt.tag, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("tag %d: suggestion mismatch: have %v, want %v", tt.tag, price, tt.want)
+		}
+	}
+	if _, err := oracle.SuggestTipCapAtTag(context.Background(), params.TestChainConfig, jsonrpc.PendingBlockNumber); !errors.Is(err, errUnsupportedTag) {
+		t.Errorf("pending tag error mismatch: have %v, want %v", err, errUnsupportedTag)
+	}
+	if _, err := newTestOracle(backend.testBackend, conf.GpoConfig{}).SuggestTipCapAtTag(context.Background(), params.TestChainConfig, jsonrpc.SafeBlockNumber); !errors.Is(err, errUnsupportedTag) {
+		t.Errorf("safe tag error mismatch without tag support: have %v, want %v", err, errUnsupportedTag)
+	}
+}
+
+func TestSuggestTipCapAtTagKeepsLatest(t *testing.T) {
+	backend := &tagBackend{
+		testBackend: newTestBackend(10, func(number uint64) []*transaction.Transaction {
+			return []*transaction.Transaction{newTestTx(testSender, number, number)}
+		}),
+		tags: map[jsonrpc.BlockNumber]uint64{jsonrpc.FinalizedBlockNumber: 4},
+	}
+	// A change limit would clamp the latest suggestion if the finalized one
+	// counted as the previous one
+	oracle := NewOracle(backend, nil, params.TestChainConfig, conf.GpoConfig{Blocks: 1, Percentile: 100, Default: big.NewInt(params.GWei), MaxChangeRatio: 1.5})
+	head := backend.CurrentBlock().Hash()
+	for i, tt := range []struct {
+		tag  jsonrpc.BlockNumber
+		want int64
+	}{
+		{jsonrpc.LatestBlockNumber, 9 * params.GWei},
+		{jsonrpc.FinalizedBlockNumber, 4 * params.GWei},
+		{jsonrpc.LatestBlockNumber, 9 * params.GWei},
+		{jsonrpc.FinalizedBlockNumber, 4 * params.GWei},
+		{jsonrpc.LatestBlockNumber, 9 * params.GWei},
+	} {
+		price, err := oracle.SuggestTipCapAtTag(context.Background(), params.TestChainConfig, tt.tag)
+		if err != nil {
+			t.Fatalf("query %d: failed to suggest tip cap: %v", i, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("query %d: suggestion mismatch: have %v, want %v", i, price, tt.want)
+		}
+		// The latest head suggestion is left alone by the tag ones
+		price, lastHead, age, err := oracle.SuggestTipCapWithAge(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("query %d: failed to get the last tip cap: %v", i, err)
+		}
+		if lastHead != head || age != 0 || price.Cmp(big.NewInt(9*params.GWei)) != 0 {
+			t.Errorf("query %d: last suggestion mismatch: have %v at %x aged %d, want %v at %x", i, price, lastHead, age, 9*params.GWei, head)
+		}
+	}
+}
+
+func TestSuggestTipCapMaxAge(t *testing.T) {
+	backend := newTestBackend(3, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 5)}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{MaxAge: 50 * time.Millisecond})
+	if _, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig); err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	// Tamper with the cached price to tell whether it's served
+	oracle.cacheLock.Lock()
+	oracle.lastPrice = big.NewInt(params.GWei)
+	oracle.cacheLock.Unlock()
+
+	suggest := func(want int64) {
+		t.Helper()
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("failed to suggest tip cap: %v", err)
+		}
+		if price.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("suggestion mismatch: have %v, want %v", price, want)
+		}
+	}
+	suggest(params.GWei)
+
+	// Past the max age, the suggestion is recomputed at the same head
+	time.Sleep(100 * time.Millisecond)
+	suggest(5 * params.GWei)
+
+	if oracle := newTestOracle(backend, conf.GpoConfig{MaxAge: -time.Second}); oracle.maxAge != conf.DefaultMaxAge {
+		t.Errorf("max age not sanitized: have %v, want %v", oracle.maxAge, conf.DefaultMaxAge)
+	}
+}
+
+// stallingBackend is a testBackend whose block retrievals stall until released.
+type stallingBackend struct {
+	*testBackend
+	release chan struct{}
+}
+
+func (b *stallingBackend) GetBlockByNumber(number *uint256.Int) (block.IBlock, error) {
+	<-b.release
+	return b.testBackend.GetBlockByNumber(number)
+}
+
+func TestSuggestTipCapCancel(t *testing.T) {
+	backend := &stallingBackend{testBackend: newTestBackend(5, nil), release: make(chan struct{})}
+	defer close(backend.release)
+	oracle := NewOracle(backend, nil, params.TestChainConfig, conf.GpoConfig{Blocks: 3, Percentile: 60, Default: big.NewInt(params.GWei)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := oracle.SuggestTipCap(ctx, params.TestChainConfig)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("error mismatch: have %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("suggestion not aborted by the context cancellation")
+	}
+}
+
+// headlessBlock is a block without any header, as served by a backend which
+// isn't initialized yet.
+type headlessBlock struct {
+	block.IBlock
+}
+
+func (b *headlessBlock) Header() block.IHeader {
+	return nil
+}
+
+// headlessBackend is a testBackend whose current block has no header.
+type headlessBackend struct {
+	*testBackend
+}
+
+func (b *headlessBackend) CurrentBlock() block.IBlock {
+	return new(headlessBlock)
+}
+
+func TestSuggestTipCapNilHead(t *testing.T) {
+	backend := &headlessBackend{newTestBackend(1, nil)}
+	oracle := NewOracle(backend, nil, params.TestChainConfig, conf.GpoConfig{Blocks: 2, Percentile: 60, Default: big.NewInt(3 * params.GWei)})
+	for _, suggest := range []func(context.Context, *params.ChainConfig) (*big.Int, error){oracle.SuggestTipCap, oracle.SuggestGasPrice} {
+		if _, err := suggest(context.Background(), params.TestChainConfig); !errors.Is(err, ErrNoChainHead) {
+			t.Errorf("error mismatch: have %v, want %v", err, ErrNoChainHead)
+		}
+	}
+	// Nor do the suggestions sampling the blocks themselves
+	if _, err := oracle.SuggestTipCapsAt(context.Background(), params.TestChainConfig, []int{50}); !errors.Is(err, ErrNoChainHead) {
+		t.Errorf("percentiles error mismatch: have %v, want %v", err, ErrNoChainHead)
+	}
+	if _, err := oracle.SuggestTipForBlockPosition(context.Background(), params.TestChainConfig, 0.5); !errors.Is(err, ErrNoChainHead) {
+		t.Errorf("block position error mismatch: have %v, want %v", err, ErrNoChainHead)
+	}
+	// The RPC clients are told to retry
+	api := NewAmcAPI(&API{bc: backend, chainConfig: params.TestChainConfig, gpo: oracle})
+	for _, suggest := range []func(context.Context, *bool) (*hexutil.Big, error){api.GasPrice, api.MaxPriorityFeePerGas} {
+		_, err := suggest(context.Background(), nil)
+		if rpcErr, ok := err.(jsonrpc.Error); !ok || rpcErr.ErrorCode() != -32002 {
+			t.Errorf("RPC error mismatch: have %v, want code -32002", err)
+		}
+	}
+}
+
+func TestOracleStats(t *testing.T) {
+	backend := newTestBackend(3, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 4)}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{})
+	if stats := oracle.Stats(); !stats.LastFetch.IsZero() || stats.LastPrice.Cmp(big.NewInt(params.GWei)) != 0 {
+		t.Errorf("initial stats mismatch: have price %v fetched at %v, want the default never fetched", stats.LastPrice, stats.LastFetch)
+	}
+	if _, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig); err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	stats := oracle.Stats()
+	if stats.LastPrice.Cmp(big.NewInt(4*params.GWei)) != 0 {
+		t.Errorf("last price mismatch: have %v, want %v", stats.LastPrice, 4*params.GWei)
+	}
+	if stats.LastHead != backend.CurrentBlock().Hash() || stats.LastFetch.IsZero() {
+		t.Errorf("last fetch mismatch: have head %x at %v, want head %x", stats.LastHead, stats.LastFetch, backend.CurrentBlock().Hash())
+	}
+	if stats.CheckBlocks != 2 || stats.Percentile != 60 {
+		t.Errorf("configuration mismatch: have %d blocks at percentile %d, want 2 at 60", stats.CheckBlocks, stats.Percentile)
+	}
+}
+
+func TestSuggestTipCapSamplesPerBlock(t *testing.T) {
+	// Every block holds five transactions tipping 1 to 5 gwei
+	backend := newTestBackend(3, func(number uint64) []*transaction.Transaction {
+		txs := make([]*transaction.Transaction, 5)
+		for i := range txs {
+			txs[i] = newTestTx(testSender, 5*number+uint64(i), uint64(i+1))
+		}
+		return txs
+	})
+	for _, tt := range []struct {
+		samples int
+		want    int64
+	}{
+		{0, 3 * params.GWei}, // The three lowest tips are sampled by default
+		{5, 5 * params.GWei},
+	} {
+		oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 1, Percentile: 100, SamplesPerBlock: tt.samples})
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("samples %d: failed to suggest tip cap: %v", tt.samples, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("samples %d: suggestion mismatch: have %v, want %v", tt.samples, price, tt.want)
+		}
+	}
+}
+
+func TestSuggestTipCapMaxSamplesPerSender(t *testing.T) {
+	// In every block, a flooder sends three transactions tipping 1 gwei and
+	// another sender one tipping 10 gwei
+	backend := newTestBackend(3, func(number uint64) []*transaction.Transaction {
+		txs := []*transaction.Transaction{newTestTx(types2.BytesToAddress([]byte{0x40, byte(number)}), 0, 10)}
+		for i := uint64(0); i < 3; i++ {
+			txs = append(txs, newTestTx(testSender, 3*number+i, 1))
+		}
+		return txs
+	})
+	for _, tt := range []struct {
+		maxPerSender int
+		want         int64
+	}{
+		{0, params.GWei},
+		{1, 10 * params.GWei},
+	} {
+		oracle := newTestOracle(backend, conf.GpoConfig{SamplesPerBlock: 4, MaxSamplesPerSender: tt.maxPerSender})
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("max per sender %d: failed to suggest tip cap: %v", tt.maxPerSender, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("max per sender %d: suggestion mismatch: have %v, want %v", tt.maxPerSender, price, tt.want)
+		}
+	}
+}
+
+func TestSuggestTipCapIgnoreSelfFallback(t *testing.T) {
+	// The two latest blocks are empty, the older ones tip 7 gwei
+	backend := newTestBackend(6, func(number uint64) []*transaction.Transaction {
+		if number > 3 {
+			return nil
+		}
+		return []*transaction.Transaction{newTestTx(testSender, number, 7)}
+	})
+	for _, tt := range []struct {
+		ignore bool
+		want   int64
+	}{
+		{false, params.GWei}, // The empty blocks contribute the default price
+		{true, 7 * params.GWei},
+	} {
+		oracle := newTestOracle(backend, conf.GpoConfig{IgnoreSelfFallback: tt.ignore})
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("ignore %v: failed to suggest tip cap: %v", tt.ignore, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("ignore %v: suggestion mismatch: have %v, want %v", tt.ignore, price, tt.want)
+		}
+	}
+	// Without any sample at all, the last price is kept
+	oracle := newTestOracle(newTestBackend(6, nil), conf.GpoConfig{IgnoreSelfFallback: true})
+	price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if price.Cmp(big.NewInt(params.GWei)) != 0 {
+		t.Errorf("suggestion mismatch without samples: have %v, want %v", price, params.GWei)
+	}
+}
+
+func TestSuggestTipCapGasWeighted(t *testing.T) {
+	// Each block holds two transfers tipping 1 gwei and a heavy transaction
+	// tipping 10 gwei, its gas used only known from the receipts
+	backend := newTestBackend(4, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{
+			newTestTx(testSender, 3*number, 1),
+			newTestTx(testSender, 3*number+1, 1),
+			newTestTx(testSender, 3*number+2, 10),
+		}
+	})
+	backend.receipts = make(map[types2.Hash]block.Receipts)
+	for _, b := range backend.blocks {
+		for i, tx := range b.Transactions() {
+			gasUsed := params.TxGas
+			if i == 2 {
+				gasUsed = 2000000
+			}
+			backend.receipts[b.Hash()] = append(backend.receipts[b.Hash()], &block.Receipt{TxHash: tx.Hash(), GasUsed: gasUsed})
+		}
+	}
+	for _, tt := range []struct {
+		weighted bool
+		want     int64
+	}{
+		{false, params.GWei},
+		{true, 10 * params.GWei},
+	} {
+		oracle := newTestOracle(backend, conf.GpoConfig{GasWeighted: tt.weighted})
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("weighted %v: failed to suggest tip cap: %v", tt.weighted, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("weighted %v: suggestion mismatch: have %v, want %v", tt.weighted, price, tt.want)
+		}
+	}
+}
+
+func TestSuggestTipCapsDelegation(t *testing.T) {
+	// Each block holds two transfers tipping 1 gwei and a heavy transaction
+	// tipping 10 gwei
+	backend := newTestBackend(4, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{
+			newTestTx(testSender, 3*number, 1),
+			newTestTx(testSender, 3*number+1, 1),
+			newTestTx(testSender, 3*number+2, 10),
+		}
+	})
+	backend.receipts = make(map[types2.Hash]block.Receipts)
+	for _, b := range backend.blocks {
+		for i, tx := range b.Transactions() {
+			gasUsed := params.TxGas
+			if i == 2 {
+				gasUsed = 2000000
+			}
+			backend.receipts[b.Hash()] = append(backend.receipts[b.Hash()], &block.Receipt{TxHash: tx.Hash(), GasUsed: gasUsed})
+		}
+	}
+	oracle := newTestOracle(backend, conf.GpoConfig{GasWeighted: true, Percentile: 50})
+	price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	// The suggestions at other percentiles are weighted by gas just the same
+	prices, err := oracle.SuggestTipCaps(context.Background(), []int{0, 50, 100})
+	if err != nil {
+		t.Fatalf("failed to suggest tip caps: %v", err)
+	}
+	for i, want := range []int64{params.GWei, 10 * params.GWei, 10 * params.GWei} {
+		if prices[i].Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("suggestion %d mismatch: have %v, want %v", i, prices[i], want)
+		}
+	}
+	if price.Cmp(prices[1]) != 0 {
+		t.Errorf("tip cap differs from the one at its percentile: have %v, want %v", price, prices[1])
+	}
+	// A source other than the local sampling answers all the percentiles
+	oracle.SetExternalEstimator(&testEstimator{price: big.NewInt(20 * params.GWei)}, 50*time.Millisecond)
+	if prices, err = oracle.SuggestTipCaps(context.Background(), []int{0, 100}); err != nil {
+		t.Fatalf("failed to suggest tip caps: %v", err)
+	}
+	for i, price := range prices {
+		if price.Cmp(big.NewInt(20*params.GWei)) != 0 {
+			t.Errorf("estimated suggestion %d mismatch: have %v, want %v", i, price, 20*params.GWei)
+		}
+	}
+}
+
+func TestSuggestTipCapBlockValuesCache(t *testing.T) {
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 5)}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{})
+	if _, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig); err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	// Tamper with the cached values, which the next sampling must reuse
+	var cached int
+	for _, key := range oracle.historyCache.(*localCache).Keys() {
+		if key, ok := key.(blockValuesKey); ok {
+			oracle.historyCache.Add(key, results{values: []*big.Int{big.NewInt(9 * params.GWei)}, senders: []types2.Address{testSender}, gas: []uint64{params.TxGas}, hash: key.hash})
+			cached++
+		}
+	}
+	if cached != 2 {
+		t.Fatalf("cached blocks mismatch: have %d, want 2", cached)
+	}
+	oracle.Invalidate()
+	price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if price.Cmp(big.NewInt(9*params.GWei)) != 0 {
+		t.Errorf("cached suggestion mismatch: have %v, want %v", price, 9*params.GWei)
+	}
+	// Replacing the blacklist samples the blocks again
+	oracle.SetBlacklist(nil)
+	price, err = oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if price.Cmp(big.NewInt(5*params.GWei)) != 0 {
+		t.Errorf("resampled suggestion mismatch: have %v, want %v", price, 5*params.GWei)
+	}
+}
+
+// sharedCache is a SuggestionCache standing for one shared by several oracles.
+type sharedCache struct {
+	lock        sync.Mutex
+	entries     map[interface{}]interface{}
+	suggestions map[bool]CachedSuggestion
+}
+
+func newSharedCache() *sharedCache {
+	return &sharedCache{entries: make(map[interface{}]interface{}), suggestions: make(map[bool]CachedSuggestion)}
+}
+
+func (c *sharedCache) Get(key interface{}) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	value, ok := c.entries[key]
+	return value, ok
+}
+
+func (c *sharedCache) Add(key, value interface{}) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[key] = value
+	return false
+}
+
+func (c *sharedCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+func (c *sharedCache) LastSuggestion(gasPrice bool) (CachedSuggestion, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	suggestion, ok := c.suggestions[gasPrice]
+	return suggestion, ok
+}
+
+func (c *sharedCache) StoreSuggestion(gasPrice bool, suggestion CachedSuggestion) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.suggestions[gasPrice] = suggestion
+}
+
+func TestSuggestTipCapSharedCache(t *testing.T) {
+	backend := newTestBackend(3, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 5)}
+	})
+	cache := newSharedCache()
+	first, second := newTestOracle(backend, conf.GpoConfig{}), newTestOracle(backend, conf.GpoConfig{})
+	first.SetCache(cache)
+	second.SetCache(cache)
+
+	if _, err := first.SuggestTipCap(context.Background(), params.TestChainConfig); err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("shared history entries mismatch: have %d, want 2", cache.Len())
+	}
+	// Tamper with the shared suggestion to tell whether the second oracle serves
+	// it rather than sampling the blocks again
+	suggestion, ok := cache.LastSuggestion(false)
+	if !ok {
+		t.Fatalf("tip cap suggestion not shared")
+	}
+	suggestion.Price = big.NewInt(7 * params.GWei)
+	cache.StoreSuggestion(false, suggestion)
+
+	price, err := second.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if price.Cmp(big.NewInt(7*params.GWei)) != 0 {
+		t.Errorf("shared suggestion mismatch: have %v, want %v", price, 7*params.GWei)
+	}
+	// Restoring the in-process cache keeps the adopted suggestion
+	second.SetCache(nil)
+	if price, _ := second.SuggestTipCap(context.Background(), params.TestChainConfig); price.Cmp(big.NewInt(7*params.GWei)) != 0 {
+		t.Errorf("local suggestion mismatch: have %v, want %v", price, 7*params.GWei)
+	}
+}
+
+func TestSetCachePurgedOnReorg(t *testing.T) {
+	backend := newTestBackend(3, nil)
+	oracle := newTestOracle(backend, conf.GpoConfig{})
+	installed := newLocalCache(historyCacheSize)
+	oracle.SetCache(installed)
+	installed.Add("entry", struct{}{})
+
+	// The cache installed after the oracle's creation is purged too
+	event.GlobalEvent.Send(&common2.ChainHighestBlock{Block: *backend.CurrentBlock().(*block.Block)})
+	for deadline := time.Now().Add(time.Second); installed.Len() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("installed cache not purged on reorg: %d entries left", installed.Len())
+		}
+	}
+}
+
+func TestSharedCacheSamplingSettings(t *testing.T) {
+	backend := newTestBackend(3, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 1), newTestTx(testRecipient, number, 5)}
+	})
+	cache := newSharedCache()
+	strict := newTestOracle(backend, conf.GpoConfig{IgnorePrice: big.NewInt(2 * params.GWei)})
+	lenient := newTestOracle(backend, conf.GpoConfig{})
+	strict.SetCache(cache)
+	lenient.SetCache(cache)
+
+	// The lowest sampled tip tells which transactions each oracle sampled
+	for i, tt := range []struct {
+		oracle *Oracle
+		want   int64
+	}{
+		{strict, 5 * params.GWei},
+		{lenient, params.GWei},
+	} {
+		prices, err := tt.oracle.SuggestTipCapsAt(context.Background(), params.TestChainConfig, []int{0})
+		if err != nil {
+			t.Fatalf("test %d: failed to suggest tip caps: %v", i, err)
+		}
+		if prices[0].Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("test %d: lowest tip mismatch: have %v, want %v", i, prices[0], tt.want)
+		}
+	}
+}
+
+func TestSuggest1559(t *testing.T) {
+	backend := newTestBackendWithBaseFee(5, uint256.NewInt(10*params.GWei), func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 3)}
+	})
+	london := *params.TestChainConfig
+	london.LondonBlock = big.NewInt(0)
+
+	for _, tt := range []struct {
+		multiplier float64
+		maxFee     int64
+	}{
+		{0, 23 * params.GWei}, // Default multiplier of 2
+		{1.5, 18 * params.GWei},
+		{0.5, 23 * params.GWei}, // Sanitized to the default
+	} {
+		oracle := NewOracle(backend, nil, &london, conf.GpoConfig{Blocks: 2, Percentile: 60, Default: big.NewInt(params.GWei), BaseFeeMultiplier: tt.multiplier})
+		fees, err := oracle.Suggest1559(context.Background(), &london)
+		if err != nil {
+			t.Fatalf("multiplier %v: failed to suggest fees: %v", tt.multiplier, err)
+		}
+		if fees.MaxPriorityFeePerGas.Cmp(big.NewInt(3*params.GWei)) != 0 {
+			t.Errorf("multiplier %v: max priority fee mismatch: have %v, want %v", tt.multiplier, fees.MaxPriorityFeePerGas, 3*params.GWei)
+		}
+		if fees.MaxFeePerGas.Cmp(big.NewInt(tt.maxFee)) != 0 {
+			t.Errorf("multiplier %v: max fee mismatch: have %v, want %v", tt.multiplier, fees.MaxFeePerGas, tt.maxFee)
+		}
+	}
+	// Before London, there are no dynamic fee transactions to suggest for
+	oracle := newTestOracle(backend, conf.GpoConfig{})
+	if _, err := oracle.Suggest1559(context.Background(), params.TestChainConfig); !errors.Is(err, errNotLondon) {
+		t.Errorf("pre-London error mismatch: have %v, want %v", err, errNotLondon)
+	}
+	// Without a chain config, there is no fork to tell
+	if _, err := oracle.Suggest1559(context.Background(), nil); !errors.Is(err, errNoChainConfig) {
+		t.Errorf("nil chain config error mismatch: have %v, want %v", err, errNoChainConfig)
+	}
+}
+
+func TestSuggestTipCapMinSuggestedTip(t *testing.T) {
+	empty := newTestBackend(5, nil)
+	busy := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 5)}
+	})
+	for i, tt := range []struct {
+		backend *testBackend
+		config  conf.GpoConfig
+		want    int64
+	}{
+		{empty, conf.GpoConfig{MinSuggestedTip: big.NewInt(3 * params.GWei)}, 3 * params.GWei},
+		{busy, conf.GpoConfig{MinSuggestedTip: big.NewInt(3 * params.GWei)}, 5 * params.GWei},
+		{empty, conf.GpoConfig{MinSuggestedTip: big.NewInt(-1)}, params.GWei}, // Sanitized to no floor
+		{empty, conf.GpoConfig{MinSuggestedTip: big.NewInt(9 * params.GWei), MaxPrice: big.NewInt(4 * params.GWei)}, 4 * params.GWei},
+	} {
+		oracle := newTestOracle(tt.backend, tt.config)
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("test %d: failed to suggest tip cap: %v", i, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("test %d: suggestion mismatch: have %v, want %v", i, price, tt.want)
+		}
+	}
+}
+
+func TestMinSuggestedTipAllSuggestions(t *testing.T) {
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 1)}
+	})
+	var (
+		ctx    = context.Background()
+		floor  = big.NewInt(3 * params.GWei)
+		oracle = newTestOracle(backend, conf.GpoConfig{MinSuggestedTip: floor})
+	)
+	prices, err := oracle.SuggestTipCapsAt(ctx, params.TestChainConfig, []int{10, 90})
+	if err != nil {
+		t.Fatalf("failed to suggest tip caps: %v", err)
+	}
+	series, err := oracle.SuggestSeries(ctx, params.TestChainConfig, 2, 4)
+	if err != nil {
+		t.Fatalf("failed to compute series: %v", err)
+	}
+	position, err := oracle.SuggestTipForBlockPosition(ctx, params.TestChainConfig, 0.5)
+	if err != nil {
+		t.Fatalf("failed to suggest tip for block position: %v", err)
+	}
+	target, err := oracle.SuggestTipCapForTarget(ctx, params.TestChainConfig, testRecipient)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap for target: %v", err)
+	}
+	// The sampled tips of 1 gwei are all raised to the floor
+	for i, price := range append(append(prices, series...), position, target) {
+		if price.Cmp(floor) != 0 {
+			t.Errorf("suggestion %d mismatch: have %v, want %v", i, price, floor)
+		}
+	}
+}
+
+func TestSuggestTipCapTrace(t *testing.T) {
+	// The head is empty, its parent tips 2 and 6 gwei
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		if number != 3 {
+			return nil
+		}
+		return []*transaction.Transaction{newTestTx(testSender, 0, 2), newTestTx(testSender, 1, 6)}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{Blocks: 1, MaxPrice: big.NewInt(params.GWei * 3 / 2)})
+	if _, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig); err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if trace := oracle.LastTrace(); trace != nil {
+		t.Fatalf("suggestion traced while disabled: %+v", trace)
+	}
+	oracle.SetTracing(true)
+	oracle.Invalidate()
+	price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	trace := oracle.LastTrace()
+	if trace == nil {
+		t.Fatal("suggestion not traced")
+	}
+	sameValues := func(have []*big.Int, want ...int64) bool {
+		if len(have) != len(want) {
+			return false
+		}
+		for i := range have {
+			if have[i].Cmp(big.NewInt(want[i])) != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	// The empty head contributes the last price and extends the sampling to
+	// its parent
+	if len(trace.Blocks) != 2 {
+		t.Fatalf("traced blocks mismatch: have %d, want 2", len(trace.Blocks))
+	}
+	if head := trace.Blocks[0]; head.Number != 4 || head.Hash != backend.blocks[4].Hash() || !head.Fallback || !head.Extended || !sameValues(head.Values, params.GWei*3/2) {
+		t.Errorf("traced head mismatch: have %+v", head)
+	}
+	if parent := trace.Blocks[1]; parent.Number != 3 || parent.Fallback || parent.Extended || !sameValues(parent.Values, 2*params.GWei, 6*params.GWei) {
+		t.Errorf("traced parent mismatch: have %+v", parent)
+	}
+	// The 60th percentile of the three values is the second one, capped
+	if trace.Percentile != 60 || trace.Index != 1 || !sameValues(trace.Values, params.GWei*3/2, 2*params.GWei, 6*params.GWei) {
+		t.Errorf("traced selection mismatch: have index %d of %v at percentile %d, want index 1", trace.Index, trace.Values, trace.Percentile)
+	}
+	if len(trace.Adjustments) != 1 {
+		t.Fatalf("traced adjustments mismatch: have %+v, want the price cap only", trace.Adjustments)
+	}
+	if adjustment := trace.Adjustments[0]; adjustment.Reason != "max price" || !sameValues([]*big.Int{adjustment.From, adjustment.To}, 2*params.GWei, params.GWei*3/2) {
+		t.Errorf("traced adjustment mismatch: have %+v", adjustment)
+	}
+	if trace.Price.Cmp(price) != 0 || trace.Head != backend.CurrentBlock().Hash() {
+		t.Errorf("traced suggestion mismatch: have %v at %x, want %v at %x", trace.Price, trace.Head, price, backend.CurrentBlock().Hash())
+	}
+}
+
+func TestSuggestTipCapExcludedSenders(t *testing.T) {
+	// A fee recipient distinct from the coinbase tips 1 gwei in every block
+	feeRecipient := types2.HexToAddress("0x7000000000000000000000000000000000000007")
+	backend := newTestBackend(4, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{
+			newTestTx(feeRecipient, 2*number, 1),
+			newTestTx(feeRecipient, 2*number+1, 1),
+			newTestTx(testSender, number, 8),
+		}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{Percentile: 50})
+	suggest := func(want int64) {
+		t.Helper()
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("failed to suggest tip cap: %v", err)
+		}
+		if price.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("suggestion mismatch: have %v, want %v", price, want)
+		}
+	}
+	suggest(params.GWei)
+
+	// Excluding the fee recipient takes effect right away
+	oracle.SetExcludedSenders([]types2.Address{feeRecipient})
+	suggest(8 * params.GWei)
+
+	oracle = newTestOracle(backend, conf.GpoConfig{Percentile: 50, ExcludedSenders: []string{feeRecipient.Hex()}})
+	suggest(8 * params.GWei)
+}
+
+func TestSuggestTipCapPriceChangeEvent(t *testing.T) {
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 5)}
+	})
+	ch := make(chan common2.GasPriceChangeEvent, 1)
+	sub := event.GlobalEvent.Subscribe(ch)
+	defer sub.Unsubscribe()
+
+	suggest := func(oracle *Oracle) {
+		t.Helper()
+		if _, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig); err != nil {
+			t.Fatalf("failed to suggest tip cap: %v", err)
+		}
+	}
+	// Nothing is posted by default
+	suggest(newTestOracle(backend, conf.GpoConfig{}))
+	select {
+	case ev := <-ch:
+		t.Fatalf("event posted while disabled: %+v", ev)
+	default:
+	}
+	// Moving from the 1 gwei default to 5 gwei exceeds the threshold
+	oracle := newTestOracle(backend, conf.GpoConfig{PriceChangeThreshold: 50})
+	suggest(oracle)
+	select {
+	case ev := <-ch:
+		if ev.OldPrice.Cmp(big.NewInt(params.GWei)) != 0 || ev.NewPrice.Cmp(big.NewInt(5*params.GWei)) != 0 {
+			t.Errorf("event prices mismatch: have %v -> %v, want %v -> %v", ev.OldPrice, ev.NewPrice, params.GWei, 5*params.GWei)
+		}
+		if ev.Head != backend.CurrentBlock().Hash() || ev.Samples != 2 {
+			t.Errorf("event sampling mismatch: have %d samples at %x, want 2 at %x", ev.Samples, ev.Head, backend.CurrentBlock().Hash())
+		}
+	default:
+		t.Fatal("no event posted")
+	}
+	// Resampling the same price posts nothing
+	oracle.Invalidate()
+	suggest(oracle)
+	select {
+	case ev := <-ch:
+		t.Fatalf("event posted without a change: %+v", ev)
+	default:
+	}
+}
+
+// slowBackend is a testBackend taking a while to read the blocks, recording the
+// highest number of reads in flight.
+type slowBackend struct {
+	*testBackend
+	lock          sync.Mutex
+	reading, peak int
+}
+
+func (b *slowBackend) GetBlockByNumber(number *uint256.Int) (block.IBlock, error) {
+	b.lock.Lock()
+	b.reading++
+	if b.reading > b.peak {
+		b.peak = b.reading
+	}
+	b.lock.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	b.lock.Lock()
+	b.reading--
+	b.lock.Unlock()
+	return b.testBackend.GetBlockByNumber(number)
+}
+
+func TestSuggestTipCapMaxConcurrentFetches(t *testing.T) {
+	chain := newTestBackend(10, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, number)}
+	})
+	for i, tt := range []struct {
+		fetches, peak int
+	}{
+		{0, 8},
+		{1, 1},
+		{3, 3},
+	} {
+		backend := &slowBackend{testBackend: chain}
+		oracle := NewOracle(backend, nil, params.TestChainConfig, conf.GpoConfig{Blocks: 8, Percentile: 60, Default: big.NewInt(params.GWei), MaxConcurrentFetches: tt.fetches})
+		price, err := oracle.SuggestTipCap(context.Background(), params.TestChainConfig)
+		if err != nil {
+			t.Fatalf("test %d: failed to suggest tip cap: %v", i, err)
+		}
+		// The 60th percentile of the tips 2 to 9 gwei is the fifth one
+		if price.Cmp(big.NewInt(6*params.GWei)) != 0 {
+			t.Errorf("test %d: suggestion mismatch: have %v, want %v", i, price, 6*params.GWei)
+		}
+		if backend.peak > tt.peak || (tt.fetches > 0 && backend.peak != tt.peak) {
+			t.Errorf("test %d: concurrent reads mismatch: have %d, want %d", i, backend.peak, tt.peak)
+		}
+	}
+}
+
+func TestSuggest1559BaseFeeFloor(t *testing.T) {
+	txs := func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 3)}
+	}
+	flat := newTestBackendWithBaseFee(5, uint256.NewInt(10*params.GWei), txs)
+	rising := newTestBackendWithBaseFees(5, func(number uint64) *uint256.Int {
+		return uint256.NewInt(number * 10 * params.GWei)
+	}, txs)
+	london := *params.TestChainConfig
+	london.LondonBlock = big.NewInt(0)
+
+	for i, tt := range []struct {
+		backend *testBackend
+		factor  float64
+		maxFee  int64
+	}{
+		{flat, 0, 13 * params.GWei},
+		{flat, 2, 20 * params.GWei},
+		{rising, 0, 43 * params.GWei},
+		{rising, 2, 50 * params.GWei},  // Twice the average of 10 to 40 gwei
+		{rising, 1, 43 * params.GWei},  // Floor under the suggestion
+		{rising, -1, 43 * params.GWei}, // Sanitized to no floor
+	} {
+		oracle := NewOracle(tt.backend, nil, &london, conf.GpoConfig{Blocks: 4, Percentile: 60, Default: big.NewInt(params.GWei), BaseFeeMultiplier: 1, BaseFeeFloorFactor: tt.factor})
+		fees, err := oracle.Suggest1559(context.Background(), &london)
+		if err != nil {
+			t.Fatalf("test %d: failed to suggest fees: %v", i, err)
+		}
+		if fees.MaxFeePerGas.Cmp(big.NewInt(tt.maxFee)) != 0 {
+			t.Errorf("test %d: max fee mismatch: have %v, want %v", i, fees.MaxFeePerGas, tt.maxFee)
+		}
+	}
+}
+
+func TestSuggestTipCapIncompleteChainConfig(t *testing.T) {
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 10*number)}
+	})
+	// London activates at block 3, but the chain ID and Berlin are missing
+	incomplete := *params.TestChainConfig
+	incomplete.ChainID, incomplete.BerlinBlock, incomplete.LondonBlock = nil, nil, big.NewInt(3)
+
+	for i, tt := range []struct {
+		config *params.ChainConfig
+		want   int64
+	}{
+		{params.TestChainConfig, 20 * params.GWei}, // 10 to 40 gwei sampled
+		{&incomplete, 10 * params.GWei},            // Blocks past the fork skipped, not falling back to the default
+	} {
+		oracle := NewOracle(backend, nil, tt.config, conf.GpoConfig{Blocks: 4, Percentile: 60, Default: big.NewInt(params.GWei)})
+		price, err := oracle.SuggestTipCap(context.Background(), tt.config)
+		if err != nil {
+			t.Fatalf("test %d: failed to suggest tip cap: %v", i, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("test %d: suggestion mismatch: have %v, want %v", i, price, tt.want)
+		}
+	}
+}
+
+func TestSuggestTipCapNilChainConfig(t *testing.T) {
+	if _, err := signerAt(nil, 1); err == nil {
+		t.Error("signer picked without a chain config")
+	}
+	backend := newTestBackend(5, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 10)}
+	})
+	// Every block is skipped, falling back to the default
+	oracle := NewOracle(backend, nil, nil, conf.GpoConfig{Blocks: 4, Percentile: 60, Default: big.NewInt(params.GWei)})
+	price, err := oracle.SuggestTipCap(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("failed to suggest tip cap: %v", err)
+	}
+	if price.Cmp(big.NewInt(params.GWei)) != 0 {
+		t.Errorf("suggestion mismatch: have %v, want %v", price, params.GWei)
+	}
+}
+
+func TestSuggestTipCapIncludeProposerTxs(t *testing.T) {
+	// The coinbase sends two 9 gwei transactions per block, a user one 1 gwei
+	backend := newTestBackend(4, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{
+			newTestTx(testCoinbase, 2*number, 9),
+			newTestTx(testCoinbase, 2*number+1, 9),
+			newTestTx(testSender, number, 1),
+		}
+	})
+	pos := *params.TestChainConfig
+	pos.Consensus = params.CliqueConsensus
+
+	for i, tt := range []struct {
+		config  *params.ChainConfig
+		include bool
+		want    int64
+	}{
+		{params.TestChainConfig, false, params.GWei},
+		{params.TestChainConfig, true, params.GWei}, // Ignored under proof of work
+		{&pos, false, params.GWei},                  // Excluded by default
+		{&pos, true, 9 * params.GWei},
+	} {
+		oracle := NewOracle(backend, nil, tt.config, conf.GpoConfig{Blocks: 2, Percentile: 60, Default: big.NewInt(params.GWei), IncludeProposerTxs: tt.include})
+		price, err := oracle.SuggestTipCap(context.Background(), tt.config)
+		if err != nil {
+			t.Fatalf("test %d: failed to suggest tip cap: %v", i, err)
+		}
+		if price.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("test %d: suggestion mismatch: have %v, want %v", i, price, tt.want)
+		}
+	}
+}
+
+func TestSuggestSeriesCancelledFetch(t *testing.T) {
+	backend := newTestBackend(10, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, number)}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{MaxConcurrentFetches: 1})
+
+	// Hold the only fetch slot so that the series waits for it until cancelled
+	oracle.fetchSlots <- struct{}{}
+	defer func() { <-oracle.fetchSlots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := oracle.SuggestSeries(ctx, params.TestChainConfig, 4, 9)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("series still waiting after the context was cancelled")
+	}
+}
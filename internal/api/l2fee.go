@@ -0,0 +1,59 @@
+package api
+
+import (
+	"context"
+	"github.com/amazechain/amc/params"
+	"math/big"
+)
+
+// L1FeeProvider estimates the fee an L2 transaction pays for publishing its
+// data on L1, such as derived from the L1 base fee and the compressed size of
+// the data, on top of the execution fee set by the sequencer.
+type L1FeeProvider interface {
+	L1DataFee(ctx context.Context, data []byte) (*big.Int, error)
+}
+
+// L2FeeSuggestion is a fee suggestion for an L2 transaction, the execution tip
+// alongside the L1 data fee of the transaction.
+type L2FeeSuggestion struct {
+	TipCap    *big.Int // Suggested execution tip per gas
+	L1DataFee *big.Int // Estimated L1 data fee, zero without L1 fee provider
+	Total     *big.Int // Tip for the whole gas plus the L1 data fee
+}
+
+// SetL1FeeProvider sets the provider of the L1 data fees combined with the tip
+// caps by SuggestL2Fee, nil restoring the L1 behavior.
+func (oracle *Oracle) SetL1FeeProvider(provider L1FeeProvider) {
+	oracle.sourceLock.Lock()
+	oracle.l1Fees = provider
+	oracle.sourceLock.Unlock()
+}
+
+// SuggestL2Fee returns the total fee suggested for a transaction with the
+// given data and gas, combining the tip cap suggested by SuggestTipCap for the
+// execution with the L1 data fee estimated by the L1 fee provider. Without a
+// provider, the suggestion is the one of L1, the tip for the gas alone.
+func (oracle *Oracle) SuggestL2Fee(ctx context.Context, chainConfig *params.ChainConfig, data []byte, gas uint64) (*L2FeeSuggestion, error) {
+	tip, err := oracle.SuggestTipCap(ctx, chainConfig)
+	if err != nil {
+		return nil, err
+	}
+	oracle.sourceLock.RLock()
+	provider := oracle.l1Fees
+	oracle.sourceLock.RUnlock()
+
+	l1Fee := new(big.Int)
+	if provider != nil {
+		fee, err := provider.L1DataFee(ctx, data)
+		if err != nil {
+			return nil, err
+		}
+		l1Fee.Set(fee)
+	}
+	total := new(big.Int).Mul(tip, new(big.Int).SetUint64(gas))
+	return &L2FeeSuggestion{
+		TipCap:    tip,
+		L1DataFee: l1Fee,
+		Total:     total.Add(total, l1Fee),
+	}, nil
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/amazechain/amc/common/transaction"
+	"github.com/amazechain/amc/conf"
+	"github.com/amazechain/amc/params"
+	"math/big"
+	"testing"
+)
+
+// testL1FeeProvider charges a fixed L1 fee per byte of data.
+type testL1FeeProvider struct {
+	perByte *big.Int
+	err     error
+}
+
+func (p *testL1FeeProvider) L1DataFee(ctx context.Context, data []byte) (*big.Int, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return new(big.Int).Mul(p.perByte, big.NewInt(int64(len(data)))), nil
+}
+
+func TestSuggestL2Fee(t *testing.T) {
+	backend := newTestBackend(3, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 5)}
+	})
+	oracle := newTestOracle(backend, conf.GpoConfig{})
+	data := make([]byte, 100)
+
+	// Without provider the suggestion is the tip for the gas
+	fee, err := oracle.SuggestL2Fee(context.Background(), params.TestChainConfig, data, params.TxGas)
+	if err != nil {
+		t.Fatalf("failed to suggest L2 fee: %v", err)
+	}
+	tip := big.NewInt(5 * params.GWei)
+	want := new(big.Int).Mul(tip, big.NewInt(int64(params.TxGas)))
+	if fee.TipCap.Cmp(tip) != 0 || fee.L1DataFee.Sign() != 0 || fee.Total.Cmp(want) != 0 {
+		t.Errorf("L1 suggestion mismatch: have %v/%v/%v, want %v/0/%v", fee.TipCap, fee.L1DataFee, fee.Total, tip, want)
+	}
+	// The L1 data fee adds up to the execution one
+	oracle.SetL1FeeProvider(&testL1FeeProvider{perByte: big.NewInt(params.GWei)})
+	if fee, err = oracle.SuggestL2Fee(context.Background(), params.TestChainConfig, data, params.TxGas); err != nil {
+		t.Fatalf("failed to suggest L2 fee: %v", err)
+	}
+	l1Fee := big.NewInt(100 * params.GWei)
+	if fee.L1DataFee.Cmp(l1Fee) != 0 {
+		t.Errorf("L1 data fee mismatch: have %v, want %v", fee.L1DataFee, l1Fee)
+	}
+	if want := new(big.Int).Add(want, l1Fee); fee.Total.Cmp(want) != 0 {
+		t.Errorf("total fee mismatch: have %v, want %v", fee.Total, want)
+	}
+	// Failing estimations of the L1 data fee are reported
+	failure := errors.New("l1 unavailable")
+	oracle.SetL1FeeProvider(&testL1FeeProvider{err: failure})
+	if _, err := oracle.SuggestL2Fee(context.Background(), params.TestChainConfig, data, params.TxGas); !errors.Is(err, failure) {
+		t.Errorf("error mismatch: have %v, want %v", err, failure)
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"container/heap"
+	"context"
+	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/common/transaction"
+	"github.com/amazechain/amc/internal/consensus/misc"
+	"github.com/amazechain/amc/params"
+	"github.com/holiman/uint256"
+	"math/big"
+)
+
+// SuggestTipFromMempool returns the lowest effective tip among the pending
+// transactions the miner would pack into the next block, filling its gas limit
+// by descending tip while keeping the nonce order of each sender. If they don't
+// fill the block, or no mempool is set, the mempool says nothing about the
+// competition for inclusion and the tip cap sampled from the recent blocks is
+// returned instead.
+func (oracle *Oracle) SuggestTipFromMempool(ctx context.Context) (*big.Int, error) {
+	current := oracle.currentBlock(oracle.chainConfig)
+	if oracle.pool == nil || current == nil || current.Header() == nil {
+		return oracle.SuggestTipCap(ctx, oracle.chainConfig)
+	}
+	var baseFee *uint256.Int
+	if header, ok := current.Header().(*block.Header); ok && oracle.chainConfig.IsLondon(header.Number.Uint64()+1) {
+		baseFee, _ = uint256.FromBig(misc.CalcBaseFee(oracle.chainConfig, header))
+	}
+	var queue tipQueue
+	for _, txs := range oracle.pool.Pending(true) {
+		queue.push(txs, baseFee)
+	}
+	heap.Init(&queue)
+
+	var (
+		gasLimit = current.GasLimit()
+		gasUsed  uint64
+		lowest   *uint256.Int
+	)
+	for queue.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		next := queue[0]
+		// Like the miner, give up on the sender whose next transaction doesn't
+		// fit, its later ones can't be included before it.
+		if tx := next.txs[0]; tx.Gas() <= gasLimit-gasUsed {
+			gasUsed += tx.Gas()
+			if lowest == nil || next.tip.Cmp(lowest) < 0 {
+				lowest = next.tip
+			}
+			if next.shift(baseFee) {
+				heap.Fix(&queue, 0)
+				continue
+			}
+		}
+		heap.Pop(&queue)
+	}
+	if lowest == nil || gasLimit-gasUsed >= params.TxGas {
+		return oracle.SuggestTipCap(ctx, oracle.chainConfig)
+	}
+	tip := lowest.ToBig()
+	if tip.Cmp(oracle.minTip) < 0 {
+		tip = oracle.minTip
+	}
+	return oracle.withSafety(tip, oracle.maxPrice), nil
+}
+
+// senderTxs holds the pending transactions of a sender not packed yet, in
+// nonce order, along with the effective tip of the first one.
+type senderTxs struct {
+	txs []*transaction.Transaction
+	tip *uint256.Int
+}
+
+// shift drops the first transaction, returning whether the next one can be
+// packed at all, i.e. exists and pays a non-negative effective tip.
+func (s *senderTxs) shift(baseFee *uint256.Int) bool {
+	s.txs = s.txs[1:]
+	if len(s.txs) == 0 {
+		return false
+	}
+	tip, err := s.txs[0].EffectiveGasTip(baseFee)
+	if err != nil {
+		return false
+	}
+	s.tip = tip
+	return true
+}
+
+// tipQueue orders the senders by the descending effective tip of their next
+// transaction.
+type tipQueue []*senderTxs
+
+// push adds the transactions of a sender to the queue, unless the first one
+// can't be packed.
+func (q *tipQueue) push(txs []*transaction.Transaction, baseFee *uint256.Int) {
+	if len(txs) == 0 {
+		return
+	}
+	tip, err := txs[0].EffectiveGasTip(baseFee)
+	if err != nil {
+		return
+	}
+	*q = append(*q, &senderTxs{txs: txs, tip: tip})
+}
+
+func (q tipQueue) Len() int           { return len(q) }
+func (q tipQueue) Less(i, j int) bool { return q[i].tip.Cmp(q[j].tip) > 0 }
+func (q tipQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *tipQueue) Push(x interface{}) {
+	*q = append(*q, x.(*senderTxs))
+}
+
+func (q *tipQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	*q = old[:n-1]
+	return x
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/common/transaction"
+	"github.com/amazechain/amc/common/txs_pool"
+	types2 "github.com/amazechain/amc/common/types"
+	"github.com/amazechain/amc/conf"
+	"github.com/amazechain/amc/params"
+	"github.com/holiman/uint256"
+	"math/big"
+	"testing"
+)
+
+// testMempool is a mempool serving fixed pending transactions.
+type testMempool struct {
+	txs_pool.ITxsPool
+	pending map[types2.Address][]*transaction.Transaction
+}
+
+func (p *testMempool) Pending(enforceTips bool) map[types2.Address][]*transaction.Transaction {
+	return p.pending
+}
+
+func TestSuggestTipFromMempool(t *testing.T) {
+	// The recent blocks tip 7 gwei, the head only fits three transfers
+	backend := newTestBackend(4, func(number uint64) []*transaction.Transaction {
+		return []*transaction.Transaction{newTestTx(testSender, number, 7)}
+	})
+	head := backend.CurrentBlock()
+	backend.blocks[len(backend.blocks)-1] = block.NewBlock(&block.Header{
+		ParentHash: head.ParentHash(),
+		Coinbase:   testCoinbase,
+		Number:     head.Number64(),
+		Difficulty: uint256.NewInt(0),
+		GasLimit:   3 * params.TxGas,
+		Time:       head.Time(),
+	}, head.Transactions())
+
+	var (
+		first  = types2.HexToAddress("0x4000000000000000000000000000000000000004")
+		second = types2.HexToAddress("0x5000000000000000000000000000000000000005")
+		third  = types2.HexToAddress("0x6000000000000000000000000000000000000006")
+	)
+	for i, tt := range []struct {
+		pending map[types2.Address][]*transaction.Transaction
+		want    int64
+	}{
+		// The 2 gwei transaction is packed last, before the cheaper sender
+		{map[types2.Address][]*transaction.Transaction{
+			first:  {newTestTx(first, 0, 10), newTestTx(first, 1, 2)},
+			second: {newTestTx(second, 0, 5)},
+			third:  {newTestTx(third, 0, 1)},
+		}, 2 * params.GWei},
+		// A later nonce out-tipping the earlier ones is packed last, not lowest
+		{map[types2.Address][]*transaction.Transaction{
+			first:  {newTestTx(first, 0, 3), newTestTx(first, 1, 9)},
+			second: {newTestTx(second, 0, 5)},
+		}, 3 * params.GWei},
+		// A thin mempool falls back to the recent blocks
+		{map[types2.Address][]*transaction.Transaction{
+			second: {newTestTx(second, 0, 5)},
+		}, 7 * params.GWei},
+	} {
+		oracle := newTestOracle(backend, conf.GpoConfig{})
+		oracle.SetTxPool(&testMempool{pending: tt.pending})
+
+		have, err := oracle.SuggestTipFromMempool(context.Background())
+		if err != nil {
+			t.Fatalf("test %d: failed to suggest tip: %v", i, err)
+		}
+		if have.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("test %d: suggestion mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+}
@@ -407,7 +407,7 @@ func (args *TransactionArgs) setFeeDefaults(ctx context.Context, b *API) error {
 		// London not active, set gas price.
 		price, err := b.gpo.SuggestTipCap(ctx, b.chainConfig)
 		if err != nil {
-			return err
+			return rpcGasPriceError(err)
 		}
 		args.GasPrice = (*hexutil.Big)(price)
 	}
@@ -420,7 +420,7 @@ func (args *TransactionArgs) setLondonFeeDefaults(ctx context.Context, head *blo
 	if args.MaxPriorityFeePerGas == nil {
 		tip, err := b.gpo.SuggestTipCap(ctx, b.chainConfig)
 		if err != nil {
-			return err
+			return rpcGasPriceError(err)
 		}
 		args.MaxPriorityFeePerGas = (*hexutil.Big)(tip)
 	}
@@ -307,7 +307,9 @@ func NewNode(ctx context.Context, cfg *conf.Config) (*Node, error) {
 	log.Info("")
 
 	node.api = api.NewAPI(pubsubServer, s, peers, bc, chainKv, engine, pool, downloader, node.AccountManager(), cfg.GenesisBlockCfg.Config)
-	node.api.SetGpo(api.NewOracle(bc, miner, cfg.GenesisBlockCfg.Config, gpoParams))
+	oracle := api.NewOracle(bc, miner, cfg.GenesisBlockCfg.Config, gpoParams)
+	oracle.SetTxPool(pool)
+	node.api.SetGpo(oracle)
 	return &node, nil
 }
 
@@ -29,6 +29,7 @@ import (
 	"github.com/amazechain/amc/internal/kv"
 	"github.com/amazechain/amc/log"
 	"github.com/amazechain/amc/utils"
+	"github.com/torquem-ch/mdbx-go/mdbx"
 )
 
 // GetAccount get account
@@ -63,6 +64,43 @@ func StoreAccount(db db.IDatabase, changeDB kv.RwDB, blockNr types.Int256, addr
 	return w.Put(addr.Bytes(), data)
 }
 
+// ForEachAccount calls cb with the latest encoding of every stored account, in
+// address order, until it returns false.
+func ForEachAccount(db db.IDatabase, cb func(addr types.Address, data []byte) bool) error {
+	r, err := db.OpenReader(accountsDB)
+	if err != nil {
+		return err
+	}
+	it, err := r.GetIterator(nil)
+	if err != nil {
+		if mdbx.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	defer it.Close()
+
+	for {
+		key, err := it.Key()
+		if err != nil {
+			return err
+		}
+		value, err := it.Value()
+		if err != nil {
+			return err
+		}
+		if !cb(types.BytesToAddress(key), value) {
+			return nil
+		}
+		if err := it.Next(); err != nil {
+			if mdbx.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
 // writeIndex
 func writeIndexAndChangeSet(changeDB kv.RwDB, blockNr types.Int256, addr types.Address, data []byte) error {
 	txn, err := changeDB.BeginRw(context.Background())
@@ -0,0 +1,125 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"bytes"
+	"github.com/amazechain/amc/common/transaction"
+	"github.com/amazechain/amc/common/types"
+	"sort"
+)
+
+// accessUsage records the accounts and storage slots a transaction checks
+// against its access list, the actual accesses the declared list is compared
+// with.
+type accessUsage struct {
+	accessed map[types.Address]map[types.Hash]struct{}
+	warm     map[types.Address]struct{} // Accounts warm regardless of the declared list
+}
+
+func newAccessUsage() *accessUsage {
+	return &accessUsage{
+		accessed: make(map[types.Address]map[types.Hash]struct{}),
+		warm:     make(map[types.Address]struct{}),
+	}
+}
+
+// SetAccessRecording enables or disables the recording of the accounts and
+// storage slots accessed by the transactions, as checked against their access
+// list by the EVM, which AccessListMatches compares the declared lists with.
+// The record starts over with every PrepareAccessList.
+func (s *StateDB) SetAccessRecording(enabled bool) {
+	if enabled {
+		s.accessUsage = newAccessUsage()
+	} else {
+		s.accessUsage = nil
+	}
+}
+
+// recordAccess records the access to the account, and to its storage slot if
+// not nil, if the recording is enabled. The accesses within reverted calls are
+// kept, as they benefit from the declared list all the same.
+func (s *StateDB) recordAccess(addr types.Address, slot *types.Hash) {
+	if s.accessUsage == nil {
+		return
+	}
+	slots, ok := s.accessUsage.accessed[addr]
+	if !ok {
+		slots = make(map[types.Hash]struct{})
+		s.accessUsage.accessed[addr] = slots
+	}
+	if slot != nil {
+		slots[*slot] = struct{}{}
+	}
+}
+
+// AccessListMatches compares the declared access list of the transaction just
+// executed with its recorded accesses, see SetAccessRecording. Extra holds the
+// declared accounts and slots never accessed, in declaration order, an account
+// only listed along with its unused slots if it was accessed itself. Missing
+// holds the accessed accounts and slots left out of the declared list, in
+// ascending address and key order, the sender, recipient and precompiles being
+// warm anyway. Both are empty if the declared list matches, or if the accesses
+// aren't recorded.
+func (s *StateDB) AccessListMatches(declared transaction.AccessList) (extra, missing transaction.AccessList) {
+	if s.accessUsage == nil {
+		return nil, nil
+	}
+	accessed := s.accessUsage.accessed
+
+	listed := make(map[types.Address]map[types.Hash]struct{}, len(declared))
+	for _, tuple := range declared {
+		keys, ok := listed[tuple.Address]
+		if !ok {
+			keys = make(map[types.Hash]struct{}, len(tuple.StorageKeys))
+			listed[tuple.Address] = keys
+		}
+		slots, used := accessed[tuple.Address]
+		var unused []types.Hash
+		for _, key := range tuple.StorageKeys {
+			keys[key] = struct{}{}
+			if _, ok := slots[key]; !ok {
+				unused = append(unused, key)
+			}
+		}
+		if !used || len(unused) > 0 {
+			extra = append(extra, transaction.AccessTuple{Address: tuple.Address, StorageKeys: unused})
+		}
+	}
+	for addr, slots := range accessed {
+		keys, ok := listed[addr]
+		if _, warm := s.accessUsage.warm[addr]; warm {
+			ok = true
+		}
+		var unlisted []types.Hash
+		for key := range slots {
+			if _, ok := keys[key]; !ok {
+				unlisted = append(unlisted, key)
+			}
+		}
+		if !ok || len(unlisted) > 0 {
+			sort.Slice(unlisted, func(i, j int) bool {
+				return bytes.Compare(unlisted[i][:], unlisted[j][:]) < 0
+			})
+			missing = append(missing, transaction.AccessTuple{Address: addr, StorageKeys: unlisted})
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return bytes.Compare(missing[i].Address[:], missing[j].Address[:]) < 0
+	})
+	return extra, missing
+}
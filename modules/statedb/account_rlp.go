@@ -0,0 +1,65 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"fmt"
+	"github.com/amazechain/amc/api/protocol/state"
+	"github.com/amazechain/amc/common/types"
+	"github.com/amazechain/amc/internal/avm/rlp"
+	"github.com/gogo/protobuf/proto"
+	"math/big"
+)
+
+// rlpAccount is the consensus encoding of an account, as stored in the trie.
+type rlpAccount struct {
+	Nonce    uint64
+	Balance  *big.Int
+	Root     types.Hash
+	CodeHash []byte
+}
+
+// AccountRLP returns the RLP encoding of the committed account, that is
+// without the changes pending in the StateDB, as a list of its nonce, balance,
+// storage root and code hash. It fails if the account doesn't exist.
+func (s *StateDB) AccountRLP(addr types.Address) ([]byte, error) {
+	v, err := s.store.ReadAccount(s.blockNr, addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w %v", errAccountNotFound, addr)
+	}
+	var account state.Account
+	if err := proto.Unmarshal(v, &account); err != nil {
+		return nil, fmt.Errorf("%w %v: %v", errCorruptAccount, addr, err)
+	}
+	if account.Suicided {
+		return nil, fmt.Errorf("%w %v", errAccountNotFound, addr)
+	}
+	enc := rlpAccount{
+		Nonce:    account.Nonce,
+		Balance:  account.Balance.ToBig(),
+		Root:     account.Root,
+		CodeHash: account.CodeHash,
+	}
+	// Fill in the defaults of newObject for the fields never set
+	if enc.Root == (types.Hash{}) {
+		enc.Root = emptyRoot
+	}
+	if enc.CodeHash == nil {
+		enc.CodeHash = emptyCodeHash
+	}
+	return rlp.EncodeToBytes(&enc)
+}
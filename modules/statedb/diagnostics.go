@@ -0,0 +1,192 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/amazechain/amc/common/types"
+	"sort"
+)
+
+// HotSlot is a storage slot along with the number of times it was written
+// within the current transaction.
+type HotSlot struct {
+	Address types.Address
+	Key     types.Hash
+	Writes  int
+}
+
+// SetSlotWriteTracking enables or disables the counting of storage writes per
+// slot. Counters are reset at every Prepare.
+func (s *StateDB) SetSlotWriteTracking(enabled bool) {
+	if enabled {
+		s.slotWrites = make(map[types.Address]map[types.Hash]int)
+	} else {
+		s.slotWrites = nil
+	}
+}
+
+// countSlotWrite records a journalled storage change if tracking is enabled.
+func (s *StateDB) countSlotWrite(addr types.Address, key types.Hash) {
+	if s.slotWrites == nil {
+		return
+	}
+	slots, ok := s.slotWrites[addr]
+	if !ok {
+		slots = make(map[types.Hash]int)
+		s.slotWrites[addr] = slots
+	}
+	slots[key]++
+}
+
+// HotSlots returns up to n of the most written storage slots of the current
+// transaction, ordered by descending write count. Ties are broken by address
+// and key to keep the result deterministic.
+func (s *StateDB) HotSlots(n int) []HotSlot {
+	var hot []HotSlot
+	for addr, slots := range s.slotWrites {
+		for key, writes := range slots {
+			hot = append(hot, HotSlot{Address: addr, Key: key, Writes: writes})
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		if hot[i].Writes != hot[j].Writes {
+			return hot[i].Writes > hot[j].Writes
+		}
+		if c := bytes.Compare(hot[i].Address[:], hot[j].Address[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(hot[i].Key[:], hot[j].Key[:]) < 0
+	})
+	if n >= 0 && len(hot) > n {
+		hot = hot[:n]
+	}
+	return hot
+}
+
+// AccessOp is the kind of a traced state access.
+type AccessOp uint8
+
+const (
+	BalanceRead AccessOp = iota
+	BalanceWrite
+	NonceRead
+	NonceWrite
+	CodeRead
+	CodeWrite
+	StorageRead
+	StorageWrite
+)
+
+// AccessRecord is a single traced state access. Values are encoded as 32 byte
+// words: balances and nonces big endian, code accesses by their code hash.
+type AccessRecord struct {
+	Op      AccessOp
+	Address types.Address
+	Key     types.Hash // Storage slot, zero for account accesses
+	Value   types.Hash // Value read, or written by the access
+}
+
+// SetAccessTracing enables or disables the tracing of state accesses. The
+// trace is reset at every Prepare.
+func (s *StateDB) SetAccessTracing(enabled bool) {
+	s.tracing = enabled
+	s.accessTrace = nil
+}
+
+// AccessTrace returns the ordered reads and writes of the current transaction.
+func (s *StateDB) AccessTrace() []AccessRecord {
+	return s.accessTrace
+}
+
+func (s *StateDB) traceAccess(op AccessOp, addr types.Address, key, value types.Hash) {
+	s.accessTrace = append(s.accessTrace, AccessRecord{Op: op, Address: addr, Key: key, Value: value})
+}
+
+// JournalHook observes the balance, nonce, code and storage changes as they are
+// journalled, in order, including the ones later reverted but not the reverts
+// themselves. The change is journalled before being applied, so the record
+// carries the value it overwrites. Hooks run on the hot path of the execution
+// and must be cheap.
+type JournalHook func(change AccessRecord)
+
+type registeredHook struct {
+	id   int
+	hook JournalHook
+}
+
+// AddJournalHook registers a hook observing the journalled changes, returning
+// the id to remove it with.
+func (s *StateDB) AddJournalHook(hook JournalHook) int {
+	s.nextHookID++
+	s.journalHooks = append(s.journalHooks, registeredHook{id: s.nextHookID, hook: hook})
+	s.journal.hook = s.journalHook()
+	return s.nextHookID
+}
+
+// RemoveJournalHook unregisters the hook with the given id.
+func (s *StateDB) RemoveJournalHook(id int) {
+	for i, registered := range s.journalHooks {
+		if registered.id == id {
+			s.journalHooks = append(s.journalHooks[:i], s.journalHooks[i+1:]...)
+			break
+		}
+	}
+	s.journal.hook = s.journalHook()
+}
+
+// journalHook returns the journal hook relaying the entries to the registered
+// hooks, nil if there are none.
+func (s *StateDB) journalHook() func(journalEntry) {
+	if len(s.journalHooks) == 0 {
+		return nil
+	}
+	return s.relayJournalEntry
+}
+
+// relayJournalEntry reports the journalled change to the registered hooks, if
+// it is one they observe.
+func (s *StateDB) relayJournalEntry(entry journalEntry) {
+	var change AccessRecord
+	switch ch := entry.(type) {
+	case balanceChange:
+		change = AccessRecord{Op: BalanceWrite, Address: *ch.account, Value: balanceWord(ch.prev)}
+	case nonceChange:
+		change = AccessRecord{Op: NonceWrite, Address: *ch.account, Value: nonceWord(ch.prev)}
+	case codeChange:
+		change = AccessRecord{Op: CodeWrite, Address: *ch.account, Value: types.BytesToHash(ch.prevhash)}
+	case storageChange:
+		change = AccessRecord{Op: StorageWrite, Address: *ch.account, Key: ch.key, Value: ch.prevalue}
+	default:
+		return
+	}
+	for _, registered := range s.journalHooks {
+		registered.hook(change)
+	}
+}
+
+// balanceWord encodes a balance as a traced value.
+func balanceWord(balance types.Int256) types.Hash {
+	return balance.Bytes32()
+}
+
+// nonceWord encodes a nonce as a traced value.
+func nonceWord(nonce uint64) (word types.Hash) {
+	binary.BigEndian.PutUint64(word[types.HashLength-8:], nonce)
+	return word
+}
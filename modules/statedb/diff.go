@@ -0,0 +1,183 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"bytes"
+	"errors"
+	"github.com/amazechain/amc/api/protocol/state"
+	"github.com/amazechain/amc/common/types"
+	"github.com/gogo/protobuf/proto"
+	"sort"
+)
+
+// DiffKind tells how an account differs between two states.
+type DiffKind uint8
+
+const (
+	AccountAdded DiffKind = iota
+	AccountRemoved
+	AccountModified
+)
+
+// AccountState is the committed state of an account, as compared by StateDiff.
+type AccountState struct {
+	Nonce    uint64
+	Balance  types.Int256
+	CodeHash types.Hash
+}
+
+// SlotDiff is a storage slot differing between two states, zero in the state it
+// is unset in.
+type SlotDiff struct {
+	Key  types.Hash
+	From types.Hash
+	To   types.Hash
+}
+
+// AccountDiff is an account differing between two states. From is nil for an
+// added account and To for a removed one.
+type AccountDiff struct {
+	Address types.Address
+	Kind    DiffKind
+	From    *AccountState
+	To      *AccountState
+	Storage []SlotDiff // Differing slots, in key order
+}
+
+// StateDiff returns the differences of the committed accounts and storage from
+// stateA to stateB, in address order. Pending changes are not reflected.
+// Storage errors are memoized in stateA and can be retrieved through Error.
+func StateDiff(stateA, stateB *StateDB) []AccountDiff {
+	var diffs []AccountDiff
+	if err := StreamStateDiff(stateA, stateB, func(diff AccountDiff) bool {
+		diffs = append(diffs, diff)
+		return true
+	}); err != nil && stateA.dbErr == nil {
+		stateA.dbErr = err
+	}
+	return diffs
+}
+
+// StreamStateDiff is StateDiff calling cb with each difference until it returns
+// false, only loading a single account of each state at a time.
+func StreamStateDiff(stateA, stateB *StateDB, cb func(diff AccountDiff) bool) error {
+	addrsA, err := committedAddresses(stateA)
+	if err != nil {
+		return err
+	}
+	addrsB, err := committedAddresses(stateB)
+	if err != nil {
+		return err
+	}
+	for i, j := 0, 0; i < len(addrsA) || j < len(addrsB); {
+		var addr types.Address
+		switch {
+		case j == len(addrsB) || (i < len(addrsA) && bytes.Compare(addrsA[i][:], addrsB[j][:]) < 0):
+			addr, i = addrsA[i], i+1
+		case i == len(addrsA) || bytes.Compare(addrsA[i][:], addrsB[j][:]) > 0:
+			addr, j = addrsB[j], j+1
+		default:
+			addr, i, j = addrsA[i], i+1, j+1
+		}
+		from, fromStorage, err := stateA.committedAccount(addr)
+		if err != nil {
+			return err
+		}
+		to, toStorage, err := stateB.committedAccount(addr)
+		if err != nil {
+			return err
+		}
+		diff, changed := diffAccount(addr, from, to, fromStorage, toStorage)
+		if changed && !cb(diff) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// committedAddresses returns the addresses of the accounts in the store of the
+// state, in ascending order. Some might not exist as of the state's block.
+func committedAddresses(s *StateDB) ([]types.Address, error) {
+	var addrs []types.Address
+	err := s.store.ForEachAccount(func(addr types.Address, data []byte) bool {
+		addrs = append(addrs, addr)
+		return true
+	})
+	return addrs, err
+}
+
+// committedAccount loads the committed account as of the state's block, or nil
+// if it doesn't exist or was destructed.
+func (s *StateDB) committedAccount(addr types.Address) (*AccountState, Storage, error) {
+	v, err := s.store.ReadAccount(s.blockNr, addr)
+	if errors.Is(err, errAccountNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var account state.Account
+	if err := proto.Unmarshal(v, &account); err != nil {
+		return nil, nil, err
+	}
+	if account.Suicided {
+		return nil, nil, nil
+	}
+	codeHash := types.BytesToHash(emptyCodeHash)
+	if len(account.CodeHash) > 0 {
+		codeHash = types.BytesToHash(account.CodeHash)
+	}
+	storage := make(Storage, len(account.State))
+	for _, slot := range account.State {
+		if slot.Value != (types.Hash{}) {
+			storage[slot.Key] = slot.Value
+		}
+	}
+	return &AccountState{Nonce: account.Nonce, Balance: account.Balance, CodeHash: codeHash}, storage, nil
+}
+
+// diffAccount compares the two states of the account, reporting whether they
+// differ at all.
+func diffAccount(addr types.Address, from, to *AccountState, fromStorage, toStorage Storage) (AccountDiff, bool) {
+	diff := AccountDiff{Address: addr, Kind: AccountModified, From: from, To: to}
+	switch {
+	case from == nil && to == nil:
+		return diff, false
+	case from == nil:
+		diff.Kind = AccountAdded
+	case to == nil:
+		diff.Kind = AccountRemoved
+	}
+	for key, value := range fromStorage {
+		if toStorage[key] != value {
+			diff.Storage = append(diff.Storage, SlotDiff{Key: key, From: value, To: toStorage[key]})
+		}
+	}
+	for key, value := range toStorage {
+		if _, ok := fromStorage[key]; !ok {
+			diff.Storage = append(diff.Storage, SlotDiff{Key: key, To: value})
+		}
+	}
+	sort.Slice(diff.Storage, func(i, j int) bool {
+		return bytes.Compare(diff.Storage[i].Key[:], diff.Storage[j].Key[:]) < 0
+	})
+	if diff.Kind == AccountModified && len(diff.Storage) == 0 && from.Nonce == to.Nonce && from.Balance.Equal(to.Balance) && from.CodeHash == to.CodeHash {
+		return diff, false
+	}
+	return diff, true
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/amazechain/amc/api/protocol/state"
+	"github.com/amazechain/amc/common/hexutil"
+	"github.com/amazechain/amc/common/types"
+	"github.com/gogo/protobuf/proto"
+	"sort"
+)
+
+// DumpOptions controls the content of a state dump.
+type DumpOptions struct {
+	IncludeCode    bool // Whether the account code is dumped
+	IncludeStorage bool // Whether the non-empty storage slots are dumped
+
+	Start types.Address // Lowest address to dump, for paginating large states
+	Max   int           // Maximum number of accounts to dump, 0 means unlimited
+}
+
+// DumpAccount is the state of a single account within a dump.
+type DumpAccount struct {
+	Address  types.Address             `json:"address"`
+	Balance  string                    `json:"balance"`
+	Nonce    uint64                    `json:"nonce"`
+	CodeHash types.Hash                `json:"codeHash"`
+	Code     hexutil.Bytes             `json:"code,omitempty"`
+	Storage  map[types.Hash]types.Hash `json:"storage,omitempty"`
+}
+
+// StateDump is a page of accounts sorted by address. Next is the address the
+// following page starts at, if any.
+type StateDump struct {
+	Accounts []DumpAccount  `json:"accounts"`
+	Next     *types.Address `json:"next,omitempty"`
+}
+
+// Dump renders the committed state, overlaid by the pending changes, as JSON.
+// The output is deterministic so that the dumps of two nodes can be diffed.
+func (s *StateDB) Dump(opts DumpOptions) ([]byte, error) {
+	objects := make(map[types.Address]*stateObject)
+	var decodeErr error
+	err := s.store.ForEachAccount(func(addr types.Address, data []byte) bool {
+		if bytes.Compare(addr[:], opts.Start[:]) < 0 {
+			return true
+		}
+		var (
+			account state.Account
+			obj     stateObject
+		)
+		if decodeErr = proto.Unmarshal(data, &account); decodeErr != nil {
+			return false
+		}
+		if decodeErr = obj.FromProtoMessage(s, addr, &account); decodeErr != nil {
+			return false
+		}
+		objects[addr] = &obj
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	for addr, obj := range s.stateObjects {
+		if bytes.Compare(addr[:], opts.Start[:]) >= 0 {
+			objects[addr] = obj
+		}
+	}
+	addrs := make([]types.Address, 0, len(objects))
+	for addr, obj := range objects {
+		if !obj.deleted {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+
+	dump := StateDump{Accounts: make([]DumpAccount, 0, len(addrs))}
+	for i, addr := range addrs {
+		if opts.Max > 0 && i == opts.Max {
+			next := addr
+			dump.Next = &next
+			break
+		}
+		obj := objects[addr]
+		account := DumpAccount{
+			Address:  addr,
+			Balance:  obj.Balance().ToBig().String(),
+			Nonce:    obj.Nonce(),
+			CodeHash: types.BytesToHash(obj.CodeHash()),
+		}
+		if opts.IncludeCode {
+			account.Code = obj.Code(s.db)
+		}
+		if opts.IncludeStorage {
+			storage := obj.dirtyStorage
+			if obj.fakeStorage != nil {
+				storage = obj.fakeStorage
+			}
+			for key, value := range storage {
+				if value == (types.Hash{}) {
+					continue
+				}
+				if account.Storage == nil {
+					account.Storage = make(map[types.Hash]types.Hash)
+				}
+				account.Storage[key] = value
+			}
+		}
+		dump.Accounts = append(dump.Accounts, account)
+	}
+	return json.MarshalIndent(dump, "", "  ")
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"errors"
+	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/common/types"
+	"sync"
+)
+
+var errFrozenState = errors.New("frozen state is read-only")
+
+// frozenStore is the accountStore of a frozen view. It reads through to the
+// store of the live instance, except for the accounts the live instance
+// committed since the freeze, whose encoding as of the freeze is preserved.
+type frozenStore struct {
+	live accountStore
+
+	lock      sync.RWMutex
+	preserved map[types.Address][]byte // Encodings as of the freeze, nil if the account didn't exist
+}
+
+func (s *frozenStore) ReadAccount(blockNr types.Int256, addr types.Address) ([]byte, error) {
+	// The live store is read first: if the account is committed meanwhile,
+	// it gets preserved before being overwritten.
+	data, err := s.live.ReadAccount(blockNr, addr)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if prev, ok := s.preserved[addr]; ok {
+		if prev == nil {
+			return nil, errAccountNotFound
+		}
+		return prev, nil
+	}
+	return data, err
+}
+
+func (s *frozenStore) WriteAccount(blockNr types.Int256, addr types.Address, data []byte) error {
+	return errFrozenState
+}
+
+func (s *frozenStore) ForEachAccount(cb func(addr types.Address, data []byte) bool) error {
+	return s.live.ForEachAccount(func(addr types.Address, data []byte) bool {
+		s.lock.RLock()
+		prev, ok := s.preserved[addr]
+		s.lock.RUnlock()
+
+		if !ok {
+			return cb(addr, data)
+		}
+		if prev == nil {
+			return true
+		}
+		return cb(addr, prev)
+	})
+}
+
+// preserve saves the current encoding of the account before the live instance
+// overwrites it, unless it was already saved.
+func (s *frozenStore) preserve(blockNr types.Int256, addr types.Address) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.preserved[addr]; ok {
+		return
+	}
+	data, err := s.live.ReadAccount(blockNr, addr)
+	if err != nil {
+		data = nil
+	}
+	s.preserved[addr] = data
+}
+
+// Freeze returns a read-only view of the committed state, which stays the same
+// while the live instance keeps committing new changes, and the function to
+// release it once done. The pending changes of the live instance aren't part
+// of the view. Writes to the view fail on commit.
+func (s *StateDB) Freeze() (frozen *StateDB, release func()) {
+	store := &frozenStore{live: s.store, preserved: make(map[types.Address][]byte)}
+
+	s.frozenLock.Lock()
+	if s.frozen == nil {
+		s.frozen = make(map[*frozenStore]struct{})
+	}
+	s.frozen[store] = struct{}{}
+	s.frozenLock.Unlock()
+
+	frozen = &StateDB{
+		db:                s.db,
+		changeDB:          s.changeDB,
+		store:             store,
+		blockNr:           s.blockNr,
+		root:              s.root,
+		stateObjects:      make(map[types.Address]*stateObject),
+		logs:              make(map[types.Hash][]*block.Log),
+		stateObjectsDirty: make(map[types.Address]struct{}),
+		preimages:         make(map[types.Hash][]byte),
+		journal:           newJournal(),
+		accessList:        newAccessList(),
+	}
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			s.frozenLock.Lock()
+			delete(s.frozen, store)
+			s.frozenLock.Unlock()
+		})
+	}
+	return frozen, release
+}
+
+// preserveFrozen preserves the committed encoding of the account in every
+// frozen view before it is overwritten.
+func (s *StateDB) preserveFrozen(addr types.Address) {
+	s.frozenLock.Lock()
+	defer s.frozenLock.Unlock()
+
+	for store := range s.frozen {
+		store.preserve(s.blockNr, addr)
+	}
+}
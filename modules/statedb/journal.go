@@ -17,7 +17,10 @@
 package statedb
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/amazechain/amc/common/types"
+	"sort"
 )
 
 type revision struct {
@@ -41,6 +44,15 @@ type journalEntry interface {
 type journal struct {
 	entries []journalEntry        // Current changes tracked by the journal
 	dirties map[types.Address]int // Dirty accounts and the number of changes
+
+	spill   *journalSpill // On-disk log of the oldest entries, nil if not enabled
+	spilled int           // Number of oldest entries moved to the spill log
+
+	maxEntries int  // Number of entries of a transaction past which the journal overflows, 0 if unlimited
+	txStart    int  // Index of the first entry of the current transaction
+	overflowed bool // Whether the current transaction grew the journal past maxEntries
+
+	hook func(journalEntry) // Called with every appended entry, nil if none
 }
 
 // newJournal creates a new initialized journal.
@@ -56,23 +68,67 @@ func (j *journal) append(entry journalEntry) {
 	if addr := entry.dirtied(); addr != nil {
 		j.dirties[*addr]++
 	}
+	if j.hook != nil {
+		j.hook(entry)
+	}
+	if j.spill != nil && j.spill.threshold > 0 && len(j.entries) > j.spill.threshold {
+		j.spillEntries()
+	}
+	if j.maxEntries > 0 && j.length()-j.txStart > j.maxEntries {
+		j.overflowed = true
+	}
+}
+
+// setMaxEntries bounds the number of entries of a transaction, 0 for unlimited.
+// Entries past the bound are still recorded, to keep the journal revertible,
+// but the journal is flagged as overflowed until the next transaction starts.
+func (j *journal) setMaxEntries(n int) {
+	j.maxEntries = n
+}
+
+// startTx marks the start of a new transaction, whose entries are counted
+// against the bound from now on.
+func (j *journal) startTx() {
+	j.txStart = j.length()
+	j.overflowed = false
+}
+
+// entry returns the i-th entry of the journal, reloading it from the spill log
+// if it was moved there.
+func (j *journal) entry(i int) journalEntry {
+	if i >= j.spilled {
+		return j.entries[i-j.spilled]
+	}
+	entry, err := j.spill.load(i)
+	if err != nil {
+		panic(fmt.Errorf("failed to reload journal entry %d: %v", i, err))
+	}
+	return entry
 }
 
 // revert undoes a batch of journalled modifications along with any reverted
 // dirty handling too.
 func (j *journal) revert(statedb *StateDB, snapshot int) {
-	for i := len(j.entries) - 1; i >= snapshot; i-- {
+	for i := j.length() - 1; i >= snapshot; i-- {
+		entry := j.entry(i)
+
 		// Undo the changes made by the operation
-		j.entries[i].revert(statedb)
+		entry.revert(statedb)
 
 		// Drop any dirty tracking induced by the change
-		if addr := j.entries[i].dirtied(); addr != nil {
+		if addr := entry.dirtied(); addr != nil {
 			if j.dirties[*addr]--; j.dirties[*addr] == 0 {
 				delete(j.dirties, *addr)
 			}
 		}
 	}
-	j.entries = j.entries[:snapshot]
+	if snapshot >= j.spilled {
+		j.entries = j.entries[:snapshot-j.spilled]
+	} else {
+		j.entries = j.entries[:0]
+		j.spill.truncate(snapshot)
+		j.spilled = snapshot
+	}
 }
 
 // dirty explicitly sets an address to dirty, even if the change entries would
@@ -82,9 +138,95 @@ func (j *journal) dirty(addr types.Address) {
 	j.dirties[addr]++
 }
 
+// copy returns an independent copy of the journal for db, a copy of the StateDB
+// it belongs to, so that reverting either leaves the other untouched.
+//
+// The entries are values, and the addresses and hashes they point to are never
+// modified, so they are shared. The reset entries are the exception: reverting
+// them makes the state objects or access list they keep live again, so the copy
+// gets its own, bound to db. The spilled entries are reloaded in memory, the copy
+// having no spill log until one is configured, and the hook isn't carried over.
+func (j *journal) copy(db *StateDB) *journal {
+	entries := make([]journalEntry, 0, j.length())
+	for i := 0; i < j.length(); i++ {
+		entry := j.entry(i)
+		switch ch := entry.(type) {
+		case resetObjectChange:
+			ch.prev = ch.prev.deepCopy(db)
+			entry = ch
+		case resetAccountChange:
+			if ch.prev != nil {
+				ch.prev = ch.prev.deepCopy(db)
+			}
+			entry = ch
+		case accessListPrepareChange:
+			ch.prev = ch.prev.Copy()
+			entry = ch
+		}
+		entries = append(entries, entry)
+	}
+	dirties := make(map[types.Address]int, len(j.dirties))
+	for addr, n := range j.dirties {
+		dirties[addr] = n
+	}
+	return &journal{
+		entries:    entries,
+		dirties:    dirties,
+		maxEntries: j.maxEntries,
+		txStart:    j.txStart,
+		overflowed: j.overflowed,
+	}
+}
+
+// dirtiedSince returns the accounts dirtied by the entries from the given
+// journal index onwards, and the storage slots changed among them, both in
+// ascending order. The journal is left untouched.
+func (j *journal) dirtiedSince(snapshot int) (accounts []types.Address, slots map[types.Address][]types.Hash) {
+	seen := make(map[types.Address]struct{})
+	changed := make(map[types.Address]map[types.Hash]struct{})
+	for i := snapshot; i < j.length(); i++ {
+		entry := j.entry(i)
+		if addr := entry.dirtied(); addr != nil {
+			if _, ok := seen[*addr]; !ok {
+				seen[*addr] = struct{}{}
+				accounts = append(accounts, *addr)
+			}
+		}
+		if ch, ok := entry.(storageChange); ok {
+			if changed[*ch.account] == nil {
+				changed[*ch.account] = make(map[types.Hash]struct{})
+			}
+			changed[*ch.account][ch.key] = struct{}{}
+		}
+	}
+	sort.Slice(accounts, func(i, k int) bool {
+		return bytes.Compare(accounts[i][:], accounts[k][:]) < 0
+	})
+	slots = make(map[types.Address][]types.Hash, len(changed))
+	for addr, keys := range changed {
+		for key := range keys {
+			slots[addr] = append(slots[addr], key)
+		}
+		sort.Slice(slots[addr], func(i, k int) bool {
+			return bytes.Compare(slots[addr][i][:], slots[addr][k][:]) < 0
+		})
+	}
+	return accounts, slots
+}
+
+// lastNonceChange reports whether the newest entry is a nonce change of addr
+// recorded at or after the given journal index.
+func (j *journal) lastNonceChange(addr types.Address, from int) bool {
+	if len(j.entries) == 0 || j.length()-1 < from {
+		return false
+	}
+	ch, ok := j.entries[len(j.entries)-1].(nonceChange)
+	return ok && *ch.account == addr
+}
+
 // length returns the current number of entries in the journal.
 func (j *journal) length() int {
-	return len(j.entries)
+	return j.spilled + len(j.entries)
 }
 
 type (
@@ -96,10 +238,16 @@ type (
 		prev         *stateObject
 		prevdestruct bool
 	}
+	resetAccountChange struct {
+		account     *types.Address
+		prev        *stateObject // Live object before the reset, nil if not loaded
+		prevdirties int          // Pending changes to the account before the reset
+	}
 	suicideChange struct {
 		account     *types.Address
 		prev        bool // whether account had already suicided
 		prevbalance types.Int256
+		retained    bool // whether the account was kept, only its balance being cleared (EIP-6780)
 	}
 
 	// Changes to individual accounts.
@@ -119,6 +267,10 @@ type (
 		account            *types.Address
 		prevcode, prevhash []byte
 	}
+	transientStorageChange struct {
+		account       *types.Address
+		key, prevalue types.Hash
+	}
 
 	// Changes to other state values.
 	refundChange struct {
@@ -141,6 +293,12 @@ type (
 		address *types.Address
 		slot    *types.Hash
 	}
+	// accessListPrepareChange replaces the whole access list at once, as
+	// prepared for a transaction, rather than journalling every address and
+	// slot of the declared list.
+	accessListPrepareChange struct {
+		prev *accessList
+	}
 )
 
 func (ch createObjectChange) revert(s *StateDB) {
@@ -154,19 +312,39 @@ func (ch createObjectChange) dirtied() *types.Address {
 
 func (ch resetObjectChange) revert(s *StateDB) {
 	s.setStateObject(ch.prev)
-	//if !ch.prevdestruct && s.snap != nil {
-	//	delete(s.snapDestructs, ch.prev.addrHash)
-	//}
+	if !ch.prevdestruct && s.snapDestructs != nil {
+		delete(s.snapDestructs, ch.prev.addrHash)
+	}
 }
 
 func (ch resetObjectChange) dirtied() *types.Address {
 	return nil
 }
 
+func (ch resetAccountChange) revert(s *StateDB) {
+	if ch.prev != nil {
+		s.setStateObject(ch.prev)
+	} else {
+		delete(s.stateObjects, *ch.account)
+	}
+	if ch.prevdirties > 0 {
+		s.journal.dirties[*ch.account] = ch.prevdirties
+	}
+	s.markRootStale(*ch.account)
+}
+
+// dirtied returns nil, as the reset restores the dirty count of the account
+// itself rather than adding to it.
+func (ch resetAccountChange) dirtied() *types.Address {
+	return nil
+}
+
 func (ch suicideChange) revert(s *StateDB) {
 	obj := s.getStateObject(*ch.account)
 	if obj != nil {
-		obj.suicided = ch.prev
+		if !ch.retained {
+			obj.suicided = ch.prev
+		}
 		obj.setBalance(ch.prevbalance)
 	}
 }
@@ -184,8 +362,14 @@ func (ch touchChange) dirtied() *types.Address {
 	return ch.account
 }
 
+// revert restores the previous balance. The object might be gone already, such
+// as an account created within the reverted changes and evicted or removed
+// since, in which case there is nothing left to restore. The same goes for the
+// nonce, code and storage changes.
 func (ch balanceChange) revert(s *StateDB) {
-	s.getStateObject(*ch.account).setBalance(ch.prev)
+	if obj := s.getStateObject(*ch.account); obj != nil {
+		obj.setBalance(ch.prev)
+	}
 }
 
 func (ch balanceChange) dirtied() *types.Address {
@@ -193,7 +377,9 @@ func (ch balanceChange) dirtied() *types.Address {
 }
 
 func (ch nonceChange) revert(s *StateDB) {
-	s.getStateObject(*ch.account).setNonce(ch.prev)
+	if obj := s.getStateObject(*ch.account); obj != nil {
+		obj.setNonce(ch.prev)
+	}
 }
 
 func (ch nonceChange) dirtied() *types.Address {
@@ -201,7 +387,9 @@ func (ch nonceChange) dirtied() *types.Address {
 }
 
 func (ch codeChange) revert(s *StateDB) {
-	s.getStateObject(*ch.account).setCode(types.BytesToHash(ch.prevhash), ch.prevcode)
+	if obj := s.getStateObject(*ch.account); obj != nil {
+		obj.setCode(types.BytesToHash(ch.prevhash), ch.prevcode)
+	}
 }
 
 func (ch codeChange) dirtied() *types.Address {
@@ -209,13 +397,23 @@ func (ch codeChange) dirtied() *types.Address {
 }
 
 func (ch storageChange) revert(s *StateDB) {
-	s.getStateObject(*ch.account).setState(ch.key, ch.prevalue)
+	if obj := s.getStateObject(*ch.account); obj != nil {
+		obj.setState(ch.key, ch.prevalue)
+	}
 }
 
 func (ch storageChange) dirtied() *types.Address {
 	return ch.account
 }
 
+func (ch transientStorageChange) revert(s *StateDB) {
+	s.setTransientState(*ch.account, ch.key, ch.prevalue)
+}
+
+func (ch transientStorageChange) dirtied() *types.Address {
+	return nil
+}
+
 func (ch refundChange) revert(s *StateDB) {
 	s.refund = ch.prev
 }
@@ -232,6 +430,7 @@ func (ch addLogChange) revert(s *StateDB) {
 		s.logs[ch.txhash] = logs[:len(logs)-1]
 	}
 	s.logSize--
+	s.receiptsRoot = nil
 }
 
 func (ch addLogChange) dirtied() *types.Address {
@@ -270,3 +469,11 @@ func (ch accessListAddSlotChange) revert(s *StateDB) {
 func (ch accessListAddSlotChange) dirtied() *types.Address {
 	return nil
 }
+
+func (ch accessListPrepareChange) revert(s *StateDB) {
+	s.accessList = ch.prev
+}
+
+func (ch accessListPrepareChange) dirtied() *types.Address {
+	return nil
+}
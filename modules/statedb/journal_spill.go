@@ -0,0 +1,348 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/amazechain/amc/common/types"
+	"github.com/amazechain/amc/log"
+	"io"
+	"os"
+)
+
+// Kinds of the journal entries encoded into a spill log.
+const (
+	spillCreateObject byte = iota
+	spillSuicide
+	spillBalance
+	spillNonce
+	spillStorage
+	spillCode
+	spillRefund
+	spillAddLog
+	spillAddPreimage
+	spillTouch
+	spillAccessListAccount
+	spillAccessListSlot
+	spillTransientStorage
+)
+
+var errUnknownSpillEntry = errors.New("unknown spilled journal entry")
+
+// journalSpill is the temporary on-disk log holding the oldest entries of a
+// journal grown past its in-memory threshold.
+type journalSpill struct {
+	threshold int    // Number of in-memory entries triggering a spill, 0 to stop spilling
+	dir       string // Directory the log is created in
+
+	file    *os.File
+	offsets []int64 // Offset of each spilled entry within the log
+	end     int64   // Offset the next spilled entry is written at
+
+	pinned map[int]journalEntry // Spilled entries that can't be encoded, kept in memory
+}
+
+// setSpill enables or disables the spilling of the journal past the given
+// number of in-memory entries.
+func (j *journal) setSpill(threshold int, dir string) {
+	if j.spill == nil {
+		if threshold <= 0 {
+			return
+		}
+		j.spill = &journalSpill{pinned: make(map[int]journalEntry)}
+	}
+	j.spill.threshold, j.spill.dir = threshold, dir
+}
+
+// spillEntries moves the oldest in-memory entries to the spill log, keeping
+// half the threshold in memory. The newest entry always stays in memory, as it
+// is inspected when journaling nonce changes.
+func (j *journal) spillEntries() {
+	n := len(j.entries) - j.spill.threshold/2
+	if n >= len(j.entries) {
+		n = len(j.entries) - 1
+	}
+	for i := 0; i < n; i++ {
+		if err := j.spill.store(j.spilled, j.entries[i]); err != nil {
+			log.Warn("Failed to spill state journal, keeping it in memory", "err", err)
+			j.spill.threshold = 0
+			n = i
+			break
+		}
+		j.spilled++
+	}
+	kept := copy(j.entries, j.entries[n:])
+	for i := kept; i < len(j.entries); i++ {
+		j.entries[i] = nil
+	}
+	j.entries = j.entries[:kept]
+}
+
+// close removes the spill log of the journal, if any.
+func (j *journal) close() {
+	if j.spill != nil && j.spill.file != nil {
+		j.spill.file.Close()
+		os.Remove(j.spill.file.Name())
+		j.spill.file = nil
+	}
+}
+
+// store appends the entry with the given index to the log.
+func (s *journalSpill) store(index int, entry journalEntry) error {
+	data, ok := encodeJournalEntry(entry)
+	if !ok {
+		s.pinned[index] = entry
+	}
+	if s.file == nil {
+		file, err := os.CreateTemp(s.dir, "statedb-journal-*")
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+	if _, err := s.file.WriteAt(data, s.end); err != nil {
+		delete(s.pinned, index)
+		return err
+	}
+	s.offsets = append(s.offsets, s.end)
+	s.end += int64(len(data))
+	return nil
+}
+
+// load reads back the entry with the given index from the log.
+func (s *journalSpill) load(index int) (journalEntry, error) {
+	if entry, ok := s.pinned[index]; ok {
+		return entry, nil
+	}
+	end := s.end
+	if index+1 < len(s.offsets) {
+		end = s.offsets[index+1]
+	}
+	data := make([]byte, end-s.offsets[index])
+	if _, err := s.file.ReadAt(data, s.offsets[index]); err != nil {
+		return nil, err
+	}
+	return decodeJournalEntry(data)
+}
+
+// truncate drops the entries from the given index onwards from the log.
+func (s *journalSpill) truncate(index int) {
+	if index < len(s.offsets) {
+		s.end = s.offsets[index]
+		s.offsets = s.offsets[:index]
+	}
+	for i := range s.pinned {
+		if i >= index {
+			delete(s.pinned, i)
+		}
+	}
+}
+
+// encodeJournalEntry encodes the entry for the spill log. Entries referencing
+// state objects can't be encoded, in which case an empty record is returned
+// along with false.
+func encodeJournalEntry(entry journalEntry) ([]byte, bool) {
+	var buf bytes.Buffer
+	switch ch := entry.(type) {
+	case createObjectChange:
+		buf.WriteByte(spillCreateObject)
+		buf.Write(ch.account[:])
+	case suicideChange:
+		buf.WriteByte(spillSuicide)
+		buf.Write(ch.account[:])
+		writeSpillBool(&buf, ch.prev)
+		balance := ch.prevbalance.Bytes32()
+		buf.Write(balance[:])
+		writeSpillBool(&buf, ch.retained)
+	case balanceChange:
+		buf.WriteByte(spillBalance)
+		buf.Write(ch.account[:])
+		balance := ch.prev.Bytes32()
+		buf.Write(balance[:])
+	case nonceChange:
+		buf.WriteByte(spillNonce)
+		buf.Write(ch.account[:])
+		binary.Write(&buf, binary.BigEndian, ch.prev)
+	case storageChange:
+		buf.WriteByte(spillStorage)
+		buf.Write(ch.account[:])
+		buf.Write(ch.key[:])
+		buf.Write(ch.prevalue[:])
+	case transientStorageChange:
+		buf.WriteByte(spillTransientStorage)
+		buf.Write(ch.account[:])
+		buf.Write(ch.key[:])
+		buf.Write(ch.prevalue[:])
+	case codeChange:
+		buf.WriteByte(spillCode)
+		buf.Write(ch.account[:])
+		writeSpillBytes(&buf, ch.prevcode)
+		writeSpillBytes(&buf, ch.prevhash)
+	case refundChange:
+		buf.WriteByte(spillRefund)
+		binary.Write(&buf, binary.BigEndian, ch.prev)
+	case addLogChange:
+		buf.WriteByte(spillAddLog)
+		buf.Write(ch.txhash[:])
+	case addPreimageChange:
+		buf.WriteByte(spillAddPreimage)
+		buf.Write(ch.hash[:])
+	case touchChange:
+		buf.WriteByte(spillTouch)
+		buf.Write(ch.account[:])
+	case accessListAddAccountChange:
+		buf.WriteByte(spillAccessListAccount)
+		buf.Write(ch.address[:])
+	case accessListAddSlotChange:
+		buf.WriteByte(spillAccessListSlot)
+		buf.Write(ch.address[:])
+		buf.Write(ch.slot[:])
+	default:
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// decodeJournalEntry decodes an entry encoded by encodeJournalEntry.
+func decodeJournalEntry(data []byte) (journalEntry, error) {
+	r := bytes.NewReader(data)
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		addr types.Address
+		hash types.Hash
+	)
+	switch kind {
+	case spillCreateObject:
+		_, err = io.ReadFull(r, addr[:])
+		return createObjectChange{account: &addr}, err
+	case spillSuicide:
+		ch := suicideChange{account: &addr}
+		if _, err = io.ReadFull(r, addr[:]); err == nil {
+			ch.prev, err = readSpillBool(r)
+		}
+		if err == nil {
+			_, err = io.ReadFull(r, hash[:])
+			ch.prevbalance.SetBytes(hash[:])
+		}
+		if err == nil {
+			ch.retained, err = readSpillBool(r)
+		}
+		return ch, err
+	case spillBalance:
+		ch := balanceChange{account: &addr}
+		if _, err = io.ReadFull(r, addr[:]); err == nil {
+			_, err = io.ReadFull(r, hash[:])
+			ch.prev.SetBytes(hash[:])
+		}
+		return ch, err
+	case spillNonce:
+		ch := nonceChange{account: &addr}
+		if _, err = io.ReadFull(r, addr[:]); err == nil {
+			err = binary.Read(r, binary.BigEndian, &ch.prev)
+		}
+		return ch, err
+	case spillStorage:
+		ch := storageChange{account: &addr}
+		if _, err = io.ReadFull(r, addr[:]); err == nil {
+			_, err = io.ReadFull(r, ch.key[:])
+		}
+		if err == nil {
+			_, err = io.ReadFull(r, ch.prevalue[:])
+		}
+		return ch, err
+	case spillTransientStorage:
+		ch := transientStorageChange{account: &addr}
+		if _, err = io.ReadFull(r, addr[:]); err == nil {
+			_, err = io.ReadFull(r, ch.key[:])
+		}
+		if err == nil {
+			_, err = io.ReadFull(r, ch.prevalue[:])
+		}
+		return ch, err
+	case spillCode:
+		ch := codeChange{account: &addr}
+		if _, err = io.ReadFull(r, addr[:]); err == nil {
+			ch.prevcode, err = readSpillBytes(r)
+		}
+		if err == nil {
+			ch.prevhash, err = readSpillBytes(r)
+		}
+		return ch, err
+	case spillRefund:
+		var ch refundChange
+		err = binary.Read(r, binary.BigEndian, &ch.prev)
+		return ch, err
+	case spillAddLog:
+		_, err = io.ReadFull(r, hash[:])
+		return addLogChange{txhash: hash}, err
+	case spillAddPreimage:
+		_, err = io.ReadFull(r, hash[:])
+		return addPreimageChange{hash: hash}, err
+	case spillTouch:
+		_, err = io.ReadFull(r, addr[:])
+		return touchChange{account: &addr}, err
+	case spillAccessListAccount:
+		_, err = io.ReadFull(r, addr[:])
+		return accessListAddAccountChange{address: &addr}, err
+	case spillAccessListSlot:
+		if _, err = io.ReadFull(r, addr[:]); err == nil {
+			_, err = io.ReadFull(r, hash[:])
+		}
+		return accessListAddSlotChange{address: &addr, slot: &hash}, err
+	}
+	return nil, errUnknownSpillEntry
+}
+
+func writeSpillBool(buf *bytes.Buffer, b bool) {
+	if b {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+}
+
+func readSpillBool(r *bytes.Reader) (bool, error) {
+	b, err := r.ReadByte()
+	return b == 1, err
+}
+
+// writeSpillBytes encodes a byte slice, distinguishing nil from empty ones.
+func writeSpillBytes(buf *bytes.Buffer, b []byte) {
+	writeSpillBool(buf, b != nil)
+	var size [binary.MaxVarintLen64]byte
+	buf.Write(size[:binary.PutUvarint(size[:], uint64(len(b)))])
+	buf.Write(b)
+}
+
+func readSpillBytes(r *bytes.Reader) ([]byte, error) {
+	present, err := readSpillBool(r)
+	if err != nil {
+		return nil, err
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil || !present {
+		return nil, err
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
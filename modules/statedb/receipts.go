@@ -0,0 +1,68 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/common/hashing"
+	"github.com/amazechain/amc/common/types"
+)
+
+// receiptKey holds the consensus fields of a receipt not derived from the
+// state, identifying the receipts a root was computed for.
+type receiptKey struct {
+	txHash            types.Hash
+	status            uint64
+	cumulativeGasUsed uint64
+}
+
+// receiptsRoot is the last receipts root computed, dropped whenever a log is
+// added or reverted.
+type receiptsRoot struct {
+	receipts []receiptKey
+	root     types.Hash
+}
+
+// ReceiptsRoot fills the logs and bloom of the receipts from the logs recorded
+// for their transactions, in emission order, then returns their root as set in
+// the block header. The root is cached until the receipts or the recorded logs
+// change.
+func (s *StateDB) ReceiptsRoot(receipts block.Receipts) types.Hash {
+	keys := make([]receiptKey, len(receipts))
+	for i, receipt := range receipts {
+		keys[i] = receiptKey{receipt.TxHash, receipt.Status, receipt.CumulativeGasUsed}
+		receipt.Logs = s.TxLogs(receipt.TxHash)
+		receipt.Bloom = block.CreateBloom(block.Receipts{receipt})
+	}
+	if s.receiptsRoot != nil && sameReceipts(s.receiptsRoot.receipts, keys) {
+		return s.receiptsRoot.root
+	}
+	s.receiptsRoot = &receiptsRoot{receipts: keys, root: hashing.DeriveSha(receipts)}
+	return s.receiptsRoot.root
+}
+
+func sameReceipts(a, b []receiptKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
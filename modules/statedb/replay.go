@@ -0,0 +1,144 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amazechain/amc/common/types"
+)
+
+var errUnreplayableEntry = errors.New("journal entry can't be replayed")
+
+// CaptureJournal encodes the changes journalled since the last commit, such as
+// the ones of a transaction being debugged, for ApplyJournal to replay them on
+// another StateDB at the same starting root. The records use the journal spill
+// encoding, but each of them holds the value its change set rather than the
+// one it overwrote. Logs, preimages, transient storage and the prepared access
+// list don't affect the state root and aren't captured, while account resets
+// can't be and fail the capture.
+func (s *StateDB) CaptureJournal() ([][]byte, error) {
+	type slot struct {
+		addr types.Address
+		key  types.Hash
+	}
+	var (
+		balances = make(map[types.Address]types.Int256)
+		nonces   = make(map[types.Address]uint64)
+		codes    = make(map[types.Address][2][]byte)
+		slots    = make(map[slot]types.Hash)
+		refund   = s.refund
+		records  = make([][]byte, 0, s.journal.length())
+	)
+	// Walk the journal backwards, the value set by a change being the one the
+	// next change of the same field overwrote, or the live one for the last.
+	for i := s.journal.length() - 1; i >= 0; i-- {
+		var forward journalEntry
+		switch ch := s.journal.entry(i).(type) {
+		case createObjectChange, touchChange, accessListAddAccountChange, accessListAddSlotChange:
+			forward = ch
+		case suicideChange:
+			forward = ch
+			balances[*ch.account] = ch.prevbalance
+		case balanceChange:
+			balance, ok := balances[*ch.account]
+			if !ok {
+				balance = types.NewInt64(0)
+				if obj := s.getStateObject(*ch.account); obj != nil {
+					balance = obj.Balance()
+				}
+			}
+			forward, balances[*ch.account] = balanceChange{account: ch.account, prev: balance}, ch.prev
+		case nonceChange:
+			nonce, ok := nonces[*ch.account]
+			if !ok {
+				if obj := s.getStateObject(*ch.account); obj != nil {
+					nonce = obj.Nonce()
+				}
+			}
+			forward, nonces[*ch.account] = nonceChange{account: ch.account, prev: nonce}, ch.prev
+		case codeChange:
+			code, ok := codes[*ch.account]
+			if !ok {
+				if obj := s.getStateObject(*ch.account); obj != nil {
+					code = [2][]byte{obj.Code(s.db), obj.CodeHash()}
+				}
+			}
+			forward, codes[*ch.account] = codeChange{account: ch.account, prevcode: code[0], prevhash: code[1]}, [2][]byte{ch.prevcode, ch.prevhash}
+		case storageChange:
+			value, ok := slots[slot{*ch.account, ch.key}]
+			if !ok {
+				if obj := s.getStateObject(*ch.account); obj != nil {
+					value = obj.GetState(s.db, ch.key)
+				}
+			}
+			forward, slots[slot{*ch.account, ch.key}] = storageChange{account: ch.account, key: ch.key, prevalue: value}, ch.prevalue
+		case refundChange:
+			forward, refund = refundChange{prev: refund}, ch.prev
+		case addLogChange, addPreimageChange, transientStorageChange, accessListPrepareChange:
+			continue
+		default:
+			return nil, fmt.Errorf("%w: entry %d is a %T", errUnreplayableEntry, i, ch)
+		}
+		record, ok := encodeJournalEntry(forward)
+		if !ok {
+			return nil, fmt.Errorf("%w: entry %d is a %T", errUnreplayableEntry, i, forward)
+		}
+		records = append(records, record)
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// ApplyJournal replays the records captured by CaptureJournal, journalling the
+// changes as if they were made again.
+func (s *StateDB) ApplyJournal(records [][]byte) error {
+	for i, record := range records {
+		entry, err := decodeJournalEntry(record)
+		if err != nil {
+			return fmt.Errorf("journal record %d: %w", i, err)
+		}
+		switch ch := entry.(type) {
+		case createObjectChange:
+			s.createObject(*ch.account)
+		case suicideChange:
+			s.Suicide(*ch.account)
+		case balanceChange:
+			s.SetBalance(*ch.account, ch.prev)
+		case nonceChange:
+			s.SetNonce(*ch.account, ch.prev)
+		case codeChange:
+			s.SetCode(*ch.account, ch.prevcode)
+		case storageChange:
+			s.SetState(*ch.account, ch.key, ch.prevalue)
+		case refundChange:
+			s.journal.append(refundChange{prev: s.refund})
+			s.refund = ch.prev
+		case touchChange:
+			s.AddBalance(*ch.account, types.NewInt64(0))
+		case accessListAddAccountChange:
+			s.AddAddressToAccessList(*ch.address)
+		case accessListAddSlotChange:
+			s.AddSlotToAccessList(*ch.address, *ch.slot)
+		default:
+			return fmt.Errorf("%w: record %d is a %T", errUnreplayableEntry, i, ch)
+		}
+	}
+	return nil
+}
@@ -17,10 +17,13 @@
 package statedb
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"github.com/amazechain/amc/api/protocol/state"
 	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/common/crypto"
 	"github.com/amazechain/amc/common/db"
 	"github.com/amazechain/amc/common/transaction"
 	"github.com/amazechain/amc/common/types"
@@ -28,12 +31,32 @@ import (
 	"github.com/amazechain/amc/modules/rawdb"
 	"github.com/amazechain/amc/utils"
 	"github.com/gogo/protobuf/proto"
+	lru "github.com/hashicorp/golang-lru"
 	"sort"
+	"sync"
 )
 
+const existCacheSize = 4096 // Number of committed account existences remembered
+
+var (
+	errCodeHashMismatch = errors.New("code hash mismatch")
+	errTooManyAccounts  = errors.New("too many accounts changed by block")
+
+	// ErrJournalLimit is returned by JournalError once a transaction made more
+	// state changes than the journal allows.
+	ErrJournalLimit = errors.New("state journal entry limit exceeded")
+)
+
+// StateDB caches the accounts read and written while executing the blocks,
+// journalling the changes so they can be reverted. Every address, including
+// the zero one used as the burn address, is an ordinary account: its balance,
+// nonce, code and storage are read, journalled, reverted and committed alike.
+// Contract creations are told apart by their missing recipient, never by the
+// zero address.
 type StateDB struct {
 	db       db.IDatabase
 	changeDB kv.RwDB
+	store    accountStore
 	root     types.Hash
 	blockNr  types.Int256
 
@@ -48,6 +71,12 @@ type StateDB struct {
 	stateObjects      map[types.Address]*stateObject
 	stateObjectsDirty map[types.Address]struct{} // State objects modified in the current execution
 
+	cacheLimit int                        // Max number of resident state objects, 0 means unbounded
+	cacheOrder []types.Address            // Cached addresses in insertion order, oldest first
+	pinned     map[types.Address]struct{} // Addresses never evicted from the object cache
+
+	existCache *lru.Cache // Committed existence of the accounts as of root, nil until used
+
 	// Per-transaction access list
 	accessList *accessList
 
@@ -57,11 +86,57 @@ type StateDB struct {
 	logs    map[types.Hash][]*block.Log
 	logSize uint
 
+	refundLedger map[types.Hash]uint64 // Final refund of each transaction since the last commit
+	receiptsRoot *receiptsRoot         // Last receipts root computed, nil if the logs changed since
+
+	transientStorage transientStorage      // Storage discarded at the end of the transaction
+	transientStats   *TransientAccessStats // Transient storage accesses of the current transaction, nil if not counted
+
+	txStartBalances map[types.Address]types.Int256 // Balances as of the transaction start of the accounts changed since
+
 	journal        *journal
 	validRevisions []revision
 	nextRevisionId int
 
+	spillThreshold int    // Journal length past which entries are spilled to disk, 0 if disabled
+	spillDir       string // Directory of the journal spill logs
+	maxJournal     int    // Max number of journal entries of a transaction, 0 if unlimited
+
+	policy    ChangePolicy // Vets the state changes before they are applied, nil if none
+	policyErr error        // First change rejected within the current transaction
+
+	slotWrites map[types.Address]map[types.Hash]int // Per-tx storage write counters, nil if disabled
+
+	validateCode bool // Whether the code hashes are verified on commit
+	pruneSlots   bool // Whether the zero-valued storage slots are left out of the committed accounts
+	accountLimit int  // Max number of accounts a block may change, 0 if unlimited
+	preEIP161    bool // Whether the block predates EIP-161, new contracts starting at nonce 0
+	eip6780      bool // Whether selfdestruct only deletes the contracts created by the same transaction
+
+	newContracts []types.Address // Contracts created by the current transaction
+
+	snapDestructs map[types.Hash]struct{} // Accounts destructed for the snapshot layer by address hash, nil if not tracked
+
+	journalHooks []registeredHook // Hooks observing the journalled changes, in registration order
+	nextHookID   int
+
+	tracing     bool           // Whether state accesses are traced
+	accessTrace []AccessRecord // Ordered state accesses of the current transaction
+
+	readWitness map[types.Address]map[types.Hash]struct{} // Storage slots read, nil if not recorded
+	accessUsage *accessUsage                              // Accesses checked against the access list, nil if not recorded
+
+	// Account encodings covered by the last incremental root, as of the
+	// rootIndex position of the rootJournal journal
+	rootJournal   *journal
+	rootIndex     int
+	rootEncodings map[types.Address][]byte
+	rootStale     map[types.Address]struct{} // Cached accounts changed by a revert
+
 	preimages map[types.Hash][]byte
+
+	frozenLock sync.Mutex
+	frozen     map[*frozenStore]struct{} // Frozen views preserving the committed state
 }
 
 func NewStateDB(root types.Hash, db db.IDatabase, changeDB kv.RwDB) *StateDB {
@@ -70,6 +145,7 @@ func NewStateDB(root types.Hash, db db.IDatabase, changeDB kv.RwDB) *StateDB {
 	sdb := &StateDB{
 		db:                db,
 		changeDB:          changeDB,
+		store:             &rawdbStore{db: db, changeDB: changeDB},
 		blockNr:           blockNr,
 		root:              root,
 		stateObjects:      make(map[types.Address]*stateObject),
@@ -83,8 +159,96 @@ func NewStateDB(root types.Hash, db db.IDatabase, changeDB kv.RwDB) *StateDB {
 	return sdb
 }
 
+// NewMemoryStateDB creates an empty state database whose accounts are kept in
+// memory only. It behaves like a database backed one for reads, writes,
+// snapshots and reverts, but keeps no history, making it suitable for fast
+// unit tests of the execution logic.
+func NewMemoryStateDB() *StateDB {
+	return &StateDB{
+		store:             newMemoryStore(),
+		stateObjects:      make(map[types.Address]*stateObject),
+		logs:              make(map[types.Hash][]*block.Log),
+		stateObjectsDirty: make(map[types.Address]struct{}),
+		preimages:         make(map[types.Hash][]byte),
+		journal:           newJournal(),
+		accessList:        newAccessList(),
+	}
+}
+
 func (s *StateDB) setStateObject(object *stateObject) {
-	s.stateObjects[object.Address()] = object
+	addr := object.Address()
+	_, cached := s.stateObjects[addr]
+	s.stateObjects[addr] = object
+	if !cached && s.cacheLimit > 0 {
+		s.cacheOrder = append(s.cacheOrder, addr)
+		s.evictStateObjects()
+	}
+}
+
+// SetObjectCacheLimit bounds the number of state objects kept resident. Once
+// exceeded, the oldest clean and unpinned objects are dropped from the cache
+// and reloaded from the database on their next access. Zero disables eviction.
+func (s *StateDB) SetObjectCacheLimit(limit int) {
+	s.cacheLimit = limit
+	s.cacheOrder = s.cacheOrder[:0]
+	if limit > 0 {
+		for addr := range s.stateObjects {
+			s.cacheOrder = append(s.cacheOrder, addr)
+		}
+	}
+	s.evictStateObjects()
+}
+
+// Pin marks the account as non-evictable, keeping its state object resident
+// regardless of the cache pressure.
+func (s *StateDB) Pin(addr types.Address) {
+	if s.pinned == nil {
+		s.pinned = make(map[types.Address]struct{})
+	}
+	s.pinned[addr] = struct{}{}
+}
+
+// Unpin makes a previously pinned account evictable again.
+func (s *StateDB) Unpin(addr types.Address) {
+	delete(s.pinned, addr)
+}
+
+// evictable reports whether the state object of addr may be dropped from the
+// cache. Pinned objects and objects with pending changes are never evicted.
+func (s *StateDB) evictable(addr types.Address) bool {
+	if _, ok := s.pinned[addr]; ok {
+		return false
+	}
+	if _, ok := s.journal.dirties[addr]; ok {
+		return false
+	}
+	_, dirty := s.stateObjectsDirty[addr]
+	return !dirty
+}
+
+// evictStateObjects drops the oldest evictable objects until the cache fits
+// within its limit again. The most recently inserted object is always kept, as
+// its caller is still holding on to it.
+func (s *StateDB) evictStateObjects() {
+	if s.cacheLimit <= 0 || len(s.stateObjects) <= s.cacheLimit {
+		return
+	}
+	kept := s.cacheOrder[:0]
+	for i, addr := range s.cacheOrder {
+		if len(s.stateObjects) <= s.cacheLimit || i == len(s.cacheOrder)-1 {
+			kept = append(kept, s.cacheOrder[i:]...)
+			break
+		}
+		if _, ok := s.stateObjects[addr]; !ok {
+			continue
+		}
+		if !s.evictable(addr) {
+			kept = append(kept, addr)
+			continue
+		}
+		delete(s.stateObjects, addr)
+	}
+	s.cacheOrder = kept
 }
 
 func (s *StateDB) getStateObject(addr types.Address) *stateObject {
@@ -99,14 +263,50 @@ func (s *StateDB) getDeletedStateObject(addr types.Address) *stateObject {
 	if obj := s.stateObjects[addr]; obj != nil {
 		return obj
 	}
+	// Accounts known missing from the committed state aren't looked up again
+	if exists, ok := s.committedExistence(addr); ok && !exists {
+		return nil
+	}
 	obj, err := s.getAccount(addr)
 	if err != nil {
+		// The databases don't tell missing keys apart from read failures, but
+		// an account which can't be decoded is corrupt and must not pass for
+		// an empty one.
+		if errors.Is(err, errCorruptAccount) {
+			if s.dbErr == nil {
+				s.dbErr = err
+			}
+		} else {
+			s.cacheExistence(addr, false)
+		}
 		return nil
 	}
+	s.cacheExistence(addr, true)
 	s.setStateObject(obj)
 	return obj
 }
 
+// committedExistence returns whether the account exists in the committed state
+// as cached, and whether it is cached at all.
+func (s *StateDB) committedExistence(addr types.Address) (bool, bool) {
+	if s.existCache == nil {
+		return false, false
+	}
+	exists, ok := s.existCache.Get(addr)
+	if !ok {
+		return false, false
+	}
+	return exists.(bool), true
+}
+
+// cacheExistence remembers whether the account exists in the committed state.
+func (s *StateDB) cacheExistence(addr types.Address, exists bool) {
+	if s.existCache == nil {
+		s.existCache, _ = lru.New(existCacheSize)
+	}
+	s.existCache.Add(addr, exists)
+}
+
 func (s *StateDB) GetOrNewStateObject(addr types.Address) *stateObject {
 	stateObject := s.getStateObject(addr)
 	if stateObject == nil {
@@ -118,8 +318,15 @@ func (s *StateDB) GetOrNewStateObject(addr types.Address) *stateObject {
 func (s *StateDB) createObject(addr types.Address) (newobj, prev *stateObject) {
 	prev = s.getDeletedStateObject(addr)
 
+	// The replaced account is destructed as far as the snapshot layer is
+	// concerned, remembering whether it already was to revert precisely.
 	var prevdestruct bool
-
+	if s.snapDestructs != nil && prev != nil {
+		_, prevdestruct = s.snapDestructs[prev.addrHash]
+		if !prevdestruct {
+			s.snapDestructs[prev.addrHash] = struct{}{}
+		}
+	}
 	newobj = newObject(s, addr, StateAccount{})
 	if prev == nil {
 		s.journal.append(createObjectChange{account: &addr})
@@ -133,6 +340,29 @@ func (s *StateDB) createObject(addr types.Address) (newobj, prev *stateObject) {
 	return newobj, nil
 }
 
+// ForEachContract calls cb with the address and code hash of every committed
+// account holding code, in address order, until it returns false. Pending
+// changes are not reflected. Storage errors are memoized and can be retrieved
+// through Error.
+func (s *StateDB) ForEachContract(cb func(addr types.Address, codeHash types.Hash) bool) {
+	err := s.store.ForEachAccount(func(addr types.Address, data []byte) bool {
+		var account state.Account
+		if err := proto.Unmarshal(data, &account); err != nil {
+			if s.dbErr == nil {
+				s.dbErr = err
+			}
+			return false
+		}
+		if len(account.CodeHash) == 0 || bytes.Equal(account.CodeHash, emptyCodeHash) {
+			return true
+		}
+		return cb(addr, types.BytesToHash(account.CodeHash))
+	})
+	if err != nil && s.dbErr == nil {
+		s.dbErr = err
+	}
+}
+
 // IntermediateRoot root
 func (s *StateDB) IntermediateRoot() types.Hash {
 	return s.GenerateRootHash()
@@ -142,23 +372,94 @@ func (s *StateDB) IntermediateRoot() types.Hash {
 func (s *StateDB) Commit(blockNr types.Int256) (root types.Hash, err error) {
 	root = s.GenerateRootHash()
 
+	if err := s.CheckAccountLimit(); err != nil {
+		return types.Hash{}, err
+	}
 	for addr := range s.journal.dirties {
 		s.stateObjectsDirty[addr] = struct{}{}
 	}
 
+	if s.validateCode {
+		for addr := range s.stateObjectsDirty {
+			if err := verifyCodeHash(s.getDeletedStateObject(addr)); err != nil {
+				return types.Hash{}, err
+			}
+		}
+	}
 	for address, _ := range s.stateObjectsDirty {
 		obj := s.getDeletedStateObject(address)
 		//todo setAccount  batch?
 		//
-		err := s.setAccount(address, s.changeDB, blockNr, obj)
+		s.preserveFrozen(address)
+		err := s.setAccount(address, blockNr, obj)
 		if err != nil {
 			return types.Hash{}, err
 		}
+		s.cacheExistence(address, obj != nil && !obj.deleted && !obj.suicided)
 	}
 	s.clearJournalAndRefund()
 	return root, nil
 }
 
+// SetCodeValidation enables or disables verifying on commit that the code of
+// every changed account hashes to its code hash. It is meant for debugging, as
+// it rehashes all the code set since the last commit.
+func (s *StateDB) SetCodeValidation(enabled bool) {
+	s.validateCode = enabled
+}
+
+// SetAccountLimit caps the number of distinct accounts the block being executed
+// may create or change, as a defense against state bloat. Past the limit, the
+// block must be rejected: CheckAccountLimit reports it, and Commit fails
+// without writing anything. Zero, the default, lifts the limit.
+func (s *StateDB) SetAccountLimit(limit int) {
+	s.accountLimit = limit
+}
+
+// ChangedAccounts returns the number of distinct accounts changed since the
+// StateDB was last reset, reverted changes aside.
+func (s *StateDB) ChangedAccounts() int {
+	changed := len(s.stateObjectsDirty)
+	for addr := range s.journal.dirties {
+		if _, ok := s.stateObjectsDirty[addr]; !ok {
+			changed++
+		}
+	}
+	return changed
+}
+
+// DirtyAccountCount returns the number of distinct accounts with changes in the
+// journal, i.e. changed since the last commit, reverted changes aside. It is a
+// cheap read, suitable for sampling between the steps of the execution.
+func (s *StateDB) DirtyAccountCount() int {
+	return len(s.journal.dirties)
+}
+
+// CheckAccountLimit returns an error if the block being executed changed more
+// accounts than allowed by SetAccountLimit. It can be called after every
+// transaction to reject the block early.
+func (s *StateDB) CheckAccountLimit() error {
+	if s.accountLimit <= 0 {
+		return nil
+	}
+	if changed := s.ChangedAccounts(); changed > s.accountLimit {
+		return fmt.Errorf("%w: %d accounts, limit %d", errTooManyAccounts, changed, s.accountLimit)
+	}
+	return nil
+}
+
+// verifyCodeHash checks that the code of the account, if set since it was
+// loaded, hashes to its code hash.
+func verifyCodeHash(obj *stateObject) error {
+	if obj == nil || !obj.dirtyCode || (len(obj.code) == 0 && len(obj.CodeHash()) == 0) {
+		return nil
+	}
+	if hash := utils.Keccak256(obj.code); !bytes.Equal(hash, obj.CodeHash()) {
+		return fmt.Errorf("%w for %v: have %x, want %x", errCodeHashMismatch, obj.address, obj.CodeHash(), hash)
+	}
+	return nil
+}
+
 func (s *StateDB) RevertToSnapshot(revid int) {
 
 	idx := sort.Search(len(s.validRevisions), func(i int) bool {
@@ -169,11 +470,42 @@ func (s *StateDB) RevertToSnapshot(revid int) {
 	}
 	snapshot := s.validRevisions[idx].journalIndex
 
+	// Changes reverted past the last incremental root invalidate its encodings
+	if s.rootJournal == s.journal && snapshot < s.rootIndex {
+		for i := snapshot; i < s.rootIndex; i++ {
+			if addr := s.journal.entry(i).dirtied(); addr != nil {
+				s.rootStale[*addr] = struct{}{}
+			}
+		}
+		s.rootIndex = snapshot
+	}
 	// Replay the journal to undo changes and remove invalidated snapshots
 	s.journal.revert(s, snapshot)
 	s.validRevisions = s.validRevisions[:idx]
 }
 
+// ResetAccount discards the pending changes to the account, reloading it from
+// the committed state on its next access, or removing it if it was created
+// since the last commit. The reset itself is journalled and can be reverted.
+func (s *StateDB) ResetAccount(addr types.Address) {
+	s.journal.append(resetAccountChange{
+		account:     &addr,
+		prev:        s.stateObjects[addr],
+		prevdirties: s.journal.dirties[addr],
+	})
+	delete(s.stateObjects, addr)
+	delete(s.journal.dirties, addr)
+	s.markRootStale(addr)
+}
+
+// markRootStale invalidates the incremental root encoding of the account, for
+// the changes not reported by the journal entries.
+func (s *StateDB) markRootStale(addr types.Address) {
+	if s.rootJournal == s.journal && s.rootStale != nil {
+		s.rootStale[addr] = struct{}{}
+	}
+}
+
 // Snapshot returns an identifier for the current revision of the state.
 func (s *StateDB) Snapshot() int {
 	id := s.nextRevisionId
@@ -182,17 +514,217 @@ func (s *StateDB) Snapshot() int {
 	return id
 }
 
+// HasNetChanges reports whether the state differs from the one at the given
+// snapshot, that is whether any account was created or replaced since, or any
+// balance, nonce, code, storage slot or self-destruct flag lost the value it
+// had then. Logs, refunds and access lists aren't considered state.
+func (s *StateDB) HasNetChanges(revid int) bool {
+	idx := sort.Search(len(s.validRevisions), func(i int) bool {
+		return s.validRevisions[i].id >= revid
+	})
+	if idx == len(s.validRevisions) || s.validRevisions[idx].id != revid {
+		panic(fmt.Errorf("revision id %v cannot be compared", revid))
+	}
+	type slot struct {
+		addr types.Address
+		key  types.Hash
+	}
+	// The first change of each value since the snapshot holds the value of
+	// the snapshot
+	var (
+		balances = make(map[types.Address]types.Int256)
+		nonces   = make(map[types.Address]uint64)
+		codes    = make(map[types.Address][]byte)
+		suicides = make(map[types.Address]bool)
+		slots    = make(map[slot]types.Hash)
+	)
+	for i := s.validRevisions[idx].journalIndex; i < s.journal.length(); i++ {
+		switch ch := s.journal.entry(i).(type) {
+		case createObjectChange, resetObjectChange, resetAccountChange:
+			return true
+		case balanceChange:
+			if _, ok := balances[*ch.account]; !ok {
+				balances[*ch.account] = ch.prev
+			}
+		case suicideChange:
+			if _, ok := suicides[*ch.account]; !ok {
+				suicides[*ch.account] = ch.prev
+			}
+			if _, ok := balances[*ch.account]; !ok {
+				balances[*ch.account] = ch.prevbalance
+			}
+		case nonceChange:
+			if _, ok := nonces[*ch.account]; !ok {
+				nonces[*ch.account] = ch.prev
+			}
+		case codeChange:
+			if _, ok := codes[*ch.account]; !ok {
+				codes[*ch.account] = ch.prevhash
+			}
+		case storageChange:
+			if _, ok := slots[slot{*ch.account, ch.key}]; !ok {
+				slots[slot{*ch.account, ch.key}] = ch.prevalue
+			}
+		}
+	}
+	// Accounts changed since the snapshot weren't created since, so they
+	// exist unless self-destructed. Their objects are read directly to keep
+	// the comparison out of the access trace.
+	for addr, balance := range balances {
+		if obj := s.getStateObject(addr); obj == nil || !obj.Balance().Equal(balance) {
+			return true
+		}
+	}
+	for addr, suicided := range suicides {
+		if obj := s.getStateObject(addr); obj == nil || obj.suicided != suicided {
+			return true
+		}
+	}
+	for addr, nonce := range nonces {
+		if obj := s.getStateObject(addr); obj == nil || obj.Nonce() != nonce {
+			return true
+		}
+	}
+	for addr, hash := range codes {
+		if obj := s.getStateObject(addr); obj == nil || !bytes.Equal(obj.CodeHash(), hash) {
+			return true
+		}
+	}
+	for slot, value := range slots {
+		if obj := s.getStateObject(slot.addr); obj == nil || obj.GetState(s.db, slot.key) != value {
+			return true
+		}
+	}
+	return false
+}
+
+// BalanceCheckpoint returns a checkpoint for RevertBalances, lighter than a
+// snapshot as it isn't tracked as a revision.
+func (s *StateDB) BalanceCheckpoint() int {
+	return s.journal.length()
+}
+
+// RevertBalances restores the balances changed since the checkpoint, leaving
+// the rest of the state as is. The balances cleared by a self-destruct are
+// restored too, the accounts remaining destructed. The restorations are
+// journalled as any other balance change, so snapshots taken before or after
+// remain revertible. A checkpoint beyond the journal, invalidated by a revert,
+// restores nothing.
+func (s *StateDB) RevertBalances(checkpoint int) {
+	var (
+		addrs    []types.Address
+		balances = make(map[types.Address]types.Int256)
+	)
+	for i := checkpoint; i < s.journal.length(); i++ {
+		var (
+			addr types.Address
+			prev types.Int256
+		)
+		switch ch := s.journal.entry(i).(type) {
+		case balanceChange:
+			addr, prev = *ch.account, ch.prev
+		case suicideChange:
+			addr, prev = *ch.account, ch.prevbalance
+		default:
+			continue
+		}
+		if _, ok := balances[addr]; !ok {
+			addrs = append(addrs, addr)
+			balances[addr] = prev
+		}
+	}
+	for _, addr := range addrs {
+		if obj := s.getStateObject(addr); obj != nil && !obj.Balance().Equal(balances[addr]) {
+			obj.SetBalance(balances[addr])
+		}
+	}
+}
+
+// AllDirtyStorage returns the storage keys changed by the journalled
+// modifications, i.e. within the current transaction, keyed by account. Keys
+// are listed once, sorted, except for reverted changes.
+func (s *StateDB) AllDirtyStorage() map[types.Address][]types.Hash {
+	seen := make(map[types.Address]map[types.Hash]struct{})
+	dirty := make(map[types.Address][]types.Hash)
+	for i := 0; i < s.journal.length(); i++ {
+		ch, ok := s.journal.entry(i).(storageChange)
+		if !ok {
+			continue
+		}
+		if seen[*ch.account] == nil {
+			seen[*ch.account] = make(map[types.Hash]struct{})
+		}
+		if _, ok := seen[*ch.account][ch.key]; ok {
+			continue
+		}
+		seen[*ch.account][ch.key] = struct{}{}
+		dirty[*ch.account] = append(dirty[*ch.account], ch.key)
+	}
+	for _, keys := range dirty {
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i][:], keys[j][:]) < 0
+		})
+	}
+	return dirty
+}
+
+// SetJournalSpill bounds the number of journal entries kept in memory. Past the
+// threshold, the oldest entries are moved to a temporary log within dir, the
+// default temporary directory if empty, and reloaded on revert. A threshold of
+// zero disables spilling.
+func (s *StateDB) SetJournalSpill(threshold int, dir string) {
+	s.spillThreshold, s.spillDir = threshold, dir
+	s.journal.setSpill(threshold, dir)
+}
+
+// SetMaxJournalEntries bounds the number of state changes journalled by a
+// single transaction, guarding the memory against the ones making millions of
+// them. Past the bound, JournalError reports ErrJournalLimit and the caller is
+// expected to abort the transaction, as if it ran out of gas. Zero means
+// unlimited.
+func (s *StateDB) SetMaxJournalEntries(n int) {
+	if n < 0 {
+		n = 0
+	}
+	s.maxJournal = n
+	s.journal.setMaxEntries(n)
+}
+
+// JournalError returns ErrJournalLimit if the current transaction grew the
+// journal past its bound. Reverting the changes doesn't clear the error, the
+// next Prepare does.
+func (s *StateDB) JournalError() error {
+	if !s.journal.overflowed {
+		return nil
+	}
+	return fmt.Errorf("%w: limit %d", ErrJournalLimit, s.journal.maxEntries)
+}
+
+// revisionBoundary returns the journal index of the latest snapshot, entries
+// before which must be kept intact to be able to revert to it.
+func (s *StateDB) revisionBoundary() int {
+	if len(s.validRevisions) == 0 {
+		return 0
+	}
+	return s.validRevisions[len(s.validRevisions)-1].journalIndex
+}
+
 func (s *StateDB) clearJournalAndRefund() {
-	if len(s.journal.entries) > 0 {
+	if s.journal.length() > 0 {
+		s.journal.close()
 		s.journal = newJournal()
+		s.journal.setSpill(s.spillThreshold, s.spillDir)
+		s.journal.setMaxEntries(s.maxJournal)
+		s.journal.hook = s.journalHook()
 		s.refund = 0
 	}
+	s.refundLedger = nil
 	s.validRevisions = s.validRevisions[:0] // Snapshots can be created without journal entires
 }
 
 func (s *StateDB) getAccount(addr types.Address) (*stateObject, error) {
 
-	v, err := rawdb.GetAccount(s.db, s.changeDB, s.blockNr, addr)
+	v, err := s.store.ReadAccount(s.blockNr, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -202,10 +734,10 @@ func (s *StateDB) getAccount(addr types.Address) (*stateObject, error) {
 		obj       stateObject
 	)
 	if err := proto.Unmarshal(v, &pbAccount); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w %v: %v", errCorruptAccount, addr, err)
 	}
 	if err := obj.FromProtoMessage(s, addr, &pbAccount); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w %v: %v", errCorruptAccount, addr, err)
 	}
 
 	s.setStateObject(&obj)
@@ -213,13 +745,13 @@ func (s *StateDB) getAccount(addr types.Address) (*stateObject, error) {
 	return &obj, nil
 }
 
-func (s *StateDB) setAccount(addr types.Address, changeDB kv.RwDB, blockNr types.Int256, obj *stateObject) error {
+func (s *StateDB) setAccount(addr types.Address, blockNr types.Int256, obj *stateObject) error {
 	message := obj.ToProtoMessage()
 	v, err := proto.Marshal(message)
 	if err != nil {
 		return err
 	}
-	err = rawdb.StoreAccount(s.db, changeDB, blockNr, addr, v)
+	err = s.store.WriteAccount(blockNr, addr, v)
 	if err != nil {
 		return err
 	}
@@ -234,25 +766,122 @@ func (s *StateDB) CreateAccount(addr types.Address) {
 	}
 }
 
+// CreateContract creates the account of a contract deployed at addr, whether by
+// CREATE or CREATE2 as only the derivation of the address differs. The balance
+// sent to the address beforehand is kept, and the nonce starts at 1 as of
+// EIP-161, at 0 before. The creation is journalled, reverted along with a
+// failed deployment.
+func (s *StateDB) CreateContract(addr types.Address) {
+	s.CreateAccount(addr)
+	if obj := s.getStateObject(addr); obj != nil {
+		obj.newContract = true
+		s.newContracts = append(s.newContracts, addr)
+	}
+	if !s.preEIP161 {
+		s.SetNonce(addr, 1)
+	}
+}
+
+// SetEIP161 tells whether EIP-161 is in effect for the block being executed,
+// which it is by default, setting the initial nonce of the new contracts.
+func (s *StateDB) SetEIP161(enabled bool) {
+	s.preEIP161 = !enabled
+}
+
+// SetSnapshotDestructs enables or disables the tracking of the accounts
+// destructed by being created anew over an existing one, as needed to maintain
+// a snapshot layer. Enabling it again starts a new set.
+func (s *StateDB) SetSnapshotDestructs(enabled bool) {
+	if enabled {
+		s.snapDestructs = make(map[types.Hash]struct{})
+	} else {
+		s.snapDestructs = nil
+	}
+}
+
+// SnapshotDestructs returns the address hashes of the accounts destructed since
+// the tracking was enabled, net of the reverted changes.
+func (s *StateDB) SnapshotDestructs() []types.Hash {
+	hashes := make([]types.Hash, 0, len(s.snapDestructs))
+	for hash := range s.snapDestructs {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	return hashes
+}
+
+// SetEmptySlotPruning tells whether the storage slots set to zero are deleted
+// from the committed accounts and the state root, as canonical, rather than
+// stored with a zero value as the earlier blocks of the chain did.
+func (s *StateDB) SetEmptySlotPruning(enabled bool) {
+	s.pruneSlots = enabled
+}
+
+// SetEIP6780 tells whether EIP-6780 is in effect for the block being executed,
+// under which Suicide only deletes the contracts created by the same
+// transaction, merely clearing the balance of the others.
+func (s *StateDB) SetEIP6780(enabled bool) {
+	s.eip6780 = enabled
+}
+
 func (s *StateDB) GetNonce(addr types.Address) uint64 {
-	stateObject := s.getStateObject(addr)
-	if stateObject != nil {
-		return stateObject.Nonce()
+	var nonce uint64
+	if stateObject := s.getStateObject(addr); stateObject != nil {
+		nonce = stateObject.Nonce()
 	}
-	return 0
+	if s.tracing {
+		s.traceAccess(NonceRead, addr, types.Hash{}, nonceWord(nonce))
+	}
+	return nonce
 }
 func (s *StateDB) GetBalance(addr types.Address) types.Int256 {
-	stateObject := s.getStateObject(addr)
-	if stateObject != nil {
+	balance := types.NewInt64(0)
+	if stateObject := s.getStateObject(addr); stateObject != nil {
+		balance = stateObject.Balance()
+	}
+	if s.tracing {
+		s.traceAccess(BalanceRead, addr, types.Hash{}, balanceWord(balance))
+	}
+	return balance
+}
+
+// GetBalanceAtTxStart retrieves the balance of the account as of the start of
+// the current transaction, i.e. the last Prepare, regardless of the changes
+// made and reverted since.
+func (s *StateDB) GetBalanceAtTxStart(addr types.Address) types.Int256 {
+	if balance, ok := s.txStartBalances[addr]; ok {
+		return balance
+	}
+	if stateObject := s.getStateObject(addr); stateObject != nil {
 		return stateObject.Balance()
 	}
 	return types.NewInt64(0)
 }
 
+// keepTxStartBalance records the balance of the account before its first change
+// within the current transaction.
+func (s *StateDB) keepTxStartBalance(addr types.Address, balance types.Int256) {
+	if _, ok := s.txStartBalances[addr]; ok {
+		return
+	}
+	if s.txStartBalances == nil {
+		s.txStartBalances = make(map[types.Address]types.Int256)
+	}
+	s.txStartBalances[addr] = balance
+}
+
 func (s *StateDB) SetBalance(addr types.Address, amount types.Int256) {
 	stateObject := s.GetOrNewStateObject(addr)
 	if stateObject != nil {
-		stateObject.setBalance(amount)
+		if !s.allowed(BalanceWrite, addr, types.Hash{}, balanceWord(amount)) {
+			return
+		}
+		stateObject.SetBalance(amount)
+		if s.tracing {
+			s.traceAccess(BalanceWrite, addr, types.Hash{}, balanceWord(stateObject.Balance()))
+		}
 	}
 }
 
@@ -260,20 +889,83 @@ func (s *StateDB) SubBalance(addr types.Address, amount types.Int256) {
 	stateObject := s.GetOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.SubBalance(amount)
+		if s.tracing {
+			s.traceAccess(BalanceWrite, addr, types.Hash{}, balanceWord(stateObject.Balance()))
+		}
 	}
 }
 
 func (s *StateDB) AddBalance(addr types.Address, amount types.Int256) {
 	stateObject := s.GetOrNewStateObject(addr)
 	if stateObject != nil {
+		if !s.allowed(BalanceWrite, addr, types.Hash{}, balanceWord(stateObject.Balance().Add(amount))) {
+			return
+		}
+		stateObject.AddBalance(amount)
+		if s.tracing {
+			s.traceAccess(BalanceWrite, addr, types.Hash{}, balanceWord(stateObject.Balance()))
+		}
+	}
+}
+
+// Transfer moves amount from sender to recipient, reporting false without any
+// change if the sender can't afford it or the change policy rejects either the
+// debit or the credit. A transfer to self leaves the balance as is and journals
+// a single balance change, rather than an intermediate debit which a revert
+// could leave half applied. A transfer to the zero address burns the amount,
+// which stays accounted for in its balance.
+func (s *StateDB) Transfer(sender, recipient types.Address, amount types.Int256) bool {
+	balance := s.GetBalance(sender)
+	if balance.Compare(amount) < 0 {
+		return false
+	}
+	if sender != recipient {
+		// Vet both sides first, a rejected credit mustn't leave the debit applied
+		credited := types.NewInt64(0)
+		if obj := s.getStateObject(recipient); obj != nil {
+			credited = obj.Balance()
+		}
+		if !s.allowed(BalanceWrite, sender, types.Hash{}, balanceWord(balance.Sub(amount))) ||
+			!s.allowed(BalanceWrite, recipient, types.Hash{}, balanceWord(credited.Add(amount))) {
+			return false
+		}
+		from, to := s.GetOrNewStateObject(sender), s.GetOrNewStateObject(recipient)
+		if from == nil || to == nil {
+			return false
+		}
+		from.SubBalance(amount)
+		to.AddBalance(amount)
+		if s.tracing {
+			s.traceAccess(BalanceWrite, sender, types.Hash{}, balanceWord(from.Balance()))
+			s.traceAccess(BalanceWrite, recipient, types.Hash{}, balanceWord(to.Balance()))
+		}
+		return true
+	}
+	stateObject := s.GetOrNewStateObject(sender)
+	if stateObject == nil {
+		return false
+	}
+	if amount.Sign() == 0 {
 		stateObject.AddBalance(amount)
+		return true
+	}
+	if !s.allowed(BalanceWrite, sender, types.Hash{}, balanceWord(stateObject.Balance())) {
+		return false
 	}
+	stateObject.SetBalance(stateObject.Balance())
+	if s.tracing {
+		s.traceAccess(BalanceWrite, sender, types.Hash{}, balanceWord(stateObject.Balance()))
+	}
+	return true
 }
 
 func (s *StateDB) SetNonce(addr types.Address, nonce uint64) {
 	stateObject := s.GetOrNewStateObject(addr)
 	if stateObject != nil {
-		stateObject.setNonce(nonce)
+		stateObject.SetNonce(nonce)
+		if s.tracing {
+			s.traceAccess(NonceWrite, addr, types.Hash{}, nonceWord(nonce))
+		}
 	}
 }
 
@@ -290,6 +982,9 @@ func (s *StateDB) GetCodeHash(addr types.Address) types.Hash {
 
 func (s *StateDB) GetCode(addr types.Address) []byte {
 	stateObject := s.getStateObject(addr)
+	if s.tracing {
+		s.traceAccess(CodeRead, addr, types.Hash{}, s.GetCodeHash(addr))
+	}
 	if stateObject != nil {
 		return stateObject.Code(s.db)
 	}
@@ -299,7 +994,14 @@ func (s *StateDB) GetCode(addr types.Address) []byte {
 func (s *StateDB) SetCode(addr types.Address, code []byte) {
 	stateObject := s.GetOrNewStateObject(addr)
 	if stateObject != nil {
-		stateObject.SetCode(types.BytesToHash(utils.Keccak256(code)), code)
+		codeHash := types.BytesToHash(utils.Keccak256(code))
+		if !s.allowed(CodeWrite, addr, types.Hash{}, codeHash) {
+			return
+		}
+		stateObject.SetCode(codeHash, code)
+		if s.tracing {
+			s.traceAccess(CodeWrite, addr, types.Hash{}, types.BytesToHash(stateObject.CodeHash()))
+		}
 	}
 }
 
@@ -328,29 +1030,95 @@ func (s *StateDB) GetRefund() uint64 {
 	return s.refund
 }
 
+// FinaliseRefund caps the refund counter of the current transaction at
+// maxRefund, as the state transition does, and records the capped refund in
+// the refund ledger. It is meant to be called once the transaction is over,
+// any reverted refund being already undone.
+func (s *StateDB) FinaliseRefund(maxRefund uint64) uint64 {
+	refund := s.refund
+	if refund > maxRefund {
+		refund = maxRefund
+	}
+	if s.refundLedger == nil {
+		s.refundLedger = make(map[types.Hash]uint64)
+	}
+	s.refundLedger[s.txHash] = refund
+	return refund
+}
+
+// RefundLedger returns the final refund of each transaction finalised since
+// the last commit, keyed by transaction hash.
+func (s *StateDB) RefundLedger() map[types.Hash]uint64 {
+	ledger := make(map[types.Hash]uint64, len(s.refundLedger))
+	for hash, refund := range s.refundLedger {
+		ledger[hash] = refund
+	}
+	return ledger
+}
+
 func (s *StateDB) GetCommittedState(addr types.Address, hash types.Hash) types.Hash {
-	stateObject := s.getStateObject(addr)
-	if stateObject != nil {
-		return stateObject.GetCommittedState(s.db, hash)
+	var value types.Hash
+	if stateObject := s.getStateObject(addr); stateObject != nil {
+		value = stateObject.GetCommittedState(s.db, hash)
 	}
-	return types.Hash{}
+	s.witnessRead(addr, hash)
+	if s.tracing {
+		s.traceAccess(StorageRead, addr, hash, value)
+	}
+	return value
 }
 
 func (s *StateDB) GetState(addr types.Address, hash types.Hash) types.Hash {
-	stateObject := s.getStateObject(addr)
-	if stateObject != nil {
-		return stateObject.GetState(s.db, hash)
+	var value types.Hash
+	if stateObject := s.getStateObject(addr); stateObject != nil {
+		value = stateObject.GetState(s.db, hash)
 	}
-	return types.Hash{}
+	s.witnessRead(addr, hash)
+	if s.tracing {
+		s.traceAccess(StorageRead, addr, hash, value)
+	}
+	return value
 }
 
 func (s *StateDB) SetState(addr types.Address, key types.Hash, value types.Hash) {
 	stateObject := s.GetOrNewStateObject(addr)
 	if stateObject != nil {
+		if !s.allowed(StorageWrite, addr, key, value) {
+			return
+		}
 		stateObject.SetState(s.db, key, value)
+		if s.tracing {
+			s.traceAccess(StorageWrite, addr, key, value)
+		}
+	}
+}
+
+// SetStateBatch updates several storage slots of the account at once. Each slot
+// is journaled on its own, in key order, so that reverting restores the prior
+// value of every one of them.
+func (s *StateDB) SetStateBatch(addr types.Address, kv map[types.Hash]types.Hash) {
+	keys := make([]types.Hash, 0, len(kv))
+	for key := range kv {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	for _, key := range keys {
+		s.SetState(addr, key, kv[key])
 	}
 }
 
+// StorageSize returns the number of non-zero storage slots occupied by the
+// account, reflecting the pending storage changes.
+func (s *StateDB) StorageSize(addr types.Address) int {
+	stateObject := s.getStateObject(addr)
+	if stateObject != nil {
+		return stateObject.storageSize()
+	}
+	return 0
+}
+
 // SetStorage replaces the entire storage for the specified account with given
 // storage. This function should only be used for debugging.
 func (s *StateDB) SetStorage(addr types.Address, storage map[types.Hash]types.Hash) {
@@ -360,18 +1128,26 @@ func (s *StateDB) SetStorage(addr types.Address, storage map[types.Hash]types.Ha
 	}
 }
 
+// Suicide marks the account for deletion at the end of the block and clears its
+// balance. As of EIP-6780, the accounts not created by the current transaction
+// are retained, only their balance being cleared.
 func (s *StateDB) Suicide(addr types.Address) bool {
 	stateObject := s.getStateObject(addr)
 	if stateObject == nil {
 		return false
 	}
+	retained := s.eip6780 && !stateObject.newContract
 	s.journal.append(suicideChange{
 		account:     &addr,
 		prev:        stateObject.suicided,
 		prevbalance: stateObject.Balance(),
+		retained:    retained,
 	})
 
-	stateObject.markSuicided()
+	s.keepTxStartBalance(addr, stateObject.Balance())
+	if !retained {
+		stateObject.markSuicided()
+	}
 	stateObject.data.Balance = types.NewInt64(0)
 	return true
 }
@@ -384,10 +1160,178 @@ func (s *StateDB) HasSuicided(addr types.Address) bool {
 	return false
 }
 
+// Exist reports whether the account exists. The objects which are not live
+// are answered from the committed existence cache when possible.
 func (s *StateDB) Exist(addr types.Address) bool {
+	if _, live := s.stateObjects[addr]; !live {
+		if exists, ok := s.committedExistence(addr); ok {
+			return exists
+		}
+	}
 	return s.getStateObject(addr) != nil
 }
 
+// Reset points the StateDB to the committed state of the given root, such as
+// after a new block or a reorg, dropping all the pending changes along with
+// the cached objects and account existences.
+func (s *StateDB) Reset(root types.Hash) {
+	if s.db != nil {
+		s.blockNr, _ = rawdb.GetHashNumber(s.db, root)
+	}
+	s.root = root
+	s.stateObjects = make(map[types.Address]*stateObject)
+	s.stateObjectsDirty = make(map[types.Address]struct{})
+	s.cacheOrder = s.cacheOrder[:0]
+	if s.existCache != nil {
+		s.existCache.Purge()
+	}
+	s.logs = make(map[types.Hash][]*block.Log)
+	s.logSize = 0
+	s.receiptsRoot = nil
+	s.preimages = make(map[types.Hash][]byte)
+	s.accessList = newAccessList()
+	s.rootJournal, s.rootEncodings = nil, nil
+
+	s.journal.close()
+	s.journal = newJournal()
+	s.journal.setSpill(s.spillThreshold, s.spillDir)
+	s.journal.setMaxEntries(s.maxJournal)
+	s.journal.hook = s.journalHook()
+	s.validRevisions = s.validRevisions[:0]
+	s.refund = 0
+	s.refundLedger = nil
+}
+
+// Copy returns an independent copy of the state, such as a fork for executing
+// transactions speculatively. The cached objects, journal, snapshots, logs,
+// access list and transient storage are copied, so changing or reverting either
+// state leaves the other untouched. The databases, the account store and the
+// committed existence cache are shared, committing the copy writing to them.
+// The change policy is kept, while the journal hooks and frozen views aren't
+// carried over.
+func (s *StateDB) Copy() *StateDB {
+	state := &StateDB{
+		db:                s.db,
+		changeDB:          s.changeDB,
+		store:             s.store,
+		root:              s.root,
+		blockNr:           s.blockNr,
+		dbErr:             s.dbErr,
+		stateObjects:      make(map[types.Address]*stateObject, len(s.stateObjects)),
+		stateObjectsDirty: make(map[types.Address]struct{}, len(s.stateObjectsDirty)),
+		cacheLimit:        s.cacheLimit,
+		cacheOrder:        append([]types.Address(nil), s.cacheOrder...),
+		existCache:        s.existCache,
+		accessList:        s.accessList.Copy(),
+		refund:            s.refund,
+		txHash:            s.txHash,
+		txIndex:           s.txIndex,
+		logs:              make(map[types.Hash][]*block.Log, len(s.logs)),
+		logSize:           s.logSize,
+		transientStorage:  make(transientStorage, len(s.transientStorage)),
+		validRevisions:    append([]revision(nil), s.validRevisions...),
+		nextRevisionId:    s.nextRevisionId,
+		spillThreshold:    s.spillThreshold,
+		spillDir:          s.spillDir,
+		maxJournal:        s.maxJournal,
+		policy:            s.policy,
+		policyErr:         s.policyErr,
+		validateCode:      s.validateCode,
+		pruneSlots:        s.pruneSlots,
+		accountLimit:      s.accountLimit,
+		preEIP161:         s.preEIP161,
+		eip6780:           s.eip6780,
+		newContracts:      append([]types.Address(nil), s.newContracts...),
+		tracing:           s.tracing,
+		accessTrace:       append([]AccessRecord(nil), s.accessTrace...),
+		preimages:         make(map[types.Hash][]byte, len(s.preimages)),
+	}
+	for addr, obj := range s.stateObjects {
+		state.stateObjects[addr] = obj.deepCopy(state)
+	}
+	for addr := range s.stateObjectsDirty {
+		state.stateObjectsDirty[addr] = struct{}{}
+	}
+	if s.pinned != nil {
+		state.pinned = make(map[types.Address]struct{}, len(s.pinned))
+		for addr := range s.pinned {
+			state.pinned[addr] = struct{}{}
+		}
+	}
+	for hash, logs := range s.logs {
+		state.logs[hash] = append([]*block.Log(nil), logs...)
+	}
+	if s.refundLedger != nil {
+		state.refundLedger = make(map[types.Hash]uint64, len(s.refundLedger))
+		for hash, refund := range s.refundLedger {
+			state.refundLedger[hash] = refund
+		}
+	}
+	for addr, storage := range s.transientStorage {
+		state.transientStorage[addr] = storage.Copy()
+	}
+	if s.transientStats != nil {
+		stats := *s.transientStats
+		state.transientStats = &stats
+	}
+	if s.txStartBalances != nil {
+		state.txStartBalances = make(map[types.Address]types.Int256, len(s.txStartBalances))
+		for addr, balance := range s.txStartBalances {
+			state.txStartBalances[addr] = balance
+		}
+	}
+	if s.slotWrites != nil {
+		state.slotWrites = make(map[types.Address]map[types.Hash]int, len(s.slotWrites))
+		for addr, writes := range s.slotWrites {
+			state.slotWrites[addr] = make(map[types.Hash]int, len(writes))
+			for key, n := range writes {
+				state.slotWrites[addr][key] = n
+			}
+		}
+	}
+	if s.snapDestructs != nil {
+		state.snapDestructs = make(map[types.Hash]struct{}, len(s.snapDestructs))
+		for hash := range s.snapDestructs {
+			state.snapDestructs[hash] = struct{}{}
+		}
+	}
+	if s.readWitness != nil {
+		state.readWitness = make(map[types.Address]map[types.Hash]struct{}, len(s.readWitness))
+		for addr, slots := range s.readWitness {
+			state.readWitness[addr] = make(map[types.Hash]struct{}, len(slots))
+			for key := range slots {
+				state.readWitness[addr][key] = struct{}{}
+			}
+		}
+	}
+	if s.accessUsage != nil {
+		state.accessUsage = newAccessUsage()
+		for addr, slots := range s.accessUsage.accessed {
+			state.accessUsage.accessed[addr] = make(map[types.Hash]struct{}, len(slots))
+			for key := range slots {
+				state.accessUsage.accessed[addr][key] = struct{}{}
+			}
+		}
+		for addr := range s.accessUsage.warm {
+			state.accessUsage.warm[addr] = struct{}{}
+		}
+	}
+	for hash, preimage := range s.preimages {
+		state.preimages[hash] = preimage
+	}
+	state.journal = s.journal.copy(state)
+	state.journal.setSpill(state.spillThreshold, state.spillDir)
+	return state
+}
+
+// PredictCreate2Address returns the address a CREATE2 deployment by deployer
+// with the given salt and init code hash results in, as computed by the EVM:
+// keccak256(0xff ++ deployer ++ salt ++ initCodeHash)[12:]. Exist tells whether
+// it is occupied already.
+func PredictCreate2Address(deployer types.Address, salt types.Hash, initCodeHash types.Hash) types.Address {
+	return crypto.CreateAddress2(deployer, salt, initCodeHash[:])
+}
+
 // Empty returns whether the given account is empty. Empty
 // is defined according to EIP161 (balance = nonce = code = 0).
 func (s *StateDB) Empty(addr types.Address) bool {
@@ -395,19 +1339,176 @@ func (s *StateDB) Empty(addr types.Address) bool {
 	return obj == nil || obj.empty()
 }
 
-// GenerateRootHash calculate root hash
+// GenerateRootHash calculate root hash over the committed and pending state of
+// every account modified since the state was opened.
 func (s *StateDB) GenerateRootHash() types.Hash {
+	encodings := make(map[types.Address][]byte, len(s.stateObjectsDirty)+len(s.journal.dirties))
+	for addr := range s.stateObjectsDirty {
+		s.encodeForRoot(encodings, addr)
+	}
+	for addr := range s.journal.dirties {
+		s.encodeForRoot(encodings, addr)
+	}
+	return hashEncodings(encodings)
+}
+
+// IntermediateRootIncremental returns the same root as IntermediateRoot, but
+// only encodes again the accounts changed since its previous call, reusing the
+// cached encodings of the others. It is meant to be called after every
+// transaction, the cache being rebuilt from scratch after a commit.
+func (s *StateDB) IntermediateRootIncremental() types.Hash {
+	if s.rootJournal != s.journal || s.rootEncodings == nil {
+		s.rootJournal = s.journal
+		s.rootIndex = 0
+		s.rootEncodings = make(map[types.Address][]byte)
+		s.rootStale = make(map[types.Address]struct{})
+		for addr := range s.stateObjectsDirty {
+			s.encodeForRoot(s.rootEncodings, addr)
+		}
+	}
+	for i := s.rootIndex; i < s.journal.length(); i++ {
+		if addr := s.journal.entry(i).dirtied(); addr != nil {
+			s.rootStale[*addr] = struct{}{}
+		}
+	}
+	for addr := range s.rootStale {
+		delete(s.rootEncodings, addr)
+		_, dirty := s.journal.dirties[addr]
+		if _, committed := s.stateObjectsDirty[addr]; dirty || committed {
+			s.encodeForRoot(s.rootEncodings, addr)
+		}
+		delete(s.rootStale, addr)
+	}
+	s.rootIndex = s.journal.length()
+	return hashEncodings(s.rootEncodings)
+}
+
+// encodeForRoot adds the encoding of the account to the root encodings, unless
+// it doesn't exist.
+func (s *StateDB) encodeForRoot(encodings map[types.Address][]byte, addr types.Address) {
+	if obj := s.getDeletedStateObject(addr); obj != nil {
+		encodings[addr] = []byte(obj.ToProtoMessage().String())
+	}
+}
+
+// hashEncodings hashes the account encodings in address order.
+func hashEncodings(encodings map[types.Address][]byte) types.Hash {
+	addrs := make([]types.Address, 0, len(encodings))
+	for addr := range encodings {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
 	h := sha256.New()
-	for address, _ := range s.stateObjectsDirty {
-		obj, _ := s.getAccount(address)
-		h.Write([]byte(obj.ToProtoMessage().String()))
+	for _, addr := range addrs {
+		h.Write(encodings[addr])
 	}
 	return types.BytesToHash(h.Sum(nil))
 }
 
+// DirtyFingerprint returns a deterministic hash of the accounts modified since
+// the last commit and of their current fields and non-empty dirty slots. Two
+// sets of changes leading to the same modified state have the same fingerprint,
+// whatever the order they were applied in.
+func (s *StateDB) DirtyFingerprint() types.Hash {
+	encodings := make(map[types.Address][]byte, len(s.stateObjectsDirty)+len(s.journal.dirties))
+	for addr := range s.stateObjectsDirty {
+		encodings[addr] = s.encodeForFingerprint(addr)
+	}
+	for addr := range s.journal.dirties {
+		encodings[addr] = s.encodeForFingerprint(addr)
+	}
+	return hashEncodings(encodings)
+}
+
+// encodeForFingerprint encodes the fields and the non-empty dirty slots of the
+// account in key order, or a single zero byte if it doesn't exist.
+func (s *StateDB) encodeForFingerprint(addr types.Address) []byte {
+	obj := s.getStateObject(addr)
+	if obj == nil {
+		return []byte{0}
+	}
+	nonce, balance, suicided := nonceWord(obj.Nonce()), balanceWord(obj.Balance()), byte(0)
+	if obj.suicided {
+		suicided = 1
+	}
+	enc := append([]byte{1, suicided}, nonce[:]...)
+	enc = append(enc, balance[:]...)
+	codeHash := types.BytesToHash(obj.CodeHash())
+	enc = append(enc, codeHash[:]...)
+
+	keys := make([]types.Hash, 0, len(obj.dirtyStorage))
+	for key, value := range obj.dirtyStorage {
+		if value != (types.Hash{}) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	for _, key := range keys {
+		value := obj.dirtyStorage[key]
+		enc = append(enc, key[:]...)
+		enc = append(enc, value[:]...)
+	}
+	return enc
+}
+
 func (s *StateDB) Prepare(thash types.Hash, ti int) {
 	s.txHash = thash
 	s.txIndex = ti
+	s.refund = 0
+	if s.slotWrites != nil {
+		s.slotWrites = make(map[types.Address]map[types.Hash]int)
+	}
+	s.accessTrace = nil
+	s.policyErr = nil
+	s.transientStorage = nil
+	if s.transientStats != nil {
+		s.transientStats = new(TransientAccessStats)
+	}
+	s.txStartBalances = nil
+	s.journal.startTx()
+	for _, addr := range s.newContracts {
+		if obj := s.stateObjects[addr]; obj != nil {
+			obj.newContract = false
+		}
+	}
+	s.newContracts = nil
+}
+
+// ChangePolicy vets a balance, code or storage change before it is applied,
+// returning an error to reject it. The change carries the proposed value.
+type ChangePolicy func(change AccessRecord) error
+
+// SetChangePolicy installs the policy vetting the state changes, nil to accept
+// them all. Rejected changes are not applied and the first rejection of the
+// transaction is reported by PolicyError, in which case the caller must revert
+// the transaction.
+func (s *StateDB) SetChangePolicy(policy ChangePolicy) {
+	s.policy = policy
+}
+
+// PolicyError returns the first change rejected by the change policy since the
+// current transaction was prepared.
+func (s *StateDB) PolicyError() error {
+	return s.policyErr
+}
+
+// allowed reports whether the change policy accepts the change, remembering
+// the rejection otherwise.
+func (s *StateDB) allowed(op AccessOp, addr types.Address, key types.Hash, value types.Hash) bool {
+	if s.policy == nil {
+		return true
+	}
+	if err := s.policy(AccessRecord{Op: op, Address: addr, Key: key, Value: value}); err != nil {
+		if s.policyErr == nil {
+			s.policyErr = err
+		}
+		return false
+	}
+	return true
 }
 
 func (s *StateDB) TxIndex() int {
@@ -415,40 +1516,58 @@ func (s *StateDB) TxIndex() int {
 }
 
 func (s *StateDB) PrepareAccessList(sender types.Address, dst *types.Address, precompiles []types.Address, list transaction.AccessList) {
-	// Clear out any leftover from previous executions
+	// Clear out any leftover from previous executions. The list is filled
+	// directly, a single entry journalling the replaced one, while the adds of
+	// the execution are journalled one by one.
+	s.journal.append(accessListPrepareChange{prev: s.accessList})
 	s.accessList = newAccessList()
 
-	s.AddAddressToAccessList(sender)
+	s.accessList.AddAddress(sender)
 	if dst != nil {
-		s.AddAddressToAccessList(*dst)
+		s.accessList.AddAddress(*dst)
 		// If it's a create-tx, the destination will be added inside evm.create
 	}
 	for _, addr := range precompiles {
-		s.AddAddressToAccessList(addr)
+		s.accessList.AddAddress(addr)
 	}
 	for _, el := range list {
-		s.AddAddressToAccessList(el.Address)
+		s.accessList.AddAddress(el.Address)
 		for _, key := range el.StorageKeys {
-			s.AddSlotToAccessList(el.Address, key)
+			s.accessList.AddSlot(el.Address, key)
+		}
+	}
+	// The recording of the accesses starts after the list is prepared
+	if s.accessUsage != nil {
+		s.accessUsage = newAccessUsage()
+		s.accessUsage.warm[sender] = struct{}{}
+		if dst != nil {
+			s.accessUsage.warm[*dst] = struct{}{}
+		}
+		for _, addr := range precompiles {
+			s.accessUsage.warm[addr] = struct{}{}
 		}
 	}
 }
 
 func (s *StateDB) AddressInAccessList(addr types.Address) bool {
+	s.recordAccess(addr, nil)
 	return s.accessList.ContainsAddress(addr)
 }
 
 func (s *StateDB) SlotInAccessList(addr types.Address, slot types.Hash) (addressOk bool, slotOk bool) {
+	s.recordAccess(addr, &slot)
 	return s.accessList.Contains(addr, slot)
 }
 
 func (s *StateDB) AddAddressToAccessList(addr types.Address) {
+	s.recordAccess(addr, nil)
 	if s.accessList.AddAddress(addr) {
 		s.journal.append(accessListAddAccountChange{&addr})
 	}
 }
 
 func (s *StateDB) AddSlotToAccessList(addr types.Address, slot types.Hash) {
+	s.recordAccess(addr, &slot)
 	addrMod, slotMod := s.accessList.AddSlot(addr, slot)
 	if addrMod {
 		s.journal.append(accessListAddAccountChange{&addr})
@@ -469,6 +1588,7 @@ func (s *StateDB) AddLog(log *block.Log) {
 	log.Index = s.logSize
 	s.logs[s.txHash] = append(s.logs[s.txHash], log)
 	s.logSize++
+	s.receiptsRoot = nil
 }
 
 func (s *StateDB) GetLogs(hash types.Hash, blockHash types.Hash) []*block.Log {
@@ -479,6 +1599,17 @@ func (s *StateDB) GetLogs(hash types.Hash, blockHash types.Hash) []*block.Log {
 	return logs
 }
 
+// TxLogs returns the logs recorded so far by the given transaction, in emission
+// order and reflecting any revert. Contrary to GetLogs, the logs are returned
+// untouched and an empty slice is returned for an unknown transaction.
+func (s *StateDB) TxLogs(txHash types.Hash) []*block.Log {
+	logs := s.logs[txHash]
+	return append(make([]*block.Log, 0, len(logs)), logs...)
+}
+
+// Error returns the first database error met by the StateDB, such as a corrupt
+// account or storage read as empty. The state is unreliable once it is set and
+// the caller should abort the execution.
 func (s *StateDB) Error() error {
 	return s.dbErr
 }
@@ -24,6 +24,7 @@ import (
 	"github.com/amazechain/amc/common/types"
 	"github.com/amazechain/amc/utils"
 	"github.com/gogo/protobuf/proto"
+	"sort"
 )
 
 var (
@@ -79,9 +80,10 @@ type stateObject struct {
 	dirtyStorage Storage // Storage
 	fakeStorage  Storage // Fake storage which constructed by caller for debugging purpose.
 
-	dirtyCode bool
-	suicided  bool
-	deleted   bool
+	dirtyCode   bool
+	suicided    bool
+	deleted     bool
+	newContract bool // Whether the account was created as a contract by the current transaction
 }
 
 // empty returns whether the account is considered empty.
@@ -130,12 +132,19 @@ func (s *stateObject) ToProtoMessage() proto.Message {
 	bpAccount.Code = s.code
 	bpAccount.State = make([]*state.HashMap, 0, len(s.dirtyStorage))
 	for k, v := range s.dirtyStorage {
+		if v == (types.Hash{}) && s.db != nil && s.db.pruneSlots {
+			continue
+		}
 		bpAccount.State = append(bpAccount.State, &state.HashMap{
 			Key:   k,
 			Value: v,
 		})
 		//log.Infof("save addr %s, state key: %s, value %s", s.address.String(), k.String(), v.String())
 	}
+	// Keep the encoding deterministic, as it is hashed into the state root
+	sort.Slice(bpAccount.State, func(i, j int) bool {
+		return bytes.Compare(bpAccount.State[i].Key[:], bpAccount.State[j].Key[:]) < 0
+	})
 
 	return &bpAccount
 }
@@ -229,6 +238,7 @@ func (s *stateObject) SetState(db db.IDatabase, key, value types.Hash) {
 		key:      key,
 		prevalue: prev,
 	})
+	s.db.countSlotWrite(s.address, key)
 
 	s.setState(key, value)
 }
@@ -248,6 +258,22 @@ func (s *stateObject) setState(key, value types.Hash) {
 	s.dirtyStorage[key] = value
 }
 
+// storageSize returns the number of non-zero storage slots of the account,
+// pending changes included.
+func (s *stateObject) storageSize() int {
+	storage := s.dirtyStorage
+	if s.fakeStorage != nil {
+		storage = s.fakeStorage
+	}
+	var size int
+	for _, value := range storage {
+		if value != (types.Hash{}) {
+			size++
+		}
+	}
+	return size
+}
+
 // UpdateRoot sets the tree root to the current root hash of
 func (s *stateObject) updateRoot(db db.IDatabase) {
 
@@ -273,6 +299,7 @@ func (s *stateObject) SubBalance(amount types.Int256) {
 }
 
 func (s *stateObject) SetBalance(amount types.Int256) {
+	s.db.keepTxStartBalance(s.address, s.data.Balance)
 	s.db.journal.append(balanceChange{
 		account: &s.address,
 		prev:    s.data.Balance,
@@ -292,6 +319,7 @@ func (s *stateObject) deepCopy(db *StateDB) *stateObject {
 	stateObject.suicided = s.suicided
 	stateObject.dirtyCode = s.dirtyCode
 	stateObject.deleted = s.deleted
+	stateObject.newContract = s.newContract
 	return stateObject
 }
 
@@ -342,11 +370,23 @@ func (s *stateObject) setCode(codeHash types.Hash, code []byte) {
 	s.dirtyCode = true
 }
 
+// SetNonce updates the account nonce. Sequential increments not separated by a
+// snapshot share a single journal entry, as reverting the first one already
+// restores the nonce in effect before all of them.
 func (s *stateObject) SetNonce(nonce uint64) {
-	s.db.journal.append(nonceChange{
-		account: &s.address,
-		prev:    s.data.Nonce,
-	})
+	if nonce != s.data.Nonce+1 || !s.db.journal.lastNonceChange(s.address, s.db.revisionBoundary()) {
+		s.db.journal.append(nonceChange{
+			account: &s.address,
+			prev:    s.data.Nonce,
+		})
+	} else {
+		// The coalesced change adds no entry reporting the account, nor
+		// any the journal hooks would observe
+		s.db.markRootStale(s.address)
+		if hook := s.db.journal.hook; hook != nil {
+			hook(nonceChange{account: &s.address, prev: s.data.Nonce})
+		}
+	}
 	s.setNonce(nonce)
 }
 
@@ -0,0 +1,2047 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amazechain/amc/api/protocol/state"
+	"github.com/amazechain/amc/common/block"
+	"github.com/amazechain/amc/common/crypto"
+	"github.com/amazechain/amc/common/transaction"
+	"github.com/amazechain/amc/common/types"
+	"github.com/amazechain/amc/internal/amcdb/memdb"
+	"github.com/amazechain/amc/internal/avm/rlp"
+	kvmemdb "github.com/amazechain/amc/internal/kv/memdb"
+	"github.com/amazechain/amc/utils"
+	"github.com/gogo/protobuf/proto"
+	"math/big"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestStateDB creates an empty in-memory state database.
+func newTestStateDB() *StateDB {
+	return NewMemoryStateDB()
+}
+
+// addTestAccount seeds a clean account, as if it was loaded from the database.
+func addTestAccount(s *StateDB, addr types.Address, balance uint64) {
+	s.setStateObject(newObject(s, addr, StateAccount{Balance: types.NewInt64(balance)}))
+}
+
+func testAddress(i int) types.Address {
+	return types.BytesToAddress([]byte{byte(i >> 8), byte(i)})
+}
+
+func TestPinnedObjectSurvivesEviction(t *testing.T) {
+	s := newTestStateDB()
+	s.SetObjectCacheLimit(4)
+
+	coinbase := testAddress(1000)
+	addTestAccount(s, coinbase, 1)
+	s.Pin(coinbase)
+	for i := 0; i < 32; i++ {
+		addTestAccount(s, testAddress(i), 1)
+	}
+	if _, ok := s.stateObjects[coinbase]; !ok {
+		t.Fatal("pinned account was evicted")
+	}
+	if _, ok := s.stateObjects[testAddress(0)]; ok {
+		t.Error("unpinned account survived cache churn")
+	}
+	if len(s.stateObjects) > 4 {
+		t.Errorf("cache exceeds limit: have %d, want %d", len(s.stateObjects), 4)
+	}
+
+	s.Unpin(coinbase)
+	for i := 32; i < 64; i++ {
+		addTestAccount(s, testAddress(i), 1)
+	}
+	if _, ok := s.stateObjects[coinbase]; ok {
+		t.Error("unpinned account survived cache churn")
+	}
+}
+
+func TestHotSlots(t *testing.T) {
+	s := newTestStateDB()
+	s.SetSlotWriteTracking(true)
+
+	addr := testAddress(1)
+	addTestAccount(s, addr, 0)
+	s.Prepare(types.Hash{1}, 0)
+
+	hot, cold := types.Hash{0xaa}, types.Hash{0xbb}
+	for i := 1; i <= 50; i++ {
+		s.SetState(addr, hot, types.BytesToHash([]byte{byte(i)}))
+	}
+	s.SetState(addr, cold, types.Hash{1})
+
+	slots := s.HotSlots(1)
+	if len(slots) != 1 {
+		t.Fatalf("hot slot count mismatch: have %d, want %d", len(slots), 1)
+	}
+	if slots[0].Address != addr || slots[0].Key != hot || slots[0].Writes != 50 {
+		t.Errorf("hot slot mismatch: have %+v", slots[0])
+	}
+	if slots := s.HotSlots(10); len(slots) != 2 {
+		t.Errorf("slot count mismatch: have %d, want %d", len(slots), 2)
+	}
+
+	s.Prepare(types.Hash{2}, 1)
+	if slots := s.HotSlots(10); len(slots) != 0 {
+		t.Errorf("counters not reset at prepare: have %d slots", len(slots))
+	}
+}
+
+func TestSequentialNonceCoalescing(t *testing.T) {
+	s := newTestStateDB()
+	sender := testAddress(1)
+	addTestAccount(s, sender, 0)
+
+	var snapshot int
+	for i := 0; i < 100; i++ {
+		s.Prepare(types.BytesToHash([]byte{byte(i)}), i)
+		if i == 50 {
+			snapshot = s.Snapshot()
+		}
+		s.SetNonce(sender, s.GetNonce(sender)+1)
+		if nonce := s.GetNonce(sender); nonce != uint64(i+1) {
+			t.Fatalf("tx %d: nonce mismatch: have %d, want %d", i, nonce, i+1)
+		}
+	}
+	if have := s.journal.length(); have != 2 {
+		t.Errorf("journal length mismatch: have %d, want %d", have, 2)
+	}
+	s.RevertToSnapshot(snapshot)
+	if nonce := s.GetNonce(sender); nonce != 50 {
+		t.Errorf("nonce mismatch after revert: have %d, want %d", nonce, 50)
+	}
+	s.journal.revert(s, 0)
+	if nonce := s.GetNonce(sender); nonce != 0 {
+		t.Errorf("nonce mismatch after full revert: have %d, want %d", nonce, 0)
+	}
+}
+
+func TestIntermediateRootIncrementalCoalescedNonce(t *testing.T) {
+	s := newTestStateDB()
+	sender := testAddress(1)
+	addTestAccount(s, sender, 100)
+
+	s.Prepare(types.Hash{1}, 0)
+	s.SetNonce(sender, 1)
+	if have, want := s.IntermediateRootIncremental(), s.IntermediateRoot(); have != want {
+		t.Fatalf("root mismatch after the first nonce: have %x, want %x", have, want)
+	}
+	// The second nonce is coalesced into the entry the last root covered
+	s.SetNonce(sender, 2)
+	if have := s.journal.length(); have != 1 {
+		t.Fatalf("nonce changes not coalesced: %d entries", have)
+	}
+	if have, want := s.IntermediateRootIncremental(), s.IntermediateRoot(); have != want {
+		t.Errorf("root mismatch after the coalesced nonce: have %x, want %x", have, want)
+	}
+}
+
+func TestStorageSize(t *testing.T) {
+	s := newTestStateDB()
+	addr := testAddress(1)
+	addTestAccount(s, addr, 0)
+
+	for i := 1; i <= 3; i++ {
+		s.SetState(addr, types.BytesToHash([]byte{byte(i)}), types.Hash{1})
+	}
+	if size := s.StorageSize(addr); size != 3 {
+		t.Errorf("storage size mismatch: have %d, want %d", size, 3)
+	}
+	snapshot := s.Snapshot()
+	s.SetState(addr, types.BytesToHash([]byte{1}), types.Hash{})
+	if size := s.StorageSize(addr); size != 2 {
+		t.Errorf("storage size mismatch after clearing: have %d, want %d", size, 2)
+	}
+	s.RevertToSnapshot(snapshot)
+	if size := s.StorageSize(addr); size != 3 {
+		t.Errorf("storage size mismatch after revert: have %d, want %d", size, 3)
+	}
+}
+
+func TestAccessTrace(t *testing.T) {
+	s := newTestStateDB()
+	s.SetAccessTracing(true)
+
+	from, to := testAddress(1), testAddress(2)
+	addTestAccount(s, from, 100)
+	addTestAccount(s, to, 0)
+	s.Prepare(types.Hash{1}, 0)
+
+	slot := types.Hash{0xaa}
+	s.GetBalance(from)
+	s.SubBalance(from, types.NewInt64(40))
+	s.AddBalance(to, types.NewInt64(40))
+	s.GetState(to, slot)
+	s.SetState(to, slot, types.Hash{7})
+	s.SetNonce(from, 1)
+
+	want := []AccessRecord{
+		{Op: BalanceRead, Address: from, Value: balanceWord(types.NewInt64(100))},
+		{Op: BalanceWrite, Address: from, Value: balanceWord(types.NewInt64(60))},
+		{Op: BalanceWrite, Address: to, Value: balanceWord(types.NewInt64(40))},
+		{Op: StorageRead, Address: to, Key: slot},
+		{Op: StorageWrite, Address: to, Key: slot, Value: types.Hash{7}},
+		{Op: NonceWrite, Address: from, Value: nonceWord(1)},
+	}
+	trace := s.AccessTrace()
+	if len(trace) != len(want) {
+		t.Fatalf("trace length mismatch: have %d, want %d", len(trace), len(want))
+	}
+	for i := range want {
+		if trace[i] != want[i] {
+			t.Errorf("record %d mismatch: have %+v, want %+v", i, trace[i], want[i])
+		}
+	}
+	s.Prepare(types.Hash{2}, 1)
+	if len(s.AccessTrace()) != 0 {
+		t.Error("trace not reset at prepare")
+	}
+}
+
+// dumpState renders the state of the given accounts and storage slots.
+func dumpState(s *StateDB, addrs []types.Address, keys []types.Hash) string {
+	var b strings.Builder
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, "%x: exist %v empty %v balance %v nonce %d code %x\n",
+			addr, s.Exist(addr), s.Empty(addr), s.GetBalance(addr), s.GetNonce(addr), s.GetCode(addr))
+		for _, key := range keys {
+			if value := s.GetState(addr, key); value != (types.Hash{}) {
+				fmt.Fprintf(&b, "  %x: %x\n", key, value)
+			}
+		}
+	}
+	fmt.Fprintf(&b, "refund %d\n", s.GetRefund())
+	return b.String()
+}
+
+func TestMemoryStateDBConformance(t *testing.T) {
+	var (
+		addrs = []types.Address{testAddress(1), testAddress(2), testAddress(3)}
+		keys  = []types.Hash{{1}, {2}}
+	)
+	run := func(s *StateDB) []string {
+		var dumps []string
+		checkpoint := func() { dumps = append(dumps, dumpState(s, addrs, keys)) }
+
+		checkpoint()
+		s.AddBalance(addrs[0], types.NewInt64(100))
+		s.SetNonce(addrs[0], 1)
+		s.SetState(addrs[0], keys[0], types.Hash{0xaa})
+		checkpoint()
+
+		outer := s.Snapshot()
+		s.SubBalance(addrs[0], types.NewInt64(30))
+		s.AddBalance(addrs[1], types.NewInt64(30))
+		s.SetCode(addrs[1], []byte{0x60, 0x00})
+		s.SetState(addrs[1], keys[1], types.Hash{0xbb})
+		s.AddRefund(10)
+		checkpoint()
+
+		inner := s.Snapshot()
+		s.CreateAccount(addrs[2])
+		s.SetState(addrs[0], keys[0], types.Hash{})
+		s.Suicide(addrs[1])
+		checkpoint()
+
+		s.RevertToSnapshot(inner)
+		checkpoint()
+		s.RevertToSnapshot(outer)
+		checkpoint()
+		return dumps
+	}
+	memory := run(NewMemoryStateDB())
+	backed := run(NewStateDB(types.Hash{}, memdb.NewMemDB(), kvmemdb.NewTestDB(t)))
+	for i := range backed {
+		if memory[i] != backed[i] {
+			t.Errorf("checkpoint %d mismatch:\nmemory:\n%s\ndatabase:\n%s", i, memory[i], backed[i])
+		}
+	}
+}
+
+func TestTxLogs(t *testing.T) {
+	s := newTestStateDB()
+	tx1, tx2 := types.Hash{1}, types.Hash{2}
+
+	s.Prepare(tx1, 0)
+	s.AddLog(&block.Log{Data: []byte{1}})
+	s.AddLog(&block.Log{Data: []byte{2}})
+	s.Prepare(tx2, 1)
+	s.AddLog(&block.Log{Data: []byte{3}})
+	snapshot := s.Snapshot()
+	s.AddLog(&block.Log{Data: []byte{4}})
+	s.RevertToSnapshot(snapshot)
+
+	for _, tt := range []struct {
+		tx   types.Hash
+		data []byte
+	}{
+		{tx1, []byte{1, 2}},
+		{tx2, []byte{3}},
+		{types.Hash{3}, []byte{}},
+	} {
+		logs := s.TxLogs(tt.tx)
+		if logs == nil || len(logs) != len(tt.data) {
+			t.Fatalf("tx %x: log count mismatch: have %d, want %d", tt.tx, len(logs), len(tt.data))
+		}
+		for i, log := range logs {
+			if log.TxHash != tt.tx || log.Data[0] != tt.data[i] {
+				t.Errorf("tx %x: log %d mismatch: have %x from %x", tt.tx, i, log.Data, log.TxHash)
+			}
+		}
+	}
+}
+
+func TestGenerateRootHashDeterministic(t *testing.T) {
+	build := func(order []int) *StateDB {
+		s := newTestStateDB()
+		for _, i := range order {
+			s.AddBalance(testAddress(i), types.NewInt64(int64(1000+i)))
+			s.SetState(testAddress(i), types.Hash{byte(i)}, types.Hash{1})
+			s.SetState(testAddress(i), types.Hash{byte(i + 1)}, types.Hash{2})
+		}
+		return s
+	}
+	a, b := build([]int{0, 1, 2, 3, 4, 5, 6, 7}), build([]int{7, 3, 5, 1, 0, 6, 2, 4})
+	if have, want := a.IntermediateRoot(), b.IntermediateRoot(); have != want {
+		t.Fatalf("pending root depends on the modification order: have %x, want %x", have, want)
+	}
+	// Pending changes are covered by the root
+	root := a.IntermediateRoot()
+	a.SetBalance(testAddress(0), types.NewInt64(1))
+	if a.IntermediateRoot() == root {
+		t.Errorf("pending balance change not covered by the root")
+	}
+	if _, err := a.Commit(types.NewInt64(1)); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	if _, err := b.Commit(types.NewInt64(1)); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	b.SetBalance(testAddress(0), types.NewInt64(1))
+	if have, want := a.IntermediateRoot(), b.IntermediateRoot(); have != want {
+		t.Errorf("committed root depends on the modification order: have %x, want %x", have, want)
+	}
+}
+
+func TestIntermediateRootIncremental(t *testing.T) {
+	s := newTestStateDB()
+	for i := 0; i < 8; i++ {
+		s.AddBalance(testAddress(i), types.NewInt64(1000))
+	}
+	if _, err := s.Commit(types.NewInt64(1)); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	check := func(step string) {
+		t.Helper()
+		if have, want := s.IntermediateRootIncremental(), s.IntermediateRoot(); have != want {
+			t.Fatalf("%s: root mismatch: have %x, want %x", step, have, want)
+		}
+	}
+	check("committed")
+	for i := 0; i < 16; i++ {
+		from, to := testAddress(i%8), testAddress(8+i%3)
+		s.Prepare(types.BytesToHash([]byte{byte(i)}), i)
+		snapshot := s.Snapshot()
+		s.SubBalance(from, types.NewInt64(10))
+		s.AddBalance(to, types.NewInt64(10))
+		s.SetState(to, types.Hash{byte(i)}, types.Hash{1})
+		check(fmt.Sprintf("tx %d", i))
+		if i%3 == 0 {
+			// Revert changes already covered by the previous root
+			s.RevertToSnapshot(snapshot)
+			check(fmt.Sprintf("tx %d reverted", i))
+		}
+		s.SetNonce(from, s.GetNonce(from)+1)
+		s.SetCode(from, []byte{byte(i)})
+		check(fmt.Sprintf("tx %d finalised", i))
+	}
+	if _, err := s.Commit(types.NewInt64(2)); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	check("recommitted")
+}
+
+// benchmarkRoot measures computing the root after each transaction of a block
+// transferring between a few of many committed accounts.
+func benchmarkRoot(b *testing.B, root func(s *StateDB) types.Hash) {
+	s := newTestStateDB()
+	for i := 0; i < 1000; i++ {
+		s.AddBalance(testAddress(i), types.NewInt64(1000000))
+	}
+	if _, err := s.Commit(types.NewInt64(1)); err != nil {
+		b.Fatalf("failed to commit state: %v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Prepare(types.BytesToHash([]byte{byte(i >> 8), byte(i)}), i)
+		s.SubBalance(testAddress(i%1000), types.NewInt64(1))
+		s.AddBalance(testAddress((i+1)%1000), types.NewInt64(1))
+		root(s)
+	}
+}
+
+func BenchmarkIntermediateRoot(b *testing.B) {
+	benchmarkRoot(b, (*StateDB).IntermediateRoot)
+}
+
+func BenchmarkIntermediateRootIncremental(b *testing.B) {
+	benchmarkRoot(b, (*StateDB).IntermediateRootIncremental)
+}
+
+func TestSetStateBatch(t *testing.T) {
+	s := newTestStateDB()
+	addr := testAddress(1)
+	addTestAccount(s, addr, 0)
+
+	a, b, c := types.Hash{1}, types.Hash{2}, types.Hash{3}
+	s.SetState(addr, a, types.Hash{0xa})
+
+	snapshot := s.Snapshot()
+	s.SetStateBatch(addr, map[types.Hash]types.Hash{a: {0x1a}, b: {0x1b}, c: {0x1c}})
+	for key, want := range map[types.Hash]types.Hash{a: {0x1a}, b: {0x1b}, c: {0x1c}} {
+		if have := s.GetState(addr, key); have != want {
+			t.Errorf("slot %x mismatch after batch: have %x, want %x", key, have, want)
+		}
+	}
+	inner := s.Snapshot()
+	s.SetState(addr, b, types.Hash{0x2b})
+	s.RevertToSnapshot(inner)
+	if have := s.GetState(addr, b); have != (types.Hash{0x1b}) {
+		t.Errorf("slot %x mismatch after single write revert: have %x, want %x", b, have, types.Hash{0x1b})
+	}
+	s.RevertToSnapshot(snapshot)
+	for key, want := range map[types.Hash]types.Hash{a: {0xa}, b: {}, c: {}} {
+		if have := s.GetState(addr, key); have != want {
+			t.Errorf("slot %x mismatch after batch revert: have %x, want %x", key, have, want)
+		}
+	}
+}
+
+func TestForEachContract(t *testing.T) {
+	s := newTestStateDB()
+	contracts := map[types.Address][]byte{
+		testAddress(2): {0x60, 0x00},
+		testAddress(4): {0x60, 0x01},
+	}
+	for i := 1; i <= 5; i++ {
+		s.AddBalance(testAddress(i), types.NewInt64(1))
+	}
+	for addr, code := range contracts {
+		s.SetCode(addr, code)
+	}
+	if _, err := s.Commit(types.NewInt64(1)); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	// Pending code is not visited until committed
+	s.SetCode(testAddress(5), []byte{0x60, 0x02})
+
+	var visited []types.Address
+	s.ForEachContract(func(addr types.Address, codeHash types.Hash) bool {
+		if want := types.BytesToHash(utils.Keccak256(contracts[addr])); codeHash != want {
+			t.Errorf("code hash mismatch for %x: have %x, want %x", addr, codeHash, want)
+		}
+		visited = append(visited, addr)
+		return true
+	})
+	if err := s.Error(); err != nil {
+		t.Fatalf("failed to iterate contracts: %v", err)
+	}
+	if len(visited) != 2 || visited[0] != testAddress(2) || visited[1] != testAddress(4) {
+		t.Errorf("visited contracts mismatch: have %x", visited)
+	}
+
+	visited = visited[:0]
+	s.ForEachContract(func(addr types.Address, codeHash types.Hash) bool {
+		visited = append(visited, addr)
+		return false
+	})
+	if len(visited) != 1 {
+		t.Errorf("iteration not stopped: visited %d contracts", len(visited))
+	}
+}
+
+func TestDump(t *testing.T) {
+	build := func(order []int) *StateDB {
+		s := newTestStateDB()
+		for _, i := range order {
+			s.AddBalance(testAddress(i), types.NewInt64(uint64(i)))
+			s.SetState(testAddress(i), types.Hash{byte(i)}, types.Hash{1})
+			s.SetState(testAddress(i), types.Hash{0xff}, types.Hash{2})
+		}
+		if _, err := s.Commit(types.NewInt64(1)); err != nil {
+			t.Fatalf("failed to commit state: %v", err)
+		}
+		return s
+	}
+	a, b := build([]int{3, 1, 2}), build([]int{2, 3, 1})
+	// Pending changes are part of the dump too
+	a.SetNonce(testAddress(4), 1)
+	b.SetNonce(testAddress(4), 1)
+
+	opts := DumpOptions{IncludeCode: true, IncludeStorage: true}
+	dumpA, err := a.Dump(opts)
+	if err != nil {
+		t.Fatalf("failed to dump state: %v", err)
+	}
+	dumpB, err := b.Dump(opts)
+	if err != nil {
+		t.Fatalf("failed to dump state: %v", err)
+	}
+	if string(dumpA) != string(dumpB) {
+		t.Fatalf("dumps differ:\n%s\n%s", dumpA, dumpB)
+	}
+	var dump StateDump
+	if err := json.Unmarshal(dumpA, &dump); err != nil {
+		t.Fatalf("failed to decode dump: %v", err)
+	}
+	if len(dump.Accounts) != 4 || dump.Next != nil {
+		t.Fatalf("account count mismatch: have %d, want %d", len(dump.Accounts), 4)
+	}
+	for i, account := range dump.Accounts {
+		if account.Address != testAddress(i+1) {
+			t.Errorf("account %d address mismatch: have %x, want %x", i, account.Address, testAddress(i+1))
+		}
+	}
+	if storage := dump.Accounts[0].Storage; len(storage) != 2 || storage[types.Hash{1}] != (types.Hash{1}) {
+		t.Errorf("storage mismatch: have %v", storage)
+	}
+
+	page, err := a.Dump(DumpOptions{Start: testAddress(2), Max: 2})
+	if err != nil {
+		t.Fatalf("failed to dump state page: %v", err)
+	}
+	dump = StateDump{}
+	if err := json.Unmarshal(page, &dump); err != nil {
+		t.Fatalf("failed to decode dump page: %v", err)
+	}
+	if len(dump.Accounts) != 2 || dump.Accounts[0].Address != testAddress(2) || dump.Next == nil || *dump.Next != testAddress(4) {
+		t.Errorf("page mismatch: %s", page)
+	}
+	if dump.Accounts[0].Storage != nil {
+		t.Error("storage dumped without being requested")
+	}
+}
+
+func TestPredictCreate2Address(t *testing.T) {
+	// Test vectors from EIP-1014
+	for i, tt := range []struct {
+		deployer string
+		salt     string
+		initCode string
+		want     string
+	}{
+		{"0x0000000000000000000000000000000000000000", "0x0000000000000000000000000000000000000000000000000000000000000000", "00", "0x4D1A2e2bB4F88F0250f26Ffff098B0b30B26BF38"},
+		{"0xdeadbeef00000000000000000000000000000000", "0x0000000000000000000000000000000000000000000000000000000000000000", "00", "0xB928f69Bb1D91Cd65274e3c79d8986362984fDA3"},
+		{"0xdeadbeef00000000000000000000000000000000", "0x000000000000000000000000feed000000000000000000000000000000000000", "00", "0xD04116cDd17beBE565EB2422F2497E06cC1C9833"},
+		{"0x0000000000000000000000000000000000000000", "0x0000000000000000000000000000000000000000000000000000000000000000", "deadbeef", "0x70f2b2914A2a4b783FaEFb75f459A580616Fcb5e"},
+		{"0x00000000000000000000000000000000deadbeef", "0x00000000000000000000000000000000000000000000000000000000cafebabe", "deadbeef", "0x60f3f640a8508fC6a86d45DF051962668E1e8AC7"},
+		{"0x0000000000000000000000000000000000000000", "0x0000000000000000000000000000000000000000000000000000000000000000", "", "0xE33C0C7F7df4809055C3ebA6c09CFe4BaF1BD9e0"},
+	} {
+		initCode, err := hex.DecodeString(tt.initCode)
+		if err != nil {
+			t.Fatalf("vector %d: invalid init code: %v", i, err)
+		}
+		addr := PredictCreate2Address(types.HexToAddress(tt.deployer), types.HexToHash(tt.salt), types.BytesToHash(utils.Keccak256(initCode)))
+		if want := types.HexToAddress(tt.want); addr != want {
+			t.Errorf("vector %d: address mismatch: have %x, want %x", i, addr, want)
+		}
+	}
+
+	s := newTestStateDB()
+	deployer, salt, codeHash := testAddress(1), types.Hash{1}, types.BytesToHash(utils.Keccak256([]byte{0x60, 0x00}))
+	addr := PredictCreate2Address(deployer, salt, codeHash)
+	if s.Exist(addr) {
+		t.Fatal("predicted address occupied before deployment")
+	}
+	s.CreateAccount(addr)
+	if !s.Exist(addr) {
+		t.Error("predicted address not occupied after deployment")
+	}
+}
+
+func TestJournalSpill(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStateDB()
+	s.SetJournalSpill(8, dir)
+
+	addr := testAddress(1)
+	addTestAccount(s, addr, 0)
+	snapshots := make(map[int]int)
+	for i := 0; i < 100; i++ {
+		if i%10 == 0 {
+			snapshots[i] = s.Snapshot()
+		}
+		s.SetState(addr, types.Hash{byte(i % 16)}, types.BytesToHash([]byte{byte(i + 1)}))
+		s.AddBalance(addr, types.NewInt64(1))
+		if i == 40 {
+			s.SetCode(addr, []byte{0x60, 0x00})
+		}
+	}
+	if s.journal.spilled == 0 {
+		t.Fatal("journal not spilled")
+	}
+	if len(s.journal.entries) > 8 {
+		t.Errorf("in-memory journal exceeds threshold: have %d entries", len(s.journal.entries))
+	}
+	// expect returns the state after the first n writes
+	expect := func(n int) {
+		t.Helper()
+		for slot := 0; slot < 16; slot++ {
+			var want types.Hash
+			for i := 0; i < n; i++ {
+				if i%16 == slot {
+					want = types.BytesToHash([]byte{byte(i + 1)})
+				}
+			}
+			if have := s.GetState(addr, types.Hash{byte(slot)}); have != want {
+				t.Errorf("after %d writes: slot %d mismatch: have %x, want %x", n, slot, have, want)
+			}
+		}
+		if have := s.GetBalance(addr).Uint64(); have != uint64(n) {
+			t.Errorf("after %d writes: balance mismatch: have %d, want %d", n, have, n)
+		}
+		if have := s.GetCodeSize(addr); (n > 40) != (have != 0) {
+			t.Errorf("after %d writes: code size mismatch: have %d", n, have)
+		}
+	}
+	s.RevertToSnapshot(snapshots[90])
+	expect(90)
+	s.RevertToSnapshot(snapshots[50])
+	expect(50)
+
+	// Keep writing past the truncated log, then revert across it again
+	for i := 50; i < 70; i++ {
+		s.SetState(addr, types.Hash{byte(i % 16)}, types.BytesToHash([]byte{byte(i + 1)}))
+		s.AddBalance(addr, types.NewInt64(1))
+	}
+	expect(70)
+	s.RevertToSnapshot(snapshots[10])
+	expect(10)
+
+	if _, err := s.Commit(types.NewInt64(1)); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("spill log left behind: %d files", len(files))
+	}
+}
+
+func TestChangePolicy(t *testing.T) {
+	s := newTestStateDB()
+	from, sanctioned, other := testAddress(1), testAddress(2), testAddress(3)
+	addTestAccount(s, from, 100)
+
+	errSanctioned := errors.New("sanctioned recipient")
+	s.SetChangePolicy(func(change AccessRecord) error {
+		if change.Address == sanctioned {
+			return errSanctioned
+		}
+		return nil
+	})
+	transfer := func(to types.Address) error {
+		s.Prepare(types.BytesToHash(to[:]), 0)
+		snapshot := s.Snapshot()
+		s.SubBalance(from, types.NewInt64(10))
+		s.AddBalance(to, types.NewInt64(10))
+		if err := s.PolicyError(); err != nil {
+			s.RevertToSnapshot(snapshot)
+			return err
+		}
+		return nil
+	}
+	if err := transfer(sanctioned); err != errSanctioned {
+		t.Errorf("policy error mismatch: have %v, want %v", err, errSanctioned)
+	}
+	if balance := s.GetBalance(from).Uint64(); balance != 100 {
+		t.Errorf("sender balance mismatch after rejection: have %d, want %d", balance, 100)
+	}
+	if balance := s.GetBalance(sanctioned).Uint64(); balance != 0 {
+		t.Errorf("sanctioned balance mismatch: have %d, want %d", balance, 0)
+	}
+	if err := transfer(other); err != nil {
+		t.Fatalf("allowed transfer rejected: %v", err)
+	}
+	if balance := s.GetBalance(other).Uint64(); balance != 10 {
+		t.Errorf("recipient balance mismatch: have %d, want %d", balance, 10)
+	}
+}
+
+func TestDirtyFingerprint(t *testing.T) {
+	a, b := testAddress(1), testAddress(2)
+	key := types.BytesToHash([]byte{1})
+
+	first := newTestStateDB()
+	first.AddBalance(a, types.NewInt64(10))
+	first.SetNonce(a, 1)
+	first.SetState(b, key, types.BytesToHash([]byte{2}))
+	first.SetCode(b, []byte{0x60, 0x00})
+
+	second := newTestStateDB()
+	second.SetCode(b, []byte{0x60, 0x00})
+	second.SetState(b, key, types.BytesToHash([]byte{3}))
+	second.SetNonce(a, 1)
+	second.AddBalance(a, types.NewInt64(4))
+	second.SetState(b, key, types.BytesToHash([]byte{2}))
+	second.AddBalance(a, types.NewInt64(6))
+
+	if have, want := second.DirtyFingerprint(), first.DirtyFingerprint(); have != want {
+		t.Fatalf("fingerprint mismatch for equivalent changes: have %x, want %x", have, want)
+	}
+	second.AddBalance(a, types.NewInt64(1))
+	if second.DirtyFingerprint() == first.DirtyFingerprint() {
+		t.Fatal("fingerprint unchanged by a further change")
+	}
+}
+
+func TestCorruptAccountError(t *testing.T) {
+	s := newTestStateDB()
+	corrupt, missing := testAddress(1), testAddress(2)
+	// A length delimited field running past the end of the encoding
+	if err := s.store.WriteAccount(s.blockNr, corrupt, []byte{0x0a, 0x05, 0x01}); err != nil {
+		t.Fatalf("failed to write account: %v", err)
+	}
+	if value := s.GetState(missing, types.Hash{}); value != (types.Hash{}) {
+		t.Errorf("missing account state mismatch: have %x, want zero", value)
+	}
+	if err := s.Error(); err != nil {
+		t.Fatalf("missing account reported as an error: %v", err)
+	}
+	s.GetState(corrupt, types.Hash{})
+	if err := s.Error(); !errors.Is(err, errCorruptAccount) {
+		t.Fatalf("error mismatch: have %v, want %v", err, errCorruptAccount)
+	}
+}
+
+func TestResetAccountModified(t *testing.T) {
+	s := newTestStateDB()
+	addr, key := testAddress(1), types.BytesToHash([]byte{1})
+	s.AddBalance(addr, types.NewInt64(100))
+	if _, err := s.Commit(s.blockNr); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	s.AddBalance(addr, types.NewInt64(50))
+	s.SetState(addr, key, types.BytesToHash([]byte{2}))
+
+	snapshot := s.Snapshot()
+	s.ResetAccount(addr)
+	if balance := s.GetBalance(addr).Uint64(); balance != 100 {
+		t.Errorf("balance mismatch after reset: have %d, want %d", balance, 100)
+	}
+	if value := s.GetState(addr, key); value != (types.Hash{}) {
+		t.Errorf("storage mismatch after reset: have %x, want zero", value)
+	}
+	s.RevertToSnapshot(snapshot)
+	if balance := s.GetBalance(addr).Uint64(); balance != 150 {
+		t.Errorf("balance mismatch after reverting the reset: have %d, want %d", balance, 150)
+	}
+	if value := s.GetState(addr, key); value != types.BytesToHash([]byte{2}) {
+		t.Errorf("storage mismatch after reverting the reset: have %x, want %x", value, types.BytesToHash([]byte{2}))
+	}
+}
+
+func TestResetAccountCreated(t *testing.T) {
+	s := newTestStateDB()
+	addr := testAddress(1)
+	s.CreateAccount(addr)
+	s.AddBalance(addr, types.NewInt64(10))
+
+	snapshot := s.Snapshot()
+	s.ResetAccount(addr)
+	if s.Exist(addr) {
+		t.Fatal("created account still exists after reset")
+	}
+	s.RevertToSnapshot(snapshot)
+	if balance := s.GetBalance(addr).Uint64(); balance != 10 {
+		t.Errorf("balance mismatch after reverting the reset: have %d, want %d", balance, 10)
+	}
+	s.ResetAccount(addr)
+	if _, err := s.Commit(s.blockNr); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	if _, err := s.store.ReadAccount(s.blockNr, addr); err == nil {
+		t.Error("reset account committed")
+	}
+}
+
+func TestCodeValidation(t *testing.T) {
+	for _, validate := range []bool{false, true} {
+		s := newTestStateDB()
+		s.SetCodeValidation(validate)
+
+		addr := testAddress(1)
+		s.SetCode(addr, []byte{0x60, 0x00})
+		// Bypass SetCode to set a code hash not matching the code
+		s.getStateObject(addr).setCode(types.BytesToHash([]byte{1}), []byte{0x60, 0x01})
+
+		_, err := s.Commit(s.blockNr)
+		if validate && !errors.Is(err, errCodeHashMismatch) {
+			t.Errorf("validation enabled: error mismatch: have %v, want %v", err, errCodeHashMismatch)
+		}
+		if !validate && err != nil {
+			t.Errorf("validation disabled: failed to commit: %v", err)
+		}
+	}
+}
+
+func TestHasNetChanges(t *testing.T) {
+	s := newTestStateDB()
+	addr, key := testAddress(1), types.BytesToHash([]byte{1})
+	s.AddBalance(addr, types.NewInt64(100))
+	s.SetState(addr, key, types.BytesToHash([]byte{1}))
+
+	// Changing values back to the ones of the snapshot is a no-op
+	snapshot := s.Snapshot()
+	s.SetState(addr, key, types.BytesToHash([]byte{2}))
+	s.SetState(addr, key, types.BytesToHash([]byte{1}))
+	s.SubBalance(addr, types.NewInt64(10))
+	s.AddBalance(addr, types.NewInt64(10))
+	if s.HasNetChanges(snapshot) {
+		t.Error("set then unset changes reported as net changes")
+	}
+	s.SetNonce(addr, 1)
+	if !s.HasNetChanges(snapshot) {
+		t.Error("nonce change not reported as a net change")
+	}
+
+	snapshot = s.Snapshot()
+	s.AddBalance(addr, types.NewInt64(1))
+	if !s.HasNetChanges(snapshot) {
+		t.Error("balance change not reported as a net change")
+	}
+}
+
+func TestRefundLedger(t *testing.T) {
+	s := newTestStateDB()
+	tx1, tx2 := types.BytesToHash([]byte{1}), types.BytesToHash([]byte{2})
+
+	// The first refund is capped
+	s.Prepare(tx1, 0)
+	s.AddRefund(100)
+	if refund := s.FinaliseRefund(40); refund != 40 {
+		t.Errorf("first refund mismatch: have %d, want %d", refund, 40)
+	}
+	// The second one, partly reverted, stays under its cap
+	s.Prepare(tx2, 1)
+	snapshot := s.Snapshot()
+	s.AddRefund(50)
+	s.RevertToSnapshot(snapshot)
+	s.AddRefund(10)
+	s.FinaliseRefund(100)
+
+	ledger := s.RefundLedger()
+	if len(ledger) != 2 || ledger[tx1] != 40 || ledger[tx2] != 10 {
+		t.Errorf("refund ledger mismatch: have %v, want %v", ledger, map[types.Hash]uint64{tx1: 40, tx2: 10})
+	}
+	if _, err := s.Commit(s.blockNr); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	if ledger := s.RefundLedger(); len(ledger) != 0 {
+		t.Errorf("refund ledger not cleared by the commit: %v", ledger)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	live := newTestStateDB()
+	a, b := testAddress(1), testAddress(2)
+	live.AddBalance(a, types.NewInt64(10))
+	if _, err := live.Commit(live.blockNr); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	frozen, release := live.Freeze()
+	defer release()
+
+	before, err := frozen.Dump(DumpOptions{})
+	if err != nil {
+		t.Fatalf("failed to dump frozen state: %v", err)
+	}
+	// The live instance moves on while the frozen view is iterated
+	live.AddBalance(a, types.NewInt64(5))
+	live.AddBalance(b, types.NewInt64(1))
+	if _, err := live.Commit(live.blockNr); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	after, err := frozen.Dump(DumpOptions{})
+	if err != nil {
+		t.Fatalf("failed to dump frozen state: %v", err)
+	}
+	if string(before) != string(after) {
+		t.Errorf("frozen state changed:\nbefore: %s\nafter: %s", before, after)
+	}
+	if balance := frozen.GetBalance(a).Uint64(); balance != 10 {
+		t.Errorf("frozen balance mismatch: have %d, want %d", balance, 10)
+	}
+	if frozen.Exist(b) {
+		t.Error("account created after the freeze exists in the frozen view")
+	}
+	frozen.AddBalance(a, types.NewInt64(1))
+	if _, err := frozen.Commit(frozen.blockNr); !errors.Is(err, errFrozenState) {
+		t.Errorf("frozen commit error mismatch: have %v, want %v", err, errFrozenState)
+	}
+	release()
+	if len(live.frozen) != 0 {
+		t.Errorf("frozen view still registered after release")
+	}
+}
+
+func TestTransientAccessStats(t *testing.T) {
+	s := newTestStateDB()
+	addr, key := testAddress(1), types.BytesToHash([]byte{1})
+
+	// Nothing is counted unless enabled
+	s.SetTransientState(addr, key, types.BytesToHash([]byte{1}))
+	s.GetTransientState(addr, key)
+	if have := s.TransientAccessStats(); have != (TransientAccessStats{}) {
+		t.Errorf("accesses counted while disabled: %+v", have)
+	}
+	s.SetTransientAccessCounting(true)
+	s.Prepare(types.Hash{1}, 0)
+	s.SetTransientState(addr, key, types.BytesToHash([]byte{2}))
+	s.SetTransientState(addr, key, types.BytesToHash([]byte{3}))
+	if value := s.GetTransientState(addr, key); value != types.BytesToHash([]byte{3}) {
+		t.Errorf("transient slot mismatch: have %x, want %x", value, types.BytesToHash([]byte{3}))
+	}
+	s.GetTransientState(addr, types.Hash{})
+	if have, want := s.TransientAccessStats(), (TransientAccessStats{Loads: 2, Stores: 2}); have != want {
+		t.Errorf("access stats mismatch: have %+v, want %+v", have, want)
+	}
+	// Both the slots and the counters are reset by the next transaction
+	s.Prepare(types.Hash{2}, 1)
+	if have := s.TransientAccessStats(); have != (TransientAccessStats{}) {
+		t.Errorf("access stats not reset: %+v", have)
+	}
+	if value := s.GetTransientState(addr, key); value != (types.Hash{}) {
+		t.Errorf("transient slot not reset: %x", value)
+	}
+}
+
+func TestExistenceCache(t *testing.T) {
+	s := newTestStateDB()
+	created, external := testAddress(1), testAddress(2)
+
+	// An account created by the instance exists, until reverted
+	snapshot := s.Snapshot()
+	s.CreateAccount(created)
+	if !s.Exist(created) {
+		t.Fatal("created account doesn't exist")
+	}
+	s.RevertToSnapshot(snapshot)
+	if s.Exist(created) {
+		t.Fatal("reverted account exists")
+	}
+	s.AddBalance(created, types.NewInt64(1))
+	if _, err := s.Commit(s.blockNr); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	if !s.Exist(created) {
+		t.Fatal("committed account doesn't exist")
+	}
+	// An account committed by another writer shows up once reset to the new root
+	if s.Exist(external) {
+		t.Fatal("external account exists before its creation")
+	}
+	writer := NewMemoryStateDB()
+	writer.store = s.store
+	writer.AddBalance(external, types.NewInt64(1))
+	if _, err := writer.Commit(writer.blockNr); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	s.Reset(types.Hash{})
+	if !s.Exist(external) {
+		t.Error("external account doesn't exist after the reset")
+	}
+	if !s.Exist(created) {
+		t.Error("committed account doesn't exist after the reset")
+	}
+	// A self-destructed account doesn't exist once committed, even evicted
+	s.Suicide(created)
+	if _, err := s.Commit(s.blockNr); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	delete(s.stateObjects, created)
+	if s.Exist(created) {
+		t.Error("self-destructed account exists after the commit")
+	}
+}
+
+func TestSelfTransfer(t *testing.T) {
+	s := newTestStateDB()
+	addr := testAddress(1)
+	addTestAccount(s, addr, 100)
+
+	for _, amount := range []uint64{0, 100} {
+		snapshot := s.Snapshot()
+		if !s.Transfer(addr, addr, types.NewInt64(amount)) {
+			t.Fatalf("self transfer of %d failed", amount)
+		}
+		if have := s.GetBalance(addr); have.Uint64() != 100 {
+			t.Errorf("self transfer of %d: balance mismatch: have %v, want 100", amount, have)
+		}
+		if s.HasNetChanges(snapshot) {
+			t.Errorf("self transfer of %d reported as a net change", amount)
+		}
+		s.RevertToSnapshot(snapshot)
+		if have := s.GetBalance(addr); have.Uint64() != 100 {
+			t.Errorf("self transfer of %d: reverted balance mismatch: have %v, want 100", amount, have)
+		}
+	}
+	if s.Transfer(addr, addr, types.NewInt64(101)) {
+		t.Error("self transfer exceeding the balance succeeded")
+	}
+	if have := s.GetBalance(addr); have.Uint64() != 100 {
+		t.Errorf("balance mismatch after a failed transfer: have %v, want 100", have)
+	}
+}
+
+func TestTransferRejectedCredit(t *testing.T) {
+	s := newTestStateDB()
+	from, sanctioned := testAddress(1), testAddress(2)
+	addTestAccount(s, from, 100)
+
+	errSanctioned := errors.New("sanctioned recipient")
+	s.SetChangePolicy(func(change AccessRecord) error {
+		if change.Address == sanctioned {
+			return errSanctioned
+		}
+		return nil
+	})
+	s.Prepare(types.Hash{1}, 0)
+	length := s.journal.length()
+	if s.Transfer(from, sanctioned, types.NewInt64(30)) {
+		t.Fatal("transfer with a rejected credit succeeded")
+	}
+	if balance := s.GetBalance(from).Uint64(); balance != 100 {
+		t.Errorf("sender balance mismatch: have %d, want %d", balance, 100)
+	}
+	if s.Exist(sanctioned) {
+		t.Error("rejected recipient created")
+	}
+	if have := s.journal.length(); have != length {
+		t.Errorf("journal entries added by the rejected transfer: %d", have-length)
+	}
+	if err := s.PolicyError(); err != errSanctioned {
+		t.Errorf("policy error mismatch: have %v, want %v", err, errSanctioned)
+	}
+}
+
+func TestAllDirtyStorage(t *testing.T) {
+	s := newTestStateDB()
+	key := func(i byte) types.Hash { return types.BytesToHash([]byte{i}) }
+	for i := 1; i <= 3; i++ {
+		addTestAccount(s, testAddress(i), 1)
+	}
+	s.SetState(testAddress(1), key(2), key(1))
+	s.SetState(testAddress(1), key(1), key(1))
+	s.SetState(testAddress(1), key(2), key(2))
+	s.SetState(testAddress(2), key(3), key(1))
+
+	// Reverted changes aren't reported
+	snapshot := s.Snapshot()
+	s.SetState(testAddress(2), key(4), key(1))
+	s.SetState(testAddress(3), key(1), key(1))
+	s.RevertToSnapshot(snapshot)
+	s.SetState(testAddress(3), key(5), key(1))
+
+	want := map[types.Address][]types.Hash{
+		testAddress(1): {key(1), key(2)},
+		testAddress(2): {key(3)},
+		testAddress(3): {key(5)},
+	}
+	if have := s.AllDirtyStorage(); !reflect.DeepEqual(have, want) {
+		t.Errorf("dirty storage mismatch: have %v, want %v", have, want)
+	}
+}
+
+func TestReceiptsRoot(t *testing.T) {
+	s := newTestStateDB()
+	tx1, tx2 := types.Hash{1}, types.Hash{2}
+
+	s.Prepare(tx1, 0)
+	s.AddLog(&block.Log{
+		Address: types.BytesToAddress([]byte{1}),
+		Topics:  []types.Hash{types.BytesToHash([]byte{2})},
+		Data:    []byte{3},
+	})
+	s.Prepare(tx2, 1)
+	receipts := block.Receipts{
+		{TxHash: tx1, Status: 1, CumulativeGasUsed: 21000},
+		{TxHash: tx2, Status: 0, CumulativeGasUsed: 42000},
+	}
+	want := types.HexToHash("0x4f395bc7cee986cf6f5049db0e02789f18e1445dd15ada71b7551cbe376fe8af")
+	if have := s.ReceiptsRoot(receipts); have != want {
+		t.Errorf("receipts root mismatch: have %x, want %x", have, want)
+	}
+	if len(receipts[0].Logs) != 1 || len(receipts[1].Logs) != 0 {
+		t.Errorf("receipt logs mismatch: have %d and %d logs, want 1 and 0", len(receipts[0].Logs), len(receipts[1].Logs))
+	}
+	// A new log invalidates the cached root
+	s.AddLog(&block.Log{Data: []byte{4}})
+	if have := s.ReceiptsRoot(receipts); have == want {
+		t.Error("receipts root not updated after a new log")
+	}
+}
+
+func TestApplyJournal(t *testing.T) {
+	seed := func() *StateDB {
+		s := newTestStateDB()
+		addTestAccount(s, testAddress(1), 100)
+		addTestAccount(s, testAddress(2), 50)
+		return s
+	}
+	key := types.BytesToHash([]byte{1})
+
+	s := seed()
+	s.Transfer(testAddress(1), testAddress(2), types.NewInt64(30))
+	s.SetNonce(testAddress(1), 1)
+	s.SetState(testAddress(2), key, types.BytesToHash([]byte{1}))
+	s.SetState(testAddress(2), key, types.BytesToHash([]byte{2}))
+	s.SetCode(testAddress(3), []byte{0x60, 0x00})
+	snapshot := s.Snapshot()
+	s.AddBalance(testAddress(3), types.NewInt64(5))
+	s.RevertToSnapshot(snapshot)
+	s.AddRefund(10)
+
+	records, err := s.CaptureJournal()
+	if err != nil {
+		t.Fatalf("failed to capture journal: %v", err)
+	}
+	replayed := seed()
+	if err := replayed.ApplyJournal(records); err != nil {
+		t.Fatalf("failed to apply journal: %v", err)
+	}
+	if have, want := replayed.IntermediateRoot(), s.IntermediateRoot(); have != want {
+		t.Errorf("replayed root mismatch: have %x, want %x", have, want)
+	}
+	if have := replayed.GetState(testAddress(2), key); have != types.BytesToHash([]byte{2}) {
+		t.Errorf("replayed storage mismatch: have %x, want %x", have, types.BytesToHash([]byte{2}))
+	}
+	if have := replayed.GetRefund(); have != 10 {
+		t.Errorf("replayed refund mismatch: have %d, want 10", have)
+	}
+}
+
+func TestApplyJournalPreparedAccessList(t *testing.T) {
+	seed := func() *StateDB {
+		s := newTestStateDB()
+		addTestAccount(s, testAddress(1), 100)
+		return s
+	}
+	dst := testAddress(2)
+
+	s := seed()
+	s.PrepareAccessList(testAddress(1), &dst, nil, nil)
+	s.Transfer(testAddress(1), dst, types.NewInt64(30))
+	s.AddAddressToAccessList(testAddress(3))
+
+	records, err := s.CaptureJournal()
+	if err != nil {
+		t.Fatalf("failed to capture journal: %v", err)
+	}
+	replayed := seed()
+	if err := replayed.ApplyJournal(records); err != nil {
+		t.Fatalf("failed to apply journal: %v", err)
+	}
+	if have, want := replayed.IntermediateRoot(), s.IntermediateRoot(); have != want {
+		t.Errorf("replayed root mismatch: have %x, want %x", have, want)
+	}
+	if have := replayed.GetBalance(dst); have.Uint64() != 30 {
+		t.Errorf("replayed balance mismatch: have %v, want 30", have)
+	}
+}
+
+func TestRevertBalances(t *testing.T) {
+	s := newTestStateDB()
+	key, value := types.BytesToHash([]byte{1}), types.BytesToHash([]byte{2})
+	addTestAccount(s, testAddress(1), 100)
+	addTestAccount(s, testAddress(2), 50)
+
+	checkpoint := s.BalanceCheckpoint()
+	s.SubBalance(testAddress(1), types.NewInt64(30))
+	s.AddBalance(testAddress(2), types.NewInt64(30))
+	s.AddBalance(testAddress(2), types.NewInt64(5))
+	s.SetState(testAddress(1), key, value)
+	s.SetNonce(testAddress(2), 3)
+
+	s.RevertBalances(checkpoint)
+	if have := s.GetBalance(testAddress(1)); have.Uint64() != 100 {
+		t.Errorf("balance 1 mismatch: have %v, want 100", have)
+	}
+	if have := s.GetBalance(testAddress(2)); have.Uint64() != 50 {
+		t.Errorf("balance 2 mismatch: have %v, want 50", have)
+	}
+	if have := s.GetState(testAddress(1), key); have != value {
+		t.Errorf("storage mismatch: have %x, want %x", have, value)
+	}
+	if have := s.GetNonce(testAddress(2)); have != 3 {
+		t.Errorf("nonce mismatch: have %d, want 3", have)
+	}
+}
+
+func TestRevertBalancesSuicide(t *testing.T) {
+	s := newTestStateDB()
+	addr := testAddress(1)
+	addTestAccount(s, addr, 100)
+
+	checkpoint := s.BalanceCheckpoint()
+	s.AddBalance(addr, types.NewInt64(20))
+	s.Suicide(addr)
+	s.RevertBalances(checkpoint)
+	if have := s.GetBalance(addr); have.Uint64() != 100 {
+		t.Errorf("balance mismatch: have %v, want 100", have)
+	}
+	if !s.HasSuicided(addr) {
+		t.Error("self-destruct reverted along with the balance")
+	}
+}
+
+func TestAccountRLP(t *testing.T) {
+	s := newTestStateDB()
+	addr, missing := testAddress(1), testAddress(2)
+	code := []byte{0x60, 0x00}
+
+	obj := newObject(s, addr, StateAccount{Nonce: 3, Balance: types.NewInt64(100)})
+	obj.setCode(types.BytesToHash(utils.Keccak256(code)), code)
+	if err := s.setAccount(addr, s.blockNr, obj); err != nil {
+		t.Fatalf("failed to write account: %v", err)
+	}
+	// Pending changes are left out of the encoding
+	s.AddBalance(addr, types.NewInt64(50))
+
+	enc, err := s.AccountRLP(addr)
+	if err != nil {
+		t.Fatalf("failed to encode account: %v", err)
+	}
+	var account rlpAccount
+	if err := rlp.DecodeBytes(enc, &account); err != nil {
+		t.Fatalf("failed to decode account: %v", err)
+	}
+	want := rlpAccount{Nonce: 3, Balance: big.NewInt(100), Root: emptyRoot, CodeHash: utils.Keccak256(code)}
+	if !reflect.DeepEqual(account, want) {
+		t.Errorf("account mismatch: have %+v, want %+v", account, want)
+	}
+	if _, err := s.AccountRLP(missing); !errors.Is(err, errAccountNotFound) {
+		t.Errorf("missing account error mismatch: have %v, want %v", err, errAccountNotFound)
+	}
+}
+
+func TestAccountLimit(t *testing.T) {
+	s := newTestStateDB()
+	s.SetAccountLimit(2)
+	s.AddBalance(testAddress(1), types.NewInt64(1))
+	s.AddBalance(testAddress(2), types.NewInt64(1))
+	// Reverted changes don't count against the limit
+	snapshot := s.Snapshot()
+	s.AddBalance(testAddress(3), types.NewInt64(1))
+	s.RevertToSnapshot(snapshot)
+	if err := s.CheckAccountLimit(); err != nil {
+		t.Fatalf("accounts within the limit rejected: %v", err)
+	}
+	// A touch alone changes the account
+	s.AddBalance(testAddress(3), types.NewInt64(0))
+	if have := s.ChangedAccounts(); have != 3 {
+		t.Errorf("changed accounts mismatch: have %d, want 3", have)
+	}
+	if err := s.CheckAccountLimit(); !errors.Is(err, errTooManyAccounts) {
+		t.Errorf("limit error mismatch: have %v, want %v", err, errTooManyAccounts)
+	}
+	if _, err := s.Commit(s.blockNr); !errors.Is(err, errTooManyAccounts) {
+		t.Fatalf("commit error mismatch: have %v, want %v", err, errTooManyAccounts)
+	}
+	if _, err := s.store.ReadAccount(s.blockNr, testAddress(1)); err == nil {
+		t.Errorf("rejected block partially committed")
+	}
+}
+
+func TestCreateContract(t *testing.T) {
+	deployer := testAddress(1)
+	create := crypto.CreateAddress(deployer, 0)
+	create2 := PredictCreate2Address(deployer, types.Hash{1}, types.BytesToHash(utils.Keccak256([]byte{0x60, 0x00})))
+
+	s := newTestStateDB()
+	// Funds sent to the CREATE2 address ahead of the deployment
+	addTestAccount(s, create2, 7)
+
+	snapshot := s.Snapshot()
+	for _, addr := range []types.Address{create, create2} {
+		s.CreateContract(addr)
+		if have := s.GetNonce(addr); have != 1 {
+			t.Errorf("%v: nonce mismatch: have %d, want 1", addr, have)
+		}
+	}
+	if have := s.GetBalance(create2); have.Uint64() != 7 {
+		t.Errorf("prefunded balance mismatch: have %v, want 7", have)
+	}
+	s.RevertToSnapshot(snapshot)
+	if s.Exist(create) {
+		t.Error("reverted CREATE target still exists")
+	}
+	if have := s.GetNonce(create2); have != 0 {
+		t.Errorf("reverted CREATE2 target nonce mismatch: have %d, want 0", have)
+	}
+	if have := s.GetBalance(create2); have.Uint64() != 7 {
+		t.Errorf("reverted CREATE2 target balance mismatch: have %v, want 7", have)
+	}
+	// Before EIP-161, the contracts start at nonce 0
+	s.SetEIP161(false)
+	s.CreateContract(create)
+	if !s.Exist(create) || s.GetNonce(create) != 0 {
+		t.Errorf("pre-EIP-161 contract mismatch: exists %v, nonce %d, want nonce 0", s.Exist(create), s.GetNonce(create))
+	}
+}
+
+func TestGetBalanceAtTxStart(t *testing.T) {
+	from, to, fresh := testAddress(1), testAddress(2), testAddress(3)
+	s := newTestStateDB()
+	addTestAccount(s, from, 100)
+	addTestAccount(s, to, 5)
+
+	s.Prepare(types.Hash{1}, 0)
+	s.SubBalance(from, types.NewInt64(30))
+	s.AddBalance(to, types.NewInt64(30))
+	snapshot := s.Snapshot()
+	s.SubBalance(from, types.NewInt64(50))
+	s.AddBalance(fresh, types.NewInt64(50))
+	s.RevertToSnapshot(snapshot)
+	s.Suicide(to)
+
+	for _, tt := range []struct {
+		addr          types.Address
+		start, result uint64
+	}{
+		{from, 100, 70},
+		{to, 5, 0},
+		{fresh, 0, 0},
+	} {
+		if have := s.GetBalanceAtTxStart(tt.addr); have.Uint64() != tt.start {
+			t.Errorf("%v: tx start balance mismatch: have %v, want %d", tt.addr, have, tt.start)
+		}
+		if have := s.GetBalance(tt.addr); have.Uint64() != tt.result {
+			t.Errorf("%v: balance mismatch: have %v, want %d", tt.addr, have, tt.result)
+		}
+	}
+	// The next transaction starts from the balances left by the previous one
+	s.Prepare(types.Hash{2}, 1)
+	s.AddBalance(from, types.NewInt64(1))
+	if have := s.GetBalanceAtTxStart(from); have.Uint64() != 70 {
+		t.Errorf("next tx start balance mismatch: have %v, want 70", have)
+	}
+}
+
+func TestReadWitness(t *testing.T) {
+	contract, missing := testAddress(1), testAddress(2)
+	s := newTestStateDB()
+	addTestAccount(s, contract, 0)
+	s.SetState(contract, types.Hash{1}, types.Hash{7})
+
+	s.GetState(contract, types.Hash{1})
+	if witness := s.ReadWitness(); len(witness) != 0 {
+		t.Fatalf("reads recorded while disabled: %v", witness)
+	}
+	s.SetReadWitness(true)
+	s.Prepare(types.Hash{1}, 0)
+	s.GetState(contract, types.Hash{3})
+	s.GetState(contract, types.Hash{1})
+	s.GetCommittedState(contract, types.Hash{2})
+	s.Prepare(types.Hash{2}, 1)
+	s.GetState(contract, types.Hash{1})
+	s.GetState(missing, types.Hash{4})
+
+	want := map[types.Address][]types.Hash{
+		contract: {{1}, {2}, {3}},
+		missing:  {{4}},
+	}
+	if have := s.ReadWitness(); !reflect.DeepEqual(have, want) {
+		t.Errorf("witness mismatch: have %v, want %v", have, want)
+	}
+	s.SetReadWitness(false)
+	if witness := s.ReadWitness(); len(witness) != 0 {
+		t.Errorf("witness kept after disabling: %v", witness)
+	}
+}
+
+func TestTransientStorageRevert(t *testing.T) {
+	s := newTestStateDB()
+	addr, key := testAddress(1), types.BytesToHash([]byte{1})
+
+	s.Prepare(types.Hash{1}, 0)
+	s.SetTransientState(addr, key, types.BytesToHash([]byte{2}))
+	snapshot := s.Snapshot()
+	s.SetTransientState(addr, key, types.BytesToHash([]byte{3}))
+	s.RevertToSnapshot(snapshot)
+	if value := s.GetTransientState(addr, key); value != types.BytesToHash([]byte{2}) {
+		t.Errorf("transient slot mismatch after revert: have %x, want %x", value, types.BytesToHash([]byte{2}))
+	}
+	// Transient storage isn't part of the account trie
+	if _, ok := s.journal.dirties[addr]; ok {
+		t.Error("account dirtied by a transient storage change")
+	}
+}
+
+func TestTransientStorageJournalSpill(t *testing.T) {
+	s := newTestStateDB()
+	s.SetJournalSpill(8, t.TempDir())
+
+	addr := testAddress(1)
+	s.Prepare(types.Hash{1}, 0)
+	snapshots := make([]int, 0, 10)
+	for i := 0; i < 50; i++ {
+		if i%5 == 0 {
+			snapshots = append(snapshots, s.Snapshot())
+		}
+		s.SetTransientState(addr, types.Hash{byte(i % 4)}, types.BytesToHash([]byte{byte(i + 1)}))
+	}
+	if s.journal.spilled == 0 {
+		t.Fatal("journal not spilled")
+	}
+	if len(s.journal.spill.pinned) != 0 {
+		t.Errorf("transient storage changes pinned in memory: %d entries", len(s.journal.spill.pinned))
+	}
+	// Revert the sub-calls from the 20th store onwards
+	s.RevertToSnapshot(snapshots[4])
+	for slot := 0; slot < 4; slot++ {
+		want := types.BytesToHash([]byte{byte(16 + slot + 1)})
+		if have := s.GetTransientState(addr, types.Hash{byte(slot)}); have != want {
+			t.Errorf("slot %d mismatch after revert: have %x, want %x", slot, have, want)
+		}
+	}
+}
+
+func TestMaxJournalEntries(t *testing.T) {
+	s := newTestStateDB()
+	addr := testAddress(1)
+	addTestAccount(s, addr, 0)
+
+	// A first transaction within the bound
+	s.SetMaxJournalEntries(10)
+	s.Prepare(types.Hash{1}, 0)
+	for i := 0; i < 10; i++ {
+		s.SetState(addr, types.Hash{byte(i)}, types.Hash{1})
+	}
+	if err := s.JournalError(); err != nil {
+		t.Fatalf("journal error within the bound: %v", err)
+	}
+	// The next one is bounded on its own, and stays over after the revert
+	s.Prepare(types.Hash{2}, 1)
+	snapshot := s.Snapshot()
+	for i := 0; i < 11; i++ {
+		s.SetState(addr, types.Hash{byte(i)}, types.Hash{2})
+	}
+	if err := s.JournalError(); !errors.Is(err, ErrJournalLimit) {
+		t.Fatalf("journal error mismatch: have %v, want %v", err, ErrJournalLimit)
+	}
+	s.RevertToSnapshot(snapshot)
+	if err := s.JournalError(); !errors.Is(err, ErrJournalLimit) {
+		t.Errorf("journal error cleared by revert: %v", err)
+	}
+	if have := s.GetState(addr, types.Hash{10}); have != (types.Hash{}) {
+		t.Errorf("change past the bound not reverted: %x", have)
+	}
+	s.Prepare(types.Hash{3}, 2)
+	if err := s.JournalError(); err != nil {
+		t.Errorf("journal error not reset at prepare: %v", err)
+	}
+	// Zero lifts the bound
+	s.SetMaxJournalEntries(0)
+	for i := 0; i < 100; i++ {
+		s.SetState(addr, types.Hash{byte(i)}, types.Hash{3})
+	}
+	if err := s.JournalError(); err != nil {
+		t.Errorf("journal error while unlimited: %v", err)
+	}
+}
+
+func TestSuicideEIP6780(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		eip6780  bool
+		created  bool // Whether the contract is created by the suiciding transaction
+		suicided bool
+	}{
+		{"legacy preexisting", false, false, true},
+		{"legacy created", false, true, true},
+		{"eip6780 preexisting", true, false, false},
+		{"eip6780 created", true, true, true},
+	} {
+		s := newTestStateDB()
+		s.SetEIP6780(tt.eip6780)
+		addr := testAddress(1)
+
+		s.Prepare(types.Hash{1}, 0)
+		s.CreateContract(addr)
+		s.AddBalance(addr, types.NewInt64(10))
+		if !tt.created {
+			s.Prepare(types.Hash{2}, 1)
+		}
+		snapshot := s.Snapshot()
+		if !s.Suicide(addr) {
+			t.Fatalf("%s: existing account not suicided", tt.name)
+		}
+		if have := s.HasSuicided(addr); have != tt.suicided {
+			t.Errorf("%s: suicided mismatch: have %v, want %v", tt.name, have, tt.suicided)
+		}
+		if have := s.GetBalance(addr); have.Uint64() != 0 {
+			t.Errorf("%s: balance not cleared: have %v", tt.name, have)
+		}
+		s.RevertToSnapshot(snapshot)
+		if s.HasSuicided(addr) {
+			t.Errorf("%s: suicided after revert", tt.name)
+		}
+		if have := s.GetBalance(addr); have.Uint64() != 10 {
+			t.Errorf("%s: balance mismatch after revert: have %v, want 10", tt.name, have)
+		}
+	}
+	// Suiciding twice within the same transaction reverts step by step
+	s := newTestStateDB()
+	s.SetEIP6780(true)
+	addr := testAddress(1)
+	s.Prepare(types.Hash{1}, 0)
+	s.CreateContract(addr)
+	s.AddBalance(addr, types.NewInt64(10))
+	s.Suicide(addr)
+	snapshot := s.Snapshot()
+	s.AddBalance(addr, types.NewInt64(5))
+	s.Suicide(addr)
+	s.RevertToSnapshot(snapshot)
+	if !s.HasSuicided(addr) || s.GetBalance(addr).Uint64() != 0 {
+		t.Errorf("first suicide undone: suicided %v, balance %v", s.HasSuicided(addr), s.GetBalance(addr))
+	}
+}
+
+func TestStateDiff(t *testing.T) {
+	kept, modified, removed, touched, added := testAddress(1), testAddress(2), testAddress(3), testAddress(4), testAddress(5)
+	build := func(change func(s *StateDB)) *StateDB {
+		s := newTestStateDB()
+		for _, addr := range []types.Address{kept, modified, removed, touched} {
+			s.AddBalance(addr, types.NewInt64(10))
+		}
+		s.SetState(modified, types.Hash{1}, types.Hash{1})
+		s.SetState(modified, types.Hash{2}, types.Hash{2})
+		s.SetState(touched, types.Hash{1}, types.Hash{1})
+		if change != nil {
+			change(s)
+		}
+		if _, err := s.Commit(types.NewInt64(1)); err != nil {
+			t.Fatalf("failed to commit state: %v", err)
+		}
+		return s
+	}
+	a := build(nil)
+	b := build(func(s *StateDB) {
+		s.SetNonce(modified, 1)
+		s.SetState(modified, types.Hash{1}, types.Hash{})
+		s.SetState(modified, types.Hash{2}, types.Hash{3})
+		s.SetState(modified, types.Hash{4}, types.Hash{4})
+		s.Suicide(removed)
+		s.SetState(touched, types.Hash{1}, types.Hash{5})
+		s.AddBalance(added, types.NewInt64(7))
+	})
+	empty := types.BytesToHash(emptyCodeHash)
+	want := []AccountDiff{
+		{
+			Address: modified, Kind: AccountModified,
+			From: &AccountState{Nonce: 0, Balance: types.NewInt64(10), CodeHash: empty},
+			To:   &AccountState{Nonce: 1, Balance: types.NewInt64(10), CodeHash: empty},
+			Storage: []SlotDiff{
+				{Key: types.Hash{1}, From: types.Hash{1}},
+				{Key: types.Hash{2}, From: types.Hash{2}, To: types.Hash{3}},
+				{Key: types.Hash{4}, To: types.Hash{4}},
+			},
+		},
+		{
+			Address: removed, Kind: AccountRemoved,
+			From: &AccountState{Balance: types.NewInt64(10), CodeHash: empty},
+		},
+		{
+			Address: touched, Kind: AccountModified,
+			From:    &AccountState{Balance: types.NewInt64(10), CodeHash: empty},
+			To:      &AccountState{Balance: types.NewInt64(10), CodeHash: empty},
+			Storage: []SlotDiff{{Key: types.Hash{1}, From: types.Hash{1}, To: types.Hash{5}}},
+		},
+		{
+			Address: added, Kind: AccountAdded,
+			To: &AccountState{Balance: types.NewInt64(7), CodeHash: empty},
+		},
+	}
+	if have := StateDiff(a, b); !reflect.DeepEqual(have, want) {
+		t.Errorf("diff mismatch:\nhave %+v\nwant %+v", have, want)
+	}
+	if err := a.Error(); err != nil {
+		t.Fatalf("failed to diff states: %v", err)
+	}
+	if diff := StateDiff(a, a); len(diff) != 0 {
+		t.Errorf("diff of a state with itself: %+v", diff)
+	}
+	// Streaming stops as soon as the callback asks to
+	var streamed []types.Address
+	if err := StreamStateDiff(a, b, func(diff AccountDiff) bool {
+		streamed = append(streamed, diff.Address)
+		return len(streamed) < 2
+	}); err != nil {
+		t.Fatalf("failed to stream diff: %v", err)
+	}
+	if len(streamed) != 2 || streamed[0] != modified || streamed[1] != removed {
+		t.Errorf("streamed diff mismatch: have %v", streamed)
+	}
+	// Failing account reads are reported rather than taken for absent accounts
+	errRead := errors.New("read failure")
+	b.store = &failingStore{accountStore: b.store, err: errRead}
+	if err := StreamStateDiff(a, b, func(diff AccountDiff) bool { return true }); !errors.Is(err, errRead) {
+		t.Errorf("streamed diff error mismatch: have %v, want %v", err, errRead)
+	}
+	if diff := StateDiff(a, b); len(diff) != 0 {
+		t.Errorf("diff despite read failure: %+v", diff)
+	}
+	if err := a.Error(); !errors.Is(err, errRead) {
+		t.Errorf("memoized diff error mismatch: have %v, want %v", err, errRead)
+	}
+}
+
+// failingStore is an accountStore failing every account read with err.
+type failingStore struct {
+	accountStore
+	err error
+}
+
+func (s *failingStore) ReadAccount(blockNr types.Int256, addr types.Address) ([]byte, error) {
+	return nil, s.err
+}
+
+func TestJournalDirtiedSince(t *testing.T) {
+	s := newTestStateDB()
+	s.SetJournalSpill(4, t.TempDir())
+	before, contract, other := testAddress(1), testAddress(2), testAddress(3)
+	addTestAccount(s, before, 10)
+	addTestAccount(s, contract, 0)
+	addTestAccount(s, other, 0)
+
+	s.SetState(before, types.Hash{9}, types.Hash{1})
+	snapshot := s.journal.length()
+	s.SetState(contract, types.Hash{2}, types.Hash{1})
+	s.SetState(contract, types.Hash{1}, types.Hash{1})
+	s.SetState(contract, types.Hash{2}, types.Hash{2})
+	s.AddBalance(other, types.NewInt64(1))
+	s.SetNonce(contract, 1)
+	s.AddRefund(1)
+
+	length, spilled := s.journal.length(), s.journal.spilled
+	if spilled == 0 {
+		t.Fatal("journal not spilled")
+	}
+	accounts, slots := s.journal.dirtiedSince(snapshot)
+	if want := []types.Address{contract, other}; !reflect.DeepEqual(accounts, want) {
+		t.Errorf("dirtied accounts mismatch: have %v, want %v", accounts, want)
+	}
+	if want := map[types.Address][]types.Hash{contract: {{1}, {2}}}; !reflect.DeepEqual(slots, want) {
+		t.Errorf("changed slots mismatch: have %v, want %v", slots, want)
+	}
+	if s.journal.length() != length || s.journal.spilled != spilled {
+		t.Errorf("journal changed: have %d entries, %d spilled, want %d, %d", s.journal.length(), s.journal.spilled, length, spilled)
+	}
+}
+
+func TestSnapshotDestructsRevert(t *testing.T) {
+	s := newTestStateDB()
+	s.SetSnapshotDestructs(true)
+	addr := testAddress(1)
+	hash := types.BytesToHash(addr[:])
+	addTestAccount(s, addr, 10)
+
+	destructed := func(want bool) {
+		t.Helper()
+		have := s.SnapshotDestructs()
+		if want && (len(have) != 1 || have[0] != hash) || !want && len(have) != 0 {
+			t.Errorf("destructs mismatch: have %v, want destructed %v", have, want)
+		}
+	}
+	// Creating over the existing account destructs it until reverted
+	outer := s.Snapshot()
+	s.CreateAccount(addr)
+	destructed(true)
+
+	// Creating over it again within a nested call, then reverting the call,
+	// keeps the destruct of the outer creation
+	inner := s.Snapshot()
+	s.CreateAccount(addr)
+	s.RevertToSnapshot(inner)
+	destructed(true)
+
+	s.RevertToSnapshot(outer)
+	destructed(false)
+	if have := s.GetBalance(addr); have.Uint64() != 10 {
+		t.Errorf("balance mismatch after revert: have %v, want 10", have)
+	}
+	// Nothing is tracked unless enabled
+	s.SetSnapshotDestructs(false)
+	s.CreateAccount(addr)
+	destructed(false)
+}
+
+func TestEmptySlotPruning(t *testing.T) {
+	addr, cleared, kept := testAddress(1), types.Hash{1}, types.Hash{2}
+	// committedSlots returns the storage keys of the committed account
+	committedSlots := func(s *StateDB) []types.Hash {
+		t.Helper()
+		data, err := s.store.ReadAccount(types.Int256{}, addr)
+		if err != nil {
+			t.Fatalf("failed to read account: %v", err)
+		}
+		var account state.Account
+		if err := proto.Unmarshal(data, &account); err != nil {
+			t.Fatalf("failed to decode account: %v", err)
+		}
+		var keys []types.Hash
+		for _, slot := range account.State {
+			keys = append(keys, slot.Key)
+		}
+		return keys
+	}
+	// The state with the kept slot only, as if the cleared one was never set
+	compact := newTestStateDB()
+	compact.SetState(addr, kept, types.Hash{2})
+	want, err := compact.Commit(types.NewInt64(1))
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	for _, prune := range []bool{false, true} {
+		s := newTestStateDB()
+		s.SetEmptySlotPruning(prune)
+		s.SetState(addr, cleared, types.Hash{1})
+		s.SetState(addr, kept, types.Hash{2})
+		if _, err := s.Commit(types.NewInt64(1)); err != nil {
+			t.Fatalf("prune %v: failed to commit state: %v", prune, err)
+		}
+		s.SetState(addr, cleared, types.Hash{})
+		root, err := s.Commit(types.NewInt64(2))
+		if err != nil {
+			t.Fatalf("prune %v: failed to commit state: %v", prune, err)
+		}
+		if keys := committedSlots(s); prune && !reflect.DeepEqual(keys, []types.Hash{kept}) || !prune && len(keys) != 2 {
+			t.Errorf("prune %v: committed slots mismatch: have %x", prune, keys)
+		}
+		if (root == want) != prune {
+			t.Errorf("prune %v: root mismatch: have %x, compact %x", prune, root, want)
+		}
+		if have := s.GetState(addr, cleared); have != (types.Hash{}) {
+			t.Errorf("prune %v: cleared slot mismatch: have %x", prune, have)
+		}
+	}
+}
+
+func TestJournalHooks(t *testing.T) {
+	s := newTestStateDB()
+	addr, slot := testAddress(1), types.Hash{1}
+	addTestAccount(s, addr, 10)
+
+	var first, second []AccessRecord
+	firstID := s.AddJournalHook(func(change AccessRecord) { first = append(first, change) })
+	s.AddJournalHook(func(change AccessRecord) { second = append(second, change) })
+
+	snapshot := s.Snapshot()
+	s.AddBalance(addr, types.NewInt64(5))
+	s.SetState(addr, slot, types.Hash{7})
+	s.AddRefund(1) // Not observed
+	s.SetNonce(addr, 1)
+	s.RevertToSnapshot(snapshot)
+
+	want := []AccessRecord{
+		{Op: BalanceWrite, Address: addr, Value: balanceWord(types.NewInt64(10))},
+		{Op: StorageWrite, Address: addr, Key: slot},
+		{Op: NonceWrite, Address: addr, Value: nonceWord(0)},
+	}
+	if !reflect.DeepEqual(first, want) || !reflect.DeepEqual(second, want) {
+		t.Fatalf("observed changes mismatch:\nhave %+v\nand  %+v\nwant %+v", first, second, want)
+	}
+	// Removed hooks are no longer called, the others survive the journal
+	// reset of a commit
+	s.RemoveJournalHook(firstID)
+	s.SetState(addr, slot, types.Hash{7})
+	if _, err := s.Commit(types.NewInt64(1)); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	first, second = nil, nil
+	s.SetState(addr, slot, types.Hash{8})
+	if len(first) != 0 || len(second) != 1 {
+		t.Errorf("observed changes after commit mismatch: have %d and %d, want 0 and 1", len(first), len(second))
+	}
+}
+
+func TestJournalHooksCoalescedNonce(t *testing.T) {
+	s := newTestStateDB()
+	addr := testAddress(1)
+	addTestAccount(s, addr, 10)
+
+	var changes []AccessRecord
+	s.AddJournalHook(func(change AccessRecord) { changes = append(changes, change) })
+
+	// The sequential increments share a journal entry, but are all observed
+	length := s.journal.length()
+	for nonce := uint64(1); nonce <= 3; nonce++ {
+		s.SetNonce(addr, nonce)
+	}
+	if have := s.journal.length() - length; have != 1 {
+		t.Errorf("journal entries mismatch: have %d, want 1", have)
+	}
+	want := []AccessRecord{
+		{Op: NonceWrite, Address: addr, Value: nonceWord(0)},
+		{Op: NonceWrite, Address: addr, Value: nonceWord(1)},
+		{Op: NonceWrite, Address: addr, Value: nonceWord(2)},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("observed changes mismatch:\nhave %+v\nwant %+v", changes, want)
+	}
+}
+
+func TestRevertMissingObject(t *testing.T) {
+	s := newTestStateDB()
+	addr := testAddress(1)
+
+	// A created then destructed account, its changes nested in several snapshots
+	outer := s.Snapshot()
+	s.CreateAccount(addr)
+	s.AddBalance(addr, types.NewInt64(10))
+	s.Snapshot()
+	s.SetNonce(addr, 1)
+	s.SetCode(addr, []byte{1, 2, 3})
+	s.Snapshot()
+	s.SetState(addr, types.Hash{1}, types.Hash{2})
+	s.Suicide(addr)
+
+	// The object going away before the changes are reverted leaves nothing to
+	// restore rather than panicking
+	delete(s.stateObjects, addr)
+	s.RevertToSnapshot(outer)
+	if s.Exist(addr) {
+		t.Errorf("account exists after revert")
+	}
+	if have := s.journal.length(); have != 0 {
+		t.Errorf("journal length mismatch: have %d, want 0", have)
+	}
+}
+
+func TestZeroAddressState(t *testing.T) {
+	s := newTestStateDB()
+	sender, burn := testAddress(1), types.Address{}
+	addTestAccount(s, sender, 100)
+
+	// Burns to the zero address are credited and reverted like any transfer
+	snapshot := s.Snapshot()
+	if !s.Transfer(sender, burn, types.NewInt64(30)) {
+		t.Fatalf("affordable burn failed")
+	}
+	if have := s.GetBalance(burn); have.Uint64() != 30 {
+		t.Errorf("burned balance mismatch: have %v, want 30", have)
+	}
+	s.RevertToSnapshot(snapshot)
+	if have := s.GetBalance(burn); have.Uint64() != 0 {
+		t.Errorf("burned balance after revert mismatch: have %v, want 0", have)
+	}
+	if have := s.GetBalance(sender); have.Uint64() != 100 {
+		t.Errorf("sender balance after revert mismatch: have %v, want 100", have)
+	}
+	// The nonce, code and storage of the zero address are journalled alike
+	snapshot = s.Snapshot()
+	s.SetNonce(burn, 1)
+	s.SetCode(burn, []byte{1, 2, 3})
+	s.SetState(burn, types.Hash{1}, types.Hash{2})
+	s.RevertToSnapshot(snapshot)
+	if s.GetNonce(burn) != 0 || len(s.GetCode(burn)) != 0 || s.GetState(burn, types.Hash{1}) != (types.Hash{}) {
+		t.Errorf("zero address changes not reverted")
+	}
+	// Burns kept are committed
+	s.Transfer(sender, burn, types.NewInt64(30))
+	if _, err := s.Commit(types.NewInt64(1)); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	if !s.Exist(burn) {
+		t.Errorf("zero address missing after commit")
+	}
+	if have := s.GetBalance(burn); have.Uint64() != 30 {
+		t.Errorf("committed burned balance mismatch: have %v, want 30", have)
+	}
+}
+
+func TestCopyJournal(t *testing.T) {
+	s := newTestStateDB()
+	addr, other := testAddress(1), testAddress(2)
+	addTestAccount(s, addr, 100)
+
+	snapshot := s.Snapshot()
+	s.AddBalance(addr, types.NewInt64(10))
+	s.SetState(addr, types.Hash{1}, types.Hash{2})
+	s.CreateAccount(other)
+	// Recreating the account journals the replaced object, which the copy must
+	// not share with the original
+	s.CreateAccount(addr)
+	s.AddBalance(addr, types.NewInt64(5))
+
+	fork := s.Copy()
+	fork.RevertToSnapshot(snapshot)
+	if have := fork.GetBalance(addr); have.Uint64() != 100 {
+		t.Errorf("reverted fork balance mismatch: have %v, want 100", have)
+	}
+	if fork.Exist(other) {
+		t.Errorf("created account exists in reverted fork")
+	}
+	if have := s.GetBalance(addr); have.Uint64() != 115 {
+		t.Errorf("original balance mismatch: have %v, want 115", have)
+	}
+	if !s.Exist(other) || s.journal.length() == 0 {
+		t.Errorf("original changed by the fork revert")
+	}
+	// Changes to the restored object of the fork don't leak either way
+	fork.AddBalance(addr, types.NewInt64(1))
+	s.RevertToSnapshot(snapshot)
+	if have := s.GetBalance(addr); have.Uint64() != 100 {
+		t.Errorf("reverted original balance mismatch: have %v, want 100", have)
+	}
+	if have := fork.GetBalance(addr); have.Uint64() != 101 {
+		t.Errorf("fork balance mismatch: have %v, want 101", have)
+	}
+	if obj := fork.getStateObject(addr); obj.db != fork {
+		t.Errorf("restored fork object bound to another state")
+	}
+}
+
+func TestDirtyAccountCount(t *testing.T) {
+	s := newTestStateDB()
+	s.AddBalance(testAddress(1), types.NewInt64(1))
+	s.SetState(testAddress(1), types.Hash{1}, types.Hash{1})
+	snapshot := s.Snapshot()
+	s.AddBalance(testAddress(2), types.NewInt64(1))
+	if have := s.DirtyAccountCount(); have != 2 {
+		t.Errorf("dirty accounts mismatch: have %d, want 2", have)
+	}
+	s.RevertToSnapshot(snapshot)
+	if have := s.DirtyAccountCount(); have != 1 {
+		t.Errorf("dirty accounts after revert mismatch: have %d, want 1", have)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { s.DirtyAccountCount() }); allocs != 0 {
+		t.Errorf("dirty account count allocates: %v allocations", allocs)
+	}
+	if _, err := s.Commit(types.NewInt64(1)); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	if have := s.DirtyAccountCount(); have != 0 {
+		t.Errorf("dirty accounts after commit mismatch: have %d, want 0", have)
+	}
+}
+
+func TestAccessListMatches(t *testing.T) {
+	s := newTestStateDB()
+	s.SetAccessRecording(true)
+	sender, dst, contract, unused := testAddress(1), testAddress(2), testAddress(3), testAddress(4)
+	declared := transaction.AccessList{
+		{Address: contract, StorageKeys: []types.Hash{{1}}},
+		{Address: unused},
+	}
+	s.PrepareAccessList(sender, &dst, nil, declared)
+
+	// The accesses as checked by the EVM, the second slot being left out of the
+	// declared list
+	s.AddressInAccessList(dst)
+	s.AddressInAccessList(contract)
+	if _, ok := s.SlotInAccessList(contract, types.Hash{1}); !ok {
+		t.Fatalf("declared slot not in access list")
+	}
+	if _, ok := s.SlotInAccessList(contract, types.Hash{2}); !ok {
+		s.AddSlotToAccessList(contract, types.Hash{2})
+	}
+	extra, missing := s.AccessListMatches(declared)
+	if len(extra) != 1 || extra[0].Address != unused || len(extra[0].StorageKeys) != 0 {
+		t.Errorf("extra entries mismatch: have %v, want the unused address", extra)
+	}
+	if len(missing) != 1 || missing[0].Address != contract || len(missing[0].StorageKeys) != 1 || missing[0].StorageKeys[0] != (types.Hash{2}) {
+		t.Errorf("missing entries mismatch: have %v, want the undeclared slot", missing)
+	}
+	// An exact list matches
+	exact := transaction.AccessList{{Address: contract, StorageKeys: []types.Hash{{1}, {2}}}}
+	if extra, missing := s.AccessListMatches(exact); len(extra) != 0 || len(missing) != 0 {
+		t.Errorf("exact list mismatch: extra %v, missing %v", extra, missing)
+	}
+}
+
+// testAccessList creates an access list of the given number of storage keys,
+// spread over accounts of ten keys each.
+func testAccessList(keys int) transaction.AccessList {
+	var list transaction.AccessList
+	for i := 0; i < keys; i++ {
+		if i%10 == 0 {
+			list = append(list, transaction.AccessTuple{Address: testAddress(100 + i/10)})
+		}
+		tuple := &list[len(list)-1]
+		tuple.StorageKeys = append(tuple.StorageKeys, types.BytesToHash([]byte{byte(i >> 8), byte(i)}))
+	}
+	return list
+}
+
+func TestPrepareAccessListJournal(t *testing.T) {
+	s := newTestStateDB()
+	sender, dst := testAddress(1), testAddress(2)
+	s.PrepareAccessList(sender, &dst, nil, transaction.AccessList{{Address: testAddress(3)}})
+	before := s.Snapshot()
+
+	// The declared list is journalled as a whole
+	list := testAccessList(1000)
+	length := s.journal.length()
+	s.PrepareAccessList(sender, &dst, nil, list)
+	if have := s.journal.length() - length; have != 1 {
+		t.Errorf("prepared access list entries mismatch: have %d, want 1", have)
+	}
+	if _, ok := s.SlotInAccessList(list[99].Address, list[99].StorageKeys[9]); !ok {
+		t.Errorf("declared slot missing from access list")
+	}
+	// The adds of the execution are journalled and reverted one by one
+	prepared := s.Snapshot()
+	s.AddSlotToAccessList(testAddress(4), types.Hash{1})
+	s.RevertToSnapshot(prepared)
+	if s.AddressInAccessList(testAddress(4)) || !s.AddressInAccessList(list[0].Address) {
+		t.Errorf("execution add not reverted alone")
+	}
+	// Reverting the preparation restores the replaced list
+	s.RevertToSnapshot(before)
+	if s.AddressInAccessList(list[0].Address) || !s.AddressInAccessList(testAddress(3)) {
+		t.Errorf("replaced access list not restored")
+	}
+}
+
+// BenchmarkPrepareAccessList measures preparing a 1000 keys access list, along
+// with the journal entries it makes, a thousand and more when journalled item
+// by item.
+func BenchmarkPrepareAccessList(b *testing.B) {
+	s := newTestStateDB()
+	sender, dst := testAddress(1), testAddress(2)
+	list := testAccessList(1000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		snapshot := s.Snapshot()
+		length := s.journal.length()
+		s.PrepareAccessList(sender, &dst, nil, list)
+		b.ReportMetric(float64(s.journal.length()-length), "entries/tx")
+		s.RevertToSnapshot(snapshot)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"bytes"
+	"errors"
+	"github.com/amazechain/amc/common/db"
+	"github.com/amazechain/amc/common/types"
+	"github.com/amazechain/amc/internal/kv"
+	"github.com/amazechain/amc/modules/rawdb"
+	"github.com/amazechain/amc/utils"
+	"github.com/torquem-ch/mdbx-go/mdbx"
+	"sort"
+	"sync"
+)
+
+var (
+	errAccountNotFound = errors.New("account not found")
+	errCorruptAccount  = errors.New("corrupt account")
+)
+
+// accountStore persists the encoded accounts loaded and committed by a StateDB.
+type accountStore interface {
+	// ReadAccount returns the encoded account as of the given block, or an
+	// error if the account doesn't exist.
+	ReadAccount(blockNr types.Int256, addr types.Address) ([]byte, error)
+	// WriteAccount stores the encoded account as changed by the given block.
+	WriteAccount(blockNr types.Int256, addr types.Address, data []byte) error
+	// ForEachAccount calls cb with the latest encoding of every account, in
+	// address order, until it returns false.
+	ForEachAccount(cb func(addr types.Address, data []byte) bool) error
+}
+
+// rawdbStore is the accountStore backed by the node's databases, keeping the
+// per-block change sets needed to serve historical state.
+type rawdbStore struct {
+	db       db.IDatabase
+	changeDB kv.RwDB
+}
+
+func (s *rawdbStore) ReadAccount(blockNr types.Int256, addr types.Address) ([]byte, error) {
+	data, err := rawdb.GetAccount(s.db, s.changeDB, blockNr, addr)
+	if mdbx.IsNotFound(err) || (err == nil && len(data) == 0) {
+		return nil, errAccountNotFound
+	}
+	return data, err
+}
+
+func (s *rawdbStore) WriteAccount(blockNr types.Int256, addr types.Address, data []byte) error {
+	return rawdb.StoreAccount(s.db, s.changeDB, blockNr, addr, data)
+}
+
+func (s *rawdbStore) ForEachAccount(cb func(addr types.Address, data []byte) bool) error {
+	return rawdb.ForEachAccount(s.db, cb)
+}
+
+// memoryStore is an accountStore keeping the latest version of each account in
+// memory. It has no notion of history and is meant for tests.
+type memoryStore struct {
+	lock     sync.RWMutex
+	accounts map[types.Address][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{accounts: make(map[types.Address][]byte)}
+}
+
+func (s *memoryStore) ReadAccount(blockNr types.Int256, addr types.Address) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	data, ok := s.accounts[addr]
+	if !ok {
+		return nil, errAccountNotFound
+	}
+	return utils.Copy(data), nil
+}
+
+func (s *memoryStore) WriteAccount(blockNr types.Int256, addr types.Address, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.accounts[addr] = utils.Copy(data)
+	return nil
+}
+
+func (s *memoryStore) ForEachAccount(cb func(addr types.Address, data []byte) bool) error {
+	s.lock.RLock()
+	addrs := make([]types.Address, 0, len(s.accounts))
+	for addr := range s.accounts {
+		addrs = append(addrs, addr)
+	}
+	s.lock.RUnlock()
+
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+	for _, addr := range addrs {
+		data, err := s.ReadAccount(types.Int256{}, addr)
+		if err != nil {
+			return err
+		}
+		if !cb(addr, data) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import "github.com/amazechain/amc/common/types"
+
+// transientStorage is the storage of the accounts discarded at the end of each
+// transaction (EIP-1153).
+type transientStorage map[types.Address]Storage
+
+// TransientAccessStats counts the transient storage accesses of the current
+// transaction, for observability only.
+type TransientAccessStats struct {
+	Loads  int // Number of GetTransientState calls
+	Stores int // Number of SetTransientState calls
+}
+
+// SetTransientAccessCounting enables or disables the counting of the transient
+// storage accesses reported by TransientAccessStats. The counters start over
+// from zero when enabled and with every Prepare.
+func (s *StateDB) SetTransientAccessCounting(enabled bool) {
+	if enabled {
+		s.transientStats = new(TransientAccessStats)
+	} else {
+		s.transientStats = nil
+	}
+}
+
+// GetTransientState returns the transient storage slot of the account.
+func (s *StateDB) GetTransientState(addr types.Address, key types.Hash) types.Hash {
+	if s.transientStats != nil {
+		s.transientStats.Loads++
+	}
+	return s.transientStorage[addr][key]
+}
+
+// SetTransientState sets the transient storage slot of the account. The change
+// is journalled, but the slot is never committed.
+func (s *StateDB) SetTransientState(addr types.Address, key, value types.Hash) {
+	if s.transientStats != nil {
+		s.transientStats.Stores++
+	}
+	prev := s.transientStorage[addr][key]
+	if prev == value {
+		return
+	}
+	s.journal.append(transientStorageChange{account: &addr, key: key, prevalue: prev})
+	s.setTransientState(addr, key, value)
+}
+
+// setTransientState sets the transient storage slot without journalling it.
+func (s *StateDB) setTransientState(addr types.Address, key, value types.Hash) {
+	if s.transientStorage == nil {
+		s.transientStorage = make(transientStorage)
+	}
+	storage, ok := s.transientStorage[addr]
+	if !ok {
+		storage = make(Storage)
+		s.transientStorage[addr] = storage
+	}
+	storage[key] = value
+}
+
+// TransientAccessStats returns the transient storage accesses counted since the
+// current transaction was prepared, all zero if the counting is disabled.
+func (s *StateDB) TransientAccessStats() TransientAccessStats {
+	if s.transientStats == nil {
+		return TransientAccessStats{}
+	}
+	return *s.transientStats
+}
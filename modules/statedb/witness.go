@@ -0,0 +1,66 @@
+// Copyright 2022 The AmazeChain Authors
+// This file is part of the AmazeChain library.
+//
+// The AmazeChain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The AmazeChain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the AmazeChain library. If not, see <http://www.gnu.org/licenses/>.
+
+package statedb
+
+import (
+	"bytes"
+	"github.com/amazechain/amc/common/types"
+	"sort"
+)
+
+// SetReadWitness enables or disables the recording of the storage slots read,
+// as needed by the witness of stateless clients. Unlike the access trace, the
+// witness spans all the transactions since it was enabled, and enabling it
+// again starts a new one.
+func (s *StateDB) SetReadWitness(enabled bool) {
+	if enabled {
+		s.readWitness = make(map[types.Address]map[types.Hash]struct{})
+	} else {
+		s.readWitness = nil
+	}
+}
+
+// ReadWitness returns the storage slots read since the witness was enabled, by
+// account, in ascending key order. Slots read as empty are included, their
+// absence being part of the witness.
+func (s *StateDB) ReadWitness() map[types.Address][]types.Hash {
+	witness := make(map[types.Address][]types.Hash, len(s.readWitness))
+	for addr, slots := range s.readWitness {
+		keys := make([]types.Hash, 0, len(slots))
+		for key := range slots {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i][:], keys[j][:]) < 0
+		})
+		witness[addr] = keys
+	}
+	return witness
+}
+
+// witnessRead records a storage read if the witness is enabled.
+func (s *StateDB) witnessRead(addr types.Address, key types.Hash) {
+	if s.readWitness == nil {
+		return
+	}
+	slots, ok := s.readWitness[addr]
+	if !ok {
+		slots = make(map[types.Hash]struct{})
+		s.readWitness[addr] = slots
+	}
+	slots[key] = struct{}{}
+}
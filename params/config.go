@@ -480,6 +480,12 @@ func (c *ChainConfig) IsHeaderWithSeal() bool {
 	return c.Consensus == AuRaConsensus
 }
 
+// IsProofOfWork returns whether the blocks are mined by proof of work, rather
+// than proposed by validators.
+func (c *ChainConfig) IsProofOfWork() bool {
+	return c.Consensus == EtHashConsensus
+}
+
 type ConsensusSnapshotConfig struct {
 	CheckpointInterval uint64 // Number of blocks after which to save the vote snapshot to the database
 	InmemorySnapshots  int    // Number of recent vote snapshots to keep in memory